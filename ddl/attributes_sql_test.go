@@ -55,6 +55,11 @@ func (s *testDBSuite8) TestAlterTableAttributes(c *C) {
 	c.Assert(err, IsNil)
 	_, err = tk.Exec(`alter table t1 attributes " nomerge , somethingelse ";`)
 	c.Assert(err, IsNil)
+
+	// views have no key range to be labeled
+	tk.MustExec(`create view v1 as select * from t1;`)
+	_, err = tk.Exec(`alter table v1 attributes="nomerge";`)
+	c.Assert(err, ErrorMatches, ".*'test.v1' is not BASE TABLE")
 }
 
 func (s *testDBSuite8) TestAlterTablePartitionAttributes(c *C) {
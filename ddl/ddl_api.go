@@ -6219,6 +6219,12 @@ func (d *ddl) AlterTableAttributes(ctx sessionctx.Context, ident ast.Ident, spec
 		return errors.Trace(err)
 	}
 	meta := tb.Meta()
+	if err = label.CheckTableKeyRange(meta); err != nil {
+		if meta.TempTableType != model.TempTableNone {
+			return errors.Trace(ErrOptOnTemporaryTable.GenWithStackByArgs("alter table attributes"))
+		}
+		return errors.Trace(ErrWrongObject.GenWithStackByArgs(ident.Schema, ident.Name, "BASE TABLE"))
+	}
 
 	rule := label.NewRule()
 	err = rule.ApplyAttributesSpec(spec.AttributesSpec)
@@ -15,13 +15,17 @@
 package label
 
 import (
+	"sort"
 	"strings"
+
+	"github.com/pingcap/errors"
 )
 
 const (
 	dbKey        = "db"
 	tableKey     = "table"
 	partitionKey = "partition"
+	indexKey     = "index"
 )
 
 // Label is used to describe attributes
@@ -43,12 +47,37 @@ func NewLabels(attrs []string) Labels {
 	return labels
 }
 
+// validateAttributes checks the attributes before they are converted to labels. The attributes should be
+// non-empty and unique, and they shouldn't conflict with the labels reserved for the rule itself.
+func validateAttributes(attrs []string) error {
+	seen := make(map[string]struct{}, len(attrs))
+	for i, attr := range attrs {
+		key := strings.TrimSpace(attr)
+		if key == "" {
+			return errors.Errorf("attribute #%d is empty, remove the extra comma or quote", i+1)
+		}
+		if strings.Contains(key, "/") {
+			return errors.Errorf("attribute %q contains '/', which is used to separate the parts of the rule ID", key)
+		}
+		switch key {
+		case dbKey, tableKey, partitionKey, indexKey:
+			return errors.Errorf("attribute %q is reserved, it's set from the schema object of the rule automatically", key)
+		default:
+		}
+		if _, ok := seen[key]; ok {
+			return errors.Errorf("attribute %q is duplicated, specify it only once", key)
+		}
+		seen[key] = struct{}{}
+	}
+	return nil
+}
+
 // Restore converts Attributes to a string.
 func (labels *Labels) Restore() string {
 	var sb strings.Builder
 	for i, label := range *labels {
 		switch label.Key {
-		case dbKey, tableKey, partitionKey:
+		case dbKey, tableKey, partitionKey, indexKey:
 			continue
 		default:
 		}
@@ -84,3 +113,27 @@ func NewLabel(attr string) Label {
 func (a *Label) Restore() string {
 	return a.Key
 }
+
+func sortedLabels(labels Labels) Labels {
+	sorted := make(Labels, len(labels))
+	copy(sorted, labels)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Key != sorted[j].Key {
+			return sorted[i].Key < sorted[j].Key
+		}
+		return sorted[i].Value < sorted[j].Value
+	})
+	return sorted
+}
+
+func (labels Labels) equals(other Labels) bool {
+	if len(labels) != len(other) {
+		return false
+	}
+	for i := range labels {
+		if labels[i] != other[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -15,11 +15,18 @@
 package label
 
 import (
+	"bytes"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/pingcap/errors"
 	"github.com/pingcap/parser/ast"
+	"github.com/pingcap/parser/model"
+	"github.com/pingcap/tidb/kv"
 	"github.com/pingcap/tidb/tablecodec"
 	"github.com/pingcap/tidb/util/codec"
 	"gopkg.in/yaml.v2"
@@ -28,10 +35,19 @@ import (
 const (
 	// IDPrefix is the prefix for label rule ID.
 	IDPrefix = "schema"
+	// RawIDPrefix is the prefix for the ID of a label rule over a raw key range, the format follows "raw/name".
+	RawIDPrefix = "raw"
 
 	ruleType = "key-range"
 )
 
+// ErrNoKeyRange is returned for the tables which have no persistent key range, the rules reset for them would point
+// at meaningless keys, so no rule should be generated or pushed to PD.
+var ErrNoKeyRange = errors.New("the table has no persistent key range to be labeled")
+
+// MaxAttributes is the max number of attributes in an AttributesSpec, `0` means no limit.
+var MaxAttributes = 64
+
 var (
 	// TableIDFormat is the format of the label rule ID for a table.
 	// The format follows "schema/database_name/table_name".
@@ -39,6 +55,9 @@ var (
 	// PartitionIDFormat is the format of the label rule ID for a partition.
 	// The format follows "schema/database_name/table_name/partition_name".
 	PartitionIDFormat = "%s/%s/%s/%s"
+	// IndexIDFormat is the format of the label rule ID for an index, it's appended to the ID of the table or partition.
+	// The format follows "schema/database_name/table_name[/partition_name]/index/index_name".
+	IndexIDFormat = "%s/index/%s"
 )
 
 // Rule is used to establish the relationship between labels and a key range.
@@ -47,6 +66,10 @@ type Rule struct {
 	Labels   Labels      `json:"labels"`
 	RuleType string      `json:"rule_type"`
 	Rule     interface{} `json:"rule"`
+	// ExpireAt is when the rule expires, the rule never expires if it's nil.
+	ExpireAt *time.Time `json:"expire_at,omitempty"`
+	// Owner is the subsystem which manages the rule, it's empty for the rules created without an owner.
+	Owner string `json:"owner,omitempty"`
 }
 
 // NewRule creates a rule.
@@ -67,6 +90,12 @@ func (r *Rule) ApplyAttributesSpec(spec *ast.AttributesSpec) error {
 	if err != nil {
 		return err
 	}
+	if MaxAttributes > 0 && len(attributes) > MaxAttributes {
+		return errors.Errorf("too many attributes, %d attributes are specified but at most %d are allowed", len(attributes), MaxAttributes)
+	}
+	if err := validateAttributes(attributes); err != nil {
+		return err
+	}
 	r.Labels = NewLabels(attributes)
 	return nil
 }
@@ -75,20 +104,164 @@ func (r *Rule) ApplyAttributesSpec(spec *ast.AttributesSpec) error {
 func (r *Rule) String() string {
 	t, err := json.Marshal(r)
 	if err != nil {
-		return ""
+		return fmt.Sprintf("%+v (failed to marshal the rule: %v)", *(*jsonRule)(r), err)
 	}
 	return string(t)
 }
 
+// jsonRule has the same fields as Rule but none of its methods, it's used to avoid recursions when encoding
+// and decoding rules.
+type jsonRule Rule
+
+// MarshalJSON implements json.Marshaler.
+func (r *Rule) MarshalJSON() ([]byte, error) {
+	return json.Marshal((*jsonRule)(r))
+}
+
+// UnmarshalJSON implements json.Unmarshaler. The key range of a key-range rule is decoded as a
+// map[string]string, which is the same type as the one the rule is built with.
+func (r *Rule) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		*jsonRule
+		Rule json.RawMessage `json:"rule"`
+	}
+	raw.jsonRule = (*jsonRule)(r)
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	r.Rule = nil
+	if len(raw.Rule) == 0 || bytes.Equal(raw.Rule, []byte("null")) {
+		return nil
+	}
+	if r.RuleType == ruleType {
+		keyRange := make(map[string]string)
+		if err := json.Unmarshal(raw.Rule, &keyRange); err == nil {
+			r.Rule = keyRange
+			return nil
+		}
+	}
+	return json.Unmarshal(raw.Rule, &r.Rule)
+}
+
+// IsExpired checks whether the rule has expired at the given time.
+func (r *Rule) IsExpired(now time.Time) bool {
+	return r.ExpireAt != nil && !now.Before(*r.ExpireAt)
+}
+
 // Clone clones a rule.
 func (r *Rule) Clone() *Rule {
 	newRule := NewRule()
 	*newRule = *r
+	if r.Labels != nil {
+		newRule.Labels = make(Labels, len(r.Labels))
+		copy(newRule.Labels, r.Labels)
+	}
+	if keyRange, ok := r.Rule.(map[string]string); ok {
+		newKeyRange := make(map[string]string, len(keyRange))
+		for k, v := range keyRange {
+			newKeyRange[k] = v
+		}
+		newRule.Rule = newKeyRange
+	}
+	if r.ExpireAt != nil {
+		expireAt := *r.ExpireAt
+		newRule.ExpireAt = &expireAt
+	}
 	return newRule
 }
 
+// Equals checks whether the rules are identical. The labels are compared regardless of their order, and the key
+// ranges are compared after they are decoded, so a rule loaded from PD equals the one it's recomputed from.
+func (r *Rule) Equals(other *Rule) bool {
+	if r == nil || other == nil {
+		return r == other
+	}
+	if r.ID != other.ID || r.RuleType != other.RuleType || r.Owner != other.Owner || !sortedLabels(r.Labels).equals(sortedLabels(other.Labels)) {
+		return false
+	}
+	if (r.ExpireAt == nil) != (other.ExpireAt == nil) || (r.ExpireAt != nil && !r.ExpireAt.Equal(*other.ExpireAt)) {
+		return false
+	}
+	// The rule of a table without labels is never reset, so it has no key range.
+	if r.Rule == nil || other.Rule == nil {
+		return r.Rule == nil && other.Rule == nil
+	}
+	startKey, endKey, err := r.KeyRange()
+	if err != nil {
+		return false
+	}
+	otherStartKey, otherEndKey, err := other.KeyRange()
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(startKey, otherStartKey) && bytes.Equal(endKey, otherEndKey)
+}
+
+// CheckTableKeyRange returns ErrNoKeyRange if the table has no persistent key range, it should be checked before
+// the rule is reset for the table. The data of a temporary table lives in the memory of TiDB instead of TiKV, and
+// views and sequences have no rows in the key range of their IDs, so they have no regions to be labeled.
+// This version of the table meta has no cached tables, their rows live in TiKV like the normal tables.
+func CheckTableKeyRange(tblInfo *model.TableInfo) error {
+	if tblInfo.TempTableType != model.TempTableNone || tblInfo.IsView() || tblInfo.IsSequence() {
+		return errors.Trace(ErrNoKeyRange)
+	}
+	return nil
+}
+
 // Reset will reset the label rule for a table/partition with a given ID and names.
 func (r *Rule) Reset(id int64, dbName, tableName string, partName ...string) *Rule {
+	if !r.resetIDAndLabels(dbName, tableName, partName...) {
+		return r
+	}
+	r.setKeyRange(tablecodec.GenTableRecordPrefix(id), tablecodec.GenTableRecordPrefix(id+1))
+	return r
+}
+
+// ResetWithIndexes is like Reset, but the rule spans both the records and all the indexes of the table/partition.
+func (r *Rule) ResetWithIndexes(id int64, dbName, tableName string, partName ...string) *Rule {
+	if !r.resetIDAndLabels(dbName, tableName, partName...) {
+		return r
+	}
+	r.setKeyRange(tablecodec.GenTablePrefix(id), tablecodec.GenTablePrefix(id+1))
+	return r
+}
+
+// ResetIndex resets the label rule for an index of a table/partition, the rule only covers the keys of the index.
+func (r *Rule) ResetIndex(id, indexID int64, dbName, tableName, indexName string, partName ...string) *Rule {
+	hasLabels := r.resetIDAndLabels(dbName, tableName, partName...)
+	r.ID = fmt.Sprintf(IndexIDFormat, r.ID, indexName)
+	if !hasLabels {
+		return r
+	}
+	hasIndexKey := false
+	for i := range r.Labels {
+		if r.Labels[i].Key == indexKey {
+			r.Labels[i].Value = indexName
+			hasIndexKey = true
+		}
+	}
+	if !hasIndexKey {
+		r.Labels = append(r.Labels, Label{Key: indexKey, Value: indexName})
+	}
+	r.setKeyRange(tablecodec.EncodeTableIndexPrefix(id, indexID), tablecodec.EncodeTableIndexPrefix(id, indexID+1))
+	return r
+}
+
+// ResetRange resets the label rule for the records of a table/partition whose handles are in [startHandle, endHandle),
+// it's used to label a hot or cold sub-range instead of the whole table/partition.
+func (r *Rule) ResetRange(id int64, dbName, tableName string, startHandle, endHandle kv.Handle, partName ...string) error {
+	if startHandle.Compare(endHandle) >= 0 {
+		return errors.Errorf("the start handle %s is not less than the end handle %s", startHandle, endHandle)
+	}
+	if !r.resetIDAndLabels(dbName, tableName, partName...) {
+		return nil
+	}
+	r.setKeyRange(tablecodec.EncodeRowKeyWithHandle(id, startHandle), tablecodec.EncodeRowKeyWithHandle(id, endHandle))
+	return nil
+}
+
+// resetIDAndLabels resets the ID and the labels of the names, it returns false if the rule has no labels.
+func (r *Rule) resetIDAndLabels(dbName, tableName string, partName ...string) bool {
 	isPartition := len(partName) != 0
 	if isPartition {
 		r.ID = fmt.Sprintf(PartitionIDFormat, IDPrefix, dbName, tableName, partName[0])
@@ -96,7 +269,7 @@ func (r *Rule) Reset(id int64, dbName, tableName string, partName ...string) *Ru
 		r.ID = fmt.Sprintf(TableIDFormat, IDPrefix, dbName, tableName)
 	}
 	if len(r.Labels) == 0 {
-		return r
+		return false
 	}
 	var hasDBKey, hasTableKey, hasPartitionKey bool
 	for i := range r.Labels {
@@ -127,12 +300,91 @@ func (r *Rule) Reset(id int64, dbName, tableName string, partName ...string) *Ru
 	if isPartition && !hasPartitionKey {
 		r.Labels = append(r.Labels, Label{Key: partitionKey, Value: partName[0]})
 	}
+	return true
+}
+
+// ResetRawRange resets the rule to the given raw key range, which isn't tied to any table or partition.
+// The ID must be in the format of "raw/name", so it never collides with the rules of the tables.
+func (r *Rule) ResetRawRange(id string, startKey, endKey []byte, labels Labels) error {
+	if !isValidRawRuleID(id) {
+		return errors.Errorf("rule %q has an invalid ID, it should be in the format of %s/name", id, RawIDPrefix)
+	}
+	if bytes.Compare(startKey, endKey) >= 0 {
+		return errors.Errorf("rule %s has an invalid key range, the start key %x is not less than the end key %x", id, startKey, endKey)
+	}
+	r.ID = id
+	r.Labels = labels
+	r.setKeyRange(startKey, endKey)
+	return nil
+}
+
+// setKeyRange sets the key range of the rule, the keys are memcomparable encoded and then hex encoded.
+func (r *Rule) setKeyRange(startKey, endKey []byte) {
 	r.RuleType = ruleType
 	r.Rule = map[string]string{
-		"start_key": hex.EncodeToString(codec.EncodeBytes(nil, tablecodec.GenTableRecordPrefix(id))),
-		"end_key":   hex.EncodeToString(codec.EncodeBytes(nil, tablecodec.GenTableRecordPrefix(id+1))),
+		"start_key": hex.EncodeToString(codec.EncodeBytes(nil, startKey)),
+		"end_key":   hex.EncodeToString(codec.EncodeBytes(nil, endKey)),
 	}
-	return r
+}
+
+// HexKeyRange returns the keys of the rule as they are stored, which are hex encoded and memcomparable encoded.
+// The key range may be a map[string]string or a map[string]interface{}, depending on how the rule is built.
+func (r *Rule) HexKeyRange() (startKey, endKey string, err error) {
+	var startHex, endHex interface{}
+	switch rule := r.Rule.(type) {
+	case map[string]string:
+		startHex, endHex = rule["start_key"], rule["end_key"]
+	case map[string]interface{}:
+		startHex, endHex = rule["start_key"], rule["end_key"]
+	default:
+		return "", "", errors.Errorf("rule %s has an unexpected key range type %T", r.ID, r.Rule)
+	}
+	var ok bool
+	if startKey, ok = startHex.(string); !ok {
+		return "", "", errors.Errorf("rule %s has an invalid start key, unexpected key type %T", r.ID, startHex)
+	}
+	if endKey, ok = endHex.(string); !ok {
+		return "", "", errors.Errorf("rule %s has an invalid end key, unexpected key type %T", r.ID, endHex)
+	}
+	return startKey, endKey, nil
+}
+
+// KeyRange decodes the key range of the rule. The keys in the rule are hex encoded and memcomparable encoded.
+func (r *Rule) KeyRange() (startKey, endKey []byte, err error) {
+	startHex, endHex, err := r.HexKeyRange()
+	if err != nil {
+		return nil, nil, err
+	}
+	if startKey, err = decodeRuleKey(startHex); err != nil {
+		return nil, nil, errors.Annotatef(err, "rule %s has an invalid start key", r.ID)
+	}
+	if endKey, err = decodeRuleKey(endHex); err != nil {
+		return nil, nil, errors.Annotatef(err, "rule %s has an invalid end key", r.ID)
+	}
+	return startKey, endKey, nil
+}
+
+func decodeRuleKey(str string) ([]byte, error) {
+	encoded, err := hex.DecodeString(str)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	_, decoded, err := codec.DecodeBytes(encoded, nil)
+	return decoded, errors.Trace(err)
+}
+
+// ValidateIDMatchesRange checks whether the table resolved from the rule ID is the table of the key range.
+// The resolver returns the table or partition ID for the given rule ID.
+func (r *Rule) ValidateIDMatchesRange(resolver func(id string) int64) error {
+	startKey, _, err := r.KeyRange()
+	if err != nil {
+		return err
+	}
+	rangeTableID := tablecodec.DecodeTableID(startKey)
+	if idTableID := resolver(r.ID); idTableID != rangeTableID {
+		return errors.Errorf("rule %s is for table %d, but its key range is for table %d", r.ID, idTableID, rangeTableID)
+	}
+	return nil
 }
 
 // RulePatch is the patch to update the label rules.
@@ -148,3 +400,193 @@ func NewRulePatch(setRules []*Rule, deleteRules []string) *RulePatch {
 		DeleteRules: deleteRules,
 	}
 }
+
+// Validate checks the rules to set before the patch is pushed to PD, so a bad rule is reported by its ID instead
+// of failing at PD. Each rule must have an ID in the format of IDPrefix or RawIDPrefix, a key-range rule type,
+// and a decodable key range whose start key is less than its end key.
+func (p *RulePatch) Validate() error {
+	for _, rule := range p.SetRules {
+		if rule == nil {
+			return errors.New("the patch has a nil rule to set")
+		}
+		if !isValidRuleID(rule.ID) && !isValidRawRuleID(rule.ID) {
+			return errors.Errorf("rule %q has an invalid ID, it should be in the format of %s or %s/name", rule.ID, fmt.Sprintf(TableIDFormat, IDPrefix, "database_name", "table_name"), RawIDPrefix)
+		}
+		if rule.RuleType != ruleType {
+			return errors.Errorf("rule %s has an invalid rule type %q, it should be %q", rule.ID, rule.RuleType, ruleType)
+		}
+		startKey, endKey, err := rule.KeyRange()
+		if err != nil {
+			return err
+		}
+		if bytes.Compare(startKey, endKey) >= 0 {
+			return errors.Errorf("rule %s has an invalid key range, the start key %x is not less than the end key %x", rule.ID, startKey, endKey)
+		}
+	}
+	return nil
+}
+
+// isValidRuleID checks whether the ID starts with IDPrefix and names at least a database and a table.
+func isValidRuleID(id string) bool {
+	return hasIDParts(id, IDPrefix, 3)
+}
+
+// isValidRawRuleID checks whether the ID starts with RawIDPrefix and names the raw key range.
+func isValidRawRuleID(id string) bool {
+	return hasIDParts(id, RawIDPrefix, 2)
+}
+
+// hasIDParts checks whether the ID starts with the prefix and has at least minParts non-empty parts separated
+// by "/", the prefix included.
+func hasIDParts(id, prefix string, minParts int) bool {
+	parts := strings.Split(id, "/")
+	if len(parts) < minParts || parts[0] != prefix {
+		return false
+	}
+	for _, part := range parts[1:] {
+		if part == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// PatchSummary summarizes the changes of a RulePatch.
+type PatchSummary struct {
+	SetCount    int      `json:"set_count"`
+	DeleteCount int      `json:"delete_count"`
+	SetIDs      []string `json:"set_ids"`
+	DeleteIDs   []string `json:"delete_ids"`
+	// Labels are the distinct attributes of the rules to set, sorted by key.
+	Labels []string `json:"labels"`
+}
+
+// String implements fmt.Stringer.
+func (s *PatchSummary) String() string {
+	t, err := json.Marshal(s)
+	if err != nil {
+		return ""
+	}
+	return string(t)
+}
+
+// Summary returns the summary of the patch, it can be used to log the changes.
+func (p *RulePatch) Summary() PatchSummary {
+	summary := PatchSummary{
+		SetCount:    len(p.SetRules),
+		DeleteCount: len(p.DeleteRules),
+		SetIDs:      make([]string, 0, len(p.SetRules)),
+		DeleteIDs:   append([]string{}, p.DeleteRules...),
+		Labels:      []string{},
+	}
+	seen := make(map[string]struct{})
+	for _, rule := range p.SetRules {
+		summary.SetIDs = append(summary.SetIDs, rule.ID)
+		for _, label := range rule.Labels {
+			switch label.Key {
+			case dbKey, tableKey, partitionKey, indexKey:
+				continue
+			default:
+			}
+			if _, ok := seen[label.Key]; ok {
+				continue
+			}
+			seen[label.Key] = struct{}{}
+			summary.Labels = append(summary.Labels, label.Key)
+		}
+	}
+	sort.Strings(summary.Labels)
+	return summary
+}
+
+// MergePatches combines the patches into a single one, the later patches take precedence over the earlier
+// ones. A rule set by several patches is set by the last one, and a rule both set and deleted is only kept
+// in the set it ends up in. The sets of each patch are applied before its deletes, so a rule in both of them
+// is deleted.
+func MergePatches(patches ...*RulePatch) *RulePatch {
+	var (
+		setIDs    []string
+		deleteIDs []string
+		sets      = make(map[string]*Rule)
+		deletes   = make(map[string]bool)
+	)
+	for _, patch := range patches {
+		if patch == nil {
+			continue
+		}
+		for _, rule := range patch.SetRules {
+			if _, ok := sets[rule.ID]; !ok {
+				setIDs = append(setIDs, rule.ID)
+			}
+			sets[rule.ID] = rule
+			delete(deletes, rule.ID)
+		}
+		for _, id := range patch.DeleteRules {
+			if _, ok := deletes[id]; !ok {
+				deleteIDs = append(deleteIDs, id)
+			}
+			deletes[id] = true
+			delete(sets, id)
+		}
+	}
+
+	setRules := []*Rule{}
+	for _, id := range setIDs {
+		if rule, ok := sets[id]; ok {
+			setRules = append(setRules, rule)
+			// Keep the ID from being appended again if it's set multiple times.
+			delete(sets, id)
+		}
+	}
+	deleteRules := []string{}
+	for _, id := range deleteIDs {
+		if deletes[id] {
+			deleteRules = append(deleteRules, id)
+			delete(deletes, id)
+		}
+	}
+	return NewRulePatch(setRules, deleteRules)
+}
+
+// DiffRules returns a patch which changes the current rules into the desired ones, only the rules of the owner
+// are managed. The current rules of the owner which are not desired are deleted, and the desired rules which
+// differ from the current ones are set with the owner. A desired rule is skipped if its ID is taken by a rule of
+// another owner, so the rules of the others are left untouched.
+func DiffRules(owner string, current, desired []*Rule) *RulePatch {
+	currentRules := make(map[string]*Rule, len(current))
+	for _, rule := range current {
+		currentRules[rule.ID] = rule
+	}
+	setRules := []*Rule{}
+	desiredIDs := make(map[string]struct{}, len(desired))
+	for _, rule := range desired {
+		desiredIDs[rule.ID] = struct{}{}
+		cur, ok := currentRules[rule.ID]
+		if ok && cur.Owner != owner {
+			continue
+		}
+		rule = rule.Clone()
+		rule.Owner = owner
+		if !ok || !cur.Equals(rule) {
+			setRules = append(setRules, rule)
+		}
+	}
+	deleteRules := []string{}
+	for _, rule := range current {
+		if _, ok := desiredIDs[rule.ID]; !ok && rule.Owner == owner {
+			deleteRules = append(deleteRules, rule.ID)
+		}
+	}
+	return NewRulePatch(setRules, deleteRules)
+}
+
+// ExpiredRulesPatch returns a patch deleting all the rules expired at the given time.
+func ExpiredRulesPatch(rules []*Rule, now time.Time) *RulePatch {
+	deleteRules := []string{}
+	for _, rule := range rules {
+		if rule.IsExpired(now) {
+			deleteRules = append(deleteRules, rule.ID)
+		}
+	}
+	return NewRulePatch([]*Rule{}, deleteRules)
+}
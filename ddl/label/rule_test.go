@@ -15,8 +15,18 @@
 package label
 
 import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
 	. "github.com/pingcap/check"
+	"github.com/pingcap/errors"
 	"github.com/pingcap/parser/ast"
+	"github.com/pingcap/parser/model"
+	"github.com/pingcap/tidb/kv"
+	"github.com/pingcap/tidb/tablecodec"
+	"github.com/pingcap/tidb/util/codec"
 )
 
 var _ = Suite(&testRuleSuite{})
@@ -32,6 +42,50 @@ func (t *testRuleSuite) TestApplyAttributesSpec(c *C) {
 	c.Assert(rule.Labels[1].Key, Equals, "attr2")
 }
 
+func (t *testRuleSuite) TestApplyInvalidAttributesSpec(c *C) {
+	tests := []struct {
+		attributes string
+		err        string
+	}{
+		{`attr1,"",attr2`, `attribute #2 is empty.*`},
+		{`attr1," "`, `attribute #2 is empty.*`},
+		{`attr1,a/b`, `attribute "a/b" contains '/'.*`},
+		{`attr1,db`, `attribute "db" is reserved.*`},
+		{` table `, `attribute "table" is reserved.*`},
+		{`partition`, `attribute "partition" is reserved.*`},
+		{`index`, `attribute "index" is reserved.*`},
+		{`attr1,attr2, attr1 `, `attribute "attr1" is duplicated.*`},
+	}
+	for _, tt := range tests {
+		rule := NewRule()
+		err := rule.ApplyAttributesSpec(&ast.AttributesSpec{Attributes: tt.attributes})
+		c.Assert(err, ErrorMatches, tt.err, Commentf("%s", tt.attributes))
+		// The labels are left untouched.
+		c.Assert(rule.Labels, HasLen, 0)
+	}
+}
+
+func (t *testRuleSuite) TestMaxAttributes(c *C) {
+	defer func(max int) {
+		MaxAttributes = max
+	}(MaxAttributes)
+	MaxAttributes = 3
+
+	rule := NewRule()
+	c.Assert(rule.ApplyAttributesSpec(&ast.AttributesSpec{Attributes: "attr1,attr2,attr3"}), IsNil)
+	c.Assert(rule.Labels, HasLen, 3)
+
+	rule = NewRule()
+	err := rule.ApplyAttributesSpec(&ast.AttributesSpec{Attributes: "attr1,attr2,attr3,attr4"})
+	c.Assert(err, ErrorMatches, "too many attributes, 4 attributes are specified but at most 3 are allowed")
+	c.Assert(rule.Labels, HasLen, 0)
+
+	// No limit.
+	MaxAttributes = 0
+	c.Assert(rule.ApplyAttributesSpec(&ast.AttributesSpec{Attributes: "attr1,attr2,attr3,attr4"}), IsNil)
+	c.Assert(rule.Labels, HasLen, 4)
+}
+
 func (t *testRuleSuite) TestDefaultOrEmpty(c *C) {
 	spec := &ast.AttributesSpec{Attributes: ""}
 	rule := NewRule()
@@ -74,3 +128,397 @@ func (t *testRuleSuite) TestReset(c *C) {
 	c.Assert(r["start_key"], Equals, "7480000000000000ff025f720000000000fa")
 	c.Assert(r["end_key"], Equals, "7480000000000000ff035f720000000000fa")
 }
+
+func (t *testRuleSuite) TestCloneDeeply(c *C) {
+	rule := NewRule()
+	c.Assert(rule.ApplyAttributesSpec(&ast.AttributesSpec{Attributes: "attr"}), IsNil)
+	rule.Reset(1, "db1", "t1")
+	expireAt := time.Now()
+	rule.ExpireAt = &expireAt
+	origin := rule.String()
+
+	cloned := rule.Clone()
+	c.Assert(cloned, DeepEquals, rule)
+	cloned.Reset(2, "db2", "t2", "p2")
+	cloned.Labels[0].Key = "other"
+	*cloned.ExpireAt = expireAt.Add(time.Hour)
+	// The original rule is unchanged.
+	c.Assert(rule.String(), Equals, origin)
+	c.Assert(rule.Labels, HasLen, 3)
+	c.Assert(rule.Labels[0].Key, Equals, "attr")
+	c.Assert(rule.Labels[1].Value, Equals, "db1")
+	c.Assert(rule.Rule.(map[string]string)["start_key"], Equals, "7480000000000000ff015f720000000000fa")
+}
+
+func (t *testRuleSuite) TestJSONRoundTrip(c *C) {
+	rule := NewRule()
+	c.Assert(rule.ApplyAttributesSpec(&ast.AttributesSpec{Attributes: "attr"}), IsNil)
+	rule.Reset(1, "db1", "t1")
+	data, err := json.Marshal(rule)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, rule.String())
+
+	var loaded Rule
+	c.Assert(json.Unmarshal(data, &loaded), IsNil)
+	c.Assert(&loaded, DeepEquals, rule)
+	// The key range keeps its type.
+	_, ok := loaded.Rule.(map[string]string)
+	c.Assert(ok, IsTrue)
+
+	// The rules of other types are decoded generically.
+	c.Assert(json.Unmarshal([]byte(`{"id":"r1","rule_type":"other","rule":[1,2]}`), &loaded), IsNil)
+	c.Assert(loaded.Rule, DeepEquals, []interface{}{float64(1), float64(2)})
+	c.Assert(json.Unmarshal([]byte(`{"id":"r1","rule_type":"key-range","rule":null}`), &loaded), IsNil)
+	c.Assert(loaded.Rule, IsNil)
+	c.Assert(json.Unmarshal([]byte(`{"id":"r1","rule_type":"key-range","rule":{"start_key":1}}`), &loaded), IsNil)
+	c.Assert(loaded.Rule, DeepEquals, map[string]interface{}{"start_key": float64(1)})
+}
+
+func (t *testRuleSuite) TestHexKeyRange(c *C) {
+	rule := NewRule()
+	c.Assert(rule.ApplyAttributesSpec(&ast.AttributesSpec{Attributes: "attr"}), IsNil)
+	rule.Reset(1, "db1", "t1")
+	startKey, endKey, err := rule.HexKeyRange()
+	c.Assert(err, IsNil)
+	c.Assert(startKey, Equals, "7480000000000000ff015f720000000000fa")
+	c.Assert(endKey, Equals, "7480000000000000ff025f720000000000fa")
+
+	// The key range of the rules loaded from PD is a generic map.
+	rule.Rule = map[string]interface{}{"start_key": startKey, "end_key": endKey}
+	start, end, err := rule.HexKeyRange()
+	c.Assert(err, IsNil)
+	c.Assert(start, Equals, startKey)
+	c.Assert(end, Equals, endKey)
+
+	rule.Rule = map[string]interface{}{"start_key": float64(1), "end_key": endKey}
+	_, _, err = rule.HexKeyRange()
+	c.Assert(err, ErrorMatches, "rule schema/db1/t1 has an invalid start key, unexpected key type float64")
+	rule.Rule = []interface{}{}
+	_, _, err = rule.HexKeyRange()
+	c.Assert(err, ErrorMatches, `rule schema/db1/t1 has an unexpected key range type \[\]interface \{\}`)
+}
+
+func (t *testRuleSuite) TestStringWithMarshalError(c *C) {
+	rule := &Rule{ID: "schema/db1/t1", RuleType: ruleType, Rule: make(chan int)}
+	str := rule.String()
+	c.Assert(str, Matches, `\{ID:schema/db1/t1 .*RuleType:key-range .*\(failed to marshal the rule: json: .*unsupported type: chan int\)`)
+}
+
+func (t *testRuleSuite) TestValidateIDMatchesRange(c *C) {
+	spec := &ast.AttributesSpec{Attributes: "attr"}
+	rule := NewRule()
+	rule.ApplyAttributesSpec(spec)
+	rule.Reset(10, "db", "t1")
+	resolver := func(id string) int64 {
+		if id == "schema/db/t1" {
+			return 10
+		}
+		return 0
+	}
+	c.Assert(rule.ValidateIDMatchesRange(resolver), IsNil)
+
+	// hand-edited rule whose ID doesn't match its range
+	mismatched := NewRule()
+	mismatched.ApplyAttributesSpec(spec)
+	mismatched.Reset(11, "db", "t2")
+	mismatched.ID = "schema/db/t1"
+	err := mismatched.ValidateIDMatchesRange(resolver)
+	c.Assert(err, ErrorMatches, "rule schema/db/t1 is for table 10, but its key range is for table 11")
+
+	mismatched.Rule = map[string]string{"start_key": "zz", "end_key": "zz"}
+	c.Assert(mismatched.ValidateIDMatchesRange(resolver), NotNil)
+}
+
+func (t *testRuleSuite) TestExpiredRulesPatch(c *C) {
+	now := time.Now()
+	past, future := now.Add(-time.Hour), now.Add(time.Hour)
+	rules := []*Rule{
+		{ID: "schema/db/t1", ExpireAt: &past},
+		{ID: "schema/db/t2"},
+		{ID: "schema/db/t3", ExpireAt: &future},
+		{ID: "schema/db/t4", ExpireAt: &now},
+	}
+	c.Assert(rules[0].IsExpired(now), IsTrue)
+	c.Assert(rules[1].IsExpired(now), IsFalse)
+	c.Assert(rules[2].IsExpired(now), IsFalse)
+
+	patch := ExpiredRulesPatch(rules, now)
+	c.Assert(patch.SetRules, HasLen, 0)
+	c.Assert(patch.DeleteRules, DeepEquals, []string{"schema/db/t1", "schema/db/t4"})
+
+	patch = ExpiredRulesPatch(rules, past.Add(-time.Hour))
+	c.Assert(patch.DeleteRules, HasLen, 0)
+}
+
+func (t *testRuleSuite) TestDiffRules(c *C) {
+	labels := Labels{{Key: "hotspot", Value: "idx"}}
+	current := []*Rule{
+		{ID: "raw/a", Labels: labels, Owner: "placement"},
+		{ID: "raw/b", Labels: labels, Owner: "placement"},
+		{ID: "raw/c", Labels: labels, Owner: "placement"},
+		{ID: "raw/d", Labels: labels, Owner: "tiflash"},
+		{ID: "raw/e", Labels: labels},
+	}
+	desired := []*Rule{
+		// Unchanged.
+		{ID: "raw/a", Labels: labels},
+		// Changed.
+		{ID: "raw/b", Labels: Labels{{Key: "hotspot", Value: "row"}}},
+		// Taken by other owners.
+		{ID: "raw/d", Labels: Labels{{Key: "hotspot", Value: "row"}}},
+		{ID: "raw/e", Labels: Labels{{Key: "hotspot", Value: "row"}}},
+		// New.
+		{ID: "raw/f", Labels: labels},
+	}
+	patch := DiffRules("placement", current, desired)
+	c.Assert(patch.SetRules, HasLen, 2)
+	c.Assert(patch.SetRules[0].ID, Equals, "raw/b")
+	c.Assert(patch.SetRules[0].Owner, Equals, "placement")
+	c.Assert(patch.SetRules[1].ID, Equals, "raw/f")
+	c.Assert(patch.SetRules[1].Owner, Equals, "placement")
+	c.Assert(patch.DeleteRules, DeepEquals, []string{"raw/c"})
+	// The desired rules are not modified.
+	c.Assert(desired[1].Owner, Equals, "")
+
+	// The rules of the other owners are left untouched even if nothing is desired.
+	patch = DiffRules("placement", current, nil)
+	c.Assert(patch.SetRules, HasLen, 0)
+	c.Assert(patch.DeleteRules, DeepEquals, []string{"raw/a", "raw/b", "raw/c"})
+	patch = DiffRules("", current, nil)
+	c.Assert(patch.DeleteRules, DeepEquals, []string{"raw/e"})
+
+	// The owner is encoded in JSON.
+	data, err := json.Marshal(current[0])
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Matches, `.*"owner":"placement".*`)
+	data, err = json.Marshal(current[4])
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Not(Matches), `.*"owner".*`)
+}
+
+func (t *testRuleSuite) TestResetRawRange(c *C) {
+	labels := Labels{{Key: "hotspot", Value: "idx"}}
+	rule := NewRule()
+	err := rule.ResetRawRange("raw/hotspot", []byte("a"), []byte("b"), labels)
+	c.Assert(err, IsNil)
+	c.Assert(rule.ID, Equals, "raw/hotspot")
+	c.Assert(rule.Labels, DeepEquals, labels)
+	c.Assert(rule.RuleType, Equals, ruleType)
+	c.Assert(rule.Rule, DeepEquals, map[string]string{
+		"start_key": hex.EncodeToString(codec.EncodeBytes(nil, []byte("a"))),
+		"end_key":   hex.EncodeToString(codec.EncodeBytes(nil, []byte("b"))),
+	})
+	startKey, endKey, err := rule.KeyRange()
+	c.Assert(err, IsNil)
+	c.Assert(startKey, DeepEquals, []byte("a"))
+	c.Assert(endKey, DeepEquals, []byte("b"))
+
+	err = NewRule().ResetRawRange("raw/hotspot", []byte("b"), []byte("a"), labels)
+	c.Assert(err, ErrorMatches, "rule raw/hotspot has an invalid key range.*")
+	err = NewRule().ResetRawRange("raw/hotspot", []byte("a"), []byte("a"), labels)
+	c.Assert(err, NotNil)
+	for _, id := range []string{"hotspot", "raw/", "schema/db1/t1", ""} {
+		err = NewRule().ResetRawRange(id, []byte("a"), []byte("b"), labels)
+		c.Assert(err, ErrorMatches, `rule ".*" has an invalid ID, it should be in the format of raw/name`)
+	}
+}
+
+func (t *testRuleSuite) TestMergePatches(c *C) {
+	t1, t2, t3 := &Rule{ID: "schema/db/t1"}, &Rule{ID: "schema/db/t2"}, &Rule{ID: "schema/db/t3"}
+	newT1 := &Rule{ID: "schema/db/t1", Labels: Labels{{Key: "attr", Value: "true"}}}
+
+	patch := MergePatches(
+		NewRulePatch([]*Rule{t1, t2}, []string{"schema/db/t4"}),
+		nil,
+		NewRulePatch([]*Rule{newT1}, []string{"schema/db/t2", "schema/db/t4"}),
+		NewRulePatch([]*Rule{t3}, []string{"schema/db/t3"}),
+	)
+	// The last set of t1 wins, and t2 and t3 are set before they're deleted.
+	c.Assert(patch.SetRules, DeepEquals, []*Rule{newT1})
+	c.Assert(patch.DeleteRules, DeepEquals, []string{"schema/db/t4", "schema/db/t2", "schema/db/t3"})
+
+	// A rule set after it's deleted is kept.
+	patch = MergePatches(NewRulePatch(nil, []string{"schema/db/t1"}), NewRulePatch([]*Rule{t1}, nil))
+	c.Assert(patch.SetRules, DeepEquals, []*Rule{t1})
+	c.Assert(patch.DeleteRules, HasLen, 0)
+
+	patch = MergePatches()
+	c.Assert(patch.SetRules, HasLen, 0)
+	c.Assert(patch.DeleteRules, HasLen, 0)
+}
+
+func (t *testRuleSuite) TestPatchSummary(c *C) {
+	t1 := NewRule()
+	c.Assert(t1.ApplyAttributesSpec(&ast.AttributesSpec{Attributes: "nomerge,hot"}), IsNil)
+	t1.Reset(1, "db", "t1")
+	t2 := NewRule()
+	c.Assert(t2.ApplyAttributesSpec(&ast.AttributesSpec{Attributes: "hot"}), IsNil)
+	t2.Reset(2, "db", "t2", "p0")
+
+	summary := NewRulePatch([]*Rule{t1, t2}, []string{"schema/db/t3"}).Summary()
+	c.Assert(summary.SetCount, Equals, 2)
+	c.Assert(summary.DeleteCount, Equals, 1)
+	c.Assert(summary.SetIDs, DeepEquals, []string{"schema/db/t1", "schema/db/t2/p0"})
+	c.Assert(summary.DeleteIDs, DeepEquals, []string{"schema/db/t3"})
+	// The labels of the schema objects are left out.
+	c.Assert(summary.Labels, DeepEquals, []string{"hot", "nomerge"})
+	c.Assert(summary.String(), Equals, `{"set_count":2,"delete_count":1,"set_ids":["schema/db/t1","schema/db/t2/p0"],"delete_ids":["schema/db/t3"],"labels":["hot","nomerge"]}`)
+
+	summary = NewRulePatch([]*Rule{}, []string{}).Summary()
+	c.Assert(summary.SetCount, Equals, 0)
+	c.Assert(summary.SetIDs, HasLen, 0)
+	c.Assert(summary.DeleteIDs, HasLen, 0)
+}
+
+func (t *testRuleSuite) TestResetRange(c *C) {
+	rule := NewRule()
+	rule.ApplyAttributesSpec(&ast.AttributesSpec{Attributes: "hot"})
+	err := rule.ResetRange(2, "db1", "t1", kv.IntHandle(100), kv.IntHandle(200), "p202109")
+	c.Assert(err, IsNil)
+	c.Assert(rule.ID, Equals, "schema/db1/t1/p202109")
+	c.Assert(rule.RuleType, Equals, ruleType)
+	c.Assert(rule.Labels, HasLen, 4)
+	c.Assert(rule.Labels[3], Equals, Label{Key: partitionKey, Value: "p202109"})
+	startKey, endKey, err := rule.KeyRange()
+	c.Assert(err, IsNil)
+	c.Assert(startKey, DeepEquals, []byte(tablecodec.EncodeRowKeyWithHandle(2, kv.IntHandle(100))))
+	c.Assert(endKey, DeepEquals, []byte(tablecodec.EncodeRowKeyWithHandle(2, kv.IntHandle(200))))
+	// The sub-range is narrower than the range of the whole partition.
+	c.Assert(bytes.Compare(startKey, tablecodec.GenTableRecordPrefix(2)), Equals, 1)
+	c.Assert(bytes.Compare(endKey, tablecodec.GenTableRecordPrefix(3)), Equals, -1)
+
+	err = NewRule().ResetRange(2, "db1", "t1", kv.IntHandle(200), kv.IntHandle(100))
+	c.Assert(err, ErrorMatches, "the start handle 200 is not less than the end handle 100")
+}
+
+func (t *testRuleSuite) TestResetIndex(c *C) {
+	rule := NewRule()
+	rule.ApplyAttributesSpec(&ast.AttributesSpec{Attributes: "isolated"})
+	rule.ResetIndex(2, 3, "db1", "t1", "idx1")
+	c.Assert(rule.ID, Equals, "schema/db1/t1/index/idx1")
+	c.Assert(rule.RuleType, Equals, ruleType)
+	c.Assert(rule.Labels, HasLen, 4)
+	c.Assert(rule.Labels[3], Equals, Label{Key: indexKey, Value: "idx1"})
+	c.Assert(rule.Labels.Restore(), Equals, `"isolated"`)
+	startKey, endKey, err := rule.KeyRange()
+	c.Assert(err, IsNil)
+	c.Assert(startKey, DeepEquals, []byte(tablecodec.EncodeTableIndexPrefix(2, 3)))
+	c.Assert(endKey, DeepEquals, []byte(tablecodec.EncodeTableIndexPrefix(2, 4)))
+
+	// The index label is updated when the rule is reset for another index.
+	rule.ResetIndex(4, 1, "db1", "t1", "idx2", "p0")
+	c.Assert(rule.ID, Equals, "schema/db1/t1/p0/index/idx2")
+	c.Assert(rule.Labels, HasLen, 5)
+	c.Assert(rule.Labels[3], Equals, Label{Key: indexKey, Value: "idx2"})
+	c.Assert(rule.Labels[4], Equals, Label{Key: partitionKey, Value: "p0"})
+}
+
+func (t *testRuleSuite) TestResetWithIndexes(c *C) {
+	rule := NewRule()
+	rule.ApplyAttributesSpec(&ast.AttributesSpec{Attributes: "attr"})
+	rule.ResetWithIndexes(2, "db1", "t1")
+	c.Assert(rule.ID, Equals, "schema/db1/t1")
+	startKey, endKey, err := rule.KeyRange()
+	c.Assert(err, IsNil)
+	// Both the records and the indexes of the table are covered.
+	for _, key := range [][]byte{tablecodec.GenTableRecordPrefix(2), tablecodec.EncodeTableIndexPrefix(2, 1)} {
+		c.Assert(bytes.Compare(key, startKey) >= 0 && bytes.Compare(key, endKey) < 0, IsTrue)
+	}
+	c.Assert(bytes.Compare(tablecodec.GenTablePrefix(3), endKey), Equals, 0)
+}
+
+func (t *testRuleSuite) TestCheckTableKeyRange(c *C) {
+	c.Assert(CheckTableKeyRange(&model.TableInfo{ID: 2}), IsNil)
+	for _, tp := range []model.TempTableType{model.TempTableGlobal, model.TempTableLocal} {
+		err := CheckTableKeyRange(&model.TableInfo{ID: 2, TempTableType: tp})
+		c.Assert(errors.Cause(err), Equals, ErrNoKeyRange)
+	}
+	err := CheckTableKeyRange(&model.TableInfo{ID: 2, View: &model.ViewInfo{}})
+	c.Assert(errors.Cause(err), Equals, ErrNoKeyRange)
+	err = CheckTableKeyRange(&model.TableInfo{ID: 2, Sequence: &model.SequenceInfo{}})
+	c.Assert(errors.Cause(err), Equals, ErrNoKeyRange)
+}
+
+func (t *testRuleSuite) TestValidatePatch(c *C) {
+	newTableRule := func(id int64, tableName string) *Rule {
+		rule := NewRule()
+		c.Assert(rule.ApplyAttributesSpec(&ast.AttributesSpec{Attributes: "attr"}), IsNil)
+		return rule.Reset(id, "db1", tableName)
+	}
+	c.Assert(NewRulePatch(nil, []string{"schema/db1/t1"}).Validate(), IsNil)
+	c.Assert(NewRulePatch([]*Rule{newTableRule(1, "t1"), newTableRule(2, "t2")}, nil).Validate(), IsNil)
+	// The rules over raw key ranges are valid as well.
+	rawRule := NewRule()
+	c.Assert(rawRule.ResetRawRange("raw/hotspot", []byte("a"), []byte("b"), Labels{{Key: "hotspot", Value: "idx"}}), IsNil)
+	c.Assert(NewRulePatch([]*Rule{newTableRule(1, "t1"), rawRule}, nil).Validate(), IsNil)
+
+	invalidID := newTableRule(3, "t3")
+	invalidID.ID = "db1/t3"
+	invalidType := newTableRule(4, "t4")
+	invalidType.RuleType = "label"
+	invalidKey := newTableRule(5, "t5")
+	invalidKey.Rule = map[string]string{"start_key": "xyz", "end_key": "xyz"}
+	invalidRange := NewRule()
+	invalidRange.ID = "schema/db1/t6"
+	invalidRange.setKeyRange([]byte("b"), []byte("a"))
+	cases := []struct {
+		rule *Rule
+		err  string
+	}{
+		{invalidID, `rule "db1/t3" has an invalid ID.*`},
+		{invalidType, `rule schema/db1/t4 has an invalid rule type "label".*`},
+		{invalidKey, `rule schema/db1/t5 has an invalid start key.*`},
+		{invalidRange, `rule schema/db1/t6 has an invalid key range.*`},
+		{nil, `the patch has a nil rule to set`},
+	}
+	for _, ca := range cases {
+		// The first offending rule is reported.
+		err := NewRulePatch([]*Rule{newTableRule(1, "t1"), ca.rule, invalidID}, nil).Validate()
+		c.Assert(err, ErrorMatches, ca.err)
+	}
+}
+
+func (t *testRuleSuite) TestEquals(c *C) {
+	newTableRule := func(attributes string) *Rule {
+		rule := NewRule()
+		c.Assert(rule.ApplyAttributesSpec(&ast.AttributesSpec{Attributes: attributes}), IsNil)
+		return rule.Reset(1, "db1", "t1")
+	}
+	rule := newTableRule("attr1,attr2")
+	c.Assert(rule.Equals(rule.Clone()), IsTrue)
+	c.Assert(rule.Equals(nil), IsFalse)
+	c.Assert((*Rule)(nil).Equals(nil), IsTrue)
+
+	// The order of the labels doesn't matter.
+	c.Assert(rule.Equals(newTableRule("attr2,attr1")), IsTrue)
+	c.Assert(rule.Equals(newTableRule("attr1")), IsFalse)
+
+	var loaded Rule
+	c.Assert(json.Unmarshal([]byte(rule.String()), &loaded), IsNil)
+	c.Assert(rule.Equals(&loaded), IsTrue)
+	// The rule with a generic key range map.
+	keyRange := loaded.Rule.(map[string]string)
+	loaded.Rule = map[string]interface{}{"start_key": keyRange["start_key"], "end_key": keyRange["end_key"]}
+	c.Assert(rule.Equals(&loaded), IsTrue)
+
+	other := rule.Clone()
+	other.Rule = map[string]string{
+		"start_key": hex.EncodeToString(codec.EncodeBytes(nil, []byte("a"))),
+		"end_key":   hex.EncodeToString(codec.EncodeBytes(nil, []byte("b"))),
+	}
+	c.Assert(rule.Equals(other), IsFalse)
+	other = rule.Clone()
+	other.ID = "schema/db1/t2"
+	c.Assert(rule.Equals(other), IsFalse)
+	other = rule.Clone()
+	expireAt := time.Now()
+	other.ExpireAt = &expireAt
+	c.Assert(rule.Equals(other), IsFalse)
+
+	// The default rules have neither labels nor key ranges.
+	defaultRule := NewRule()
+	c.Assert(defaultRule.ApplyAttributesSpec(&ast.AttributesSpec{Default: true}), IsNil)
+	defaultRule.Reset(1, "db1", "t1")
+	c.Assert(defaultRule.Equals(newTableRule("")), IsTrue)
+	c.Assert(defaultRule.Equals(rule), IsFalse)
+}
@@ -1266,6 +1266,10 @@ func getOldLabelRules(tblInfo *model.TableInfo, oldSchemaName, oldTableName stri
 }
 
 func updateLabelRules(job *model.Job, tblInfo *model.TableInfo, oldRules map[string]*label.Rule, tableRuleID string, partRuleIDs, oldRuleIDs []string, tID int64) error {
+	if err := label.CheckTableKeyRange(tblInfo); err != nil {
+		// No rule is pushed for the table, the old rules are deleted only.
+		return infosync.UpdateLabelRules(context.TODO(), label.NewRulePatch(nil, oldRuleIDs))
+	}
 	var newRules []*label.Rule
 	if r, ok := oldRules[tableRuleID]; ok {
 		newRules = append(newRules, r.Clone().Reset(tID, job.SchemaName, tblInfo.Name.L))
@@ -247,8 +247,21 @@ func (builder *RequestBuilder) SetFromSessionVars(sv *variable.SessionVars) *Req
 	builder.Request.IsolationLevel = builder.getIsolationLevel()
 	builder.Request.NotFillCache = sv.StmtCtx.NotFillCache
 	builder.Request.TaskID = sv.StmtCtx.TaskID
+	builder.Request.ConnID = sv.ConnectionID
 	builder.Request.Priority = builder.getKVPriority(sv)
 	builder.Request.ReplicaRead = sv.GetReplicaRead()
+	builder.Request.BatchCopMaxRegions = sv.BatchCopMaxRegions
+	builder.Request.BatchCopStrictDuplicateRegion = sv.BatchCopStrictDuplicateRegion
+	builder.Request.BatchCopVerifyCoverage = sv.BatchCopVerifyCoverage
+	builder.Request.BatchCopDisableBalance = sv.BatchCopDisableBalance
+	builder.Request.BatchCopMaxTaskRebuilds = sv.BatchCopMaxTaskRebuilds
+	builder.Request.BatchCopBackoffSoftCap = sv.BatchCopBackoffSoftCap
+	builder.Request.BatchCopDuplicateStartKey = sv.BatchCopDuplicateStartKey
+	builder.Request.MetricLabel = sv.BatchCopMetricLabel
+	builder.Request.BatchCopStoreMaxBytes = sv.BatchCopStoreMaxBytes
+	builder.Request.FailOnAllTiFlashReplicasFailed = sv.BatchCopReplicaFailFast
+	builder.Request.BatchCopCloseGracePeriod = sv.BatchCopCloseGracePeriod
+	builder.Request.TiFlashMaxExecutionTime = sv.TiFlashMaxExecutionTime
 	builder.SetResourceGroupTag(sv.StmtCtx)
 	return builder
 }
@@ -16,6 +16,7 @@ package distsql
 
 import (
 	"testing"
+	"time"
 
 	"github.com/pingcap/parser/mysql"
 	"github.com/pingcap/tidb/kv"
@@ -252,17 +253,19 @@ func TestRequestBuilder1(t *testing.T) {
 				EndKey:   kv.Key{0x74, 0x80, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0xc, 0x5f, 0x72, 0x80, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x23},
 			},
 		},
-		Cacheable:      true,
-		KeepOrder:      false,
-		Desc:           false,
-		Concurrency:    variable.DefDistSQLScanConcurrency,
-		IsolationLevel: 0,
-		Priority:       0,
-		NotFillCache:   false,
-		SyncLog:        false,
-		Streaming:      false,
-		ReplicaRead:    kv.ReplicaReadLeader,
-		TxnScope:       oracle.GlobalTxnScope,
+		Cacheable:                 true,
+		KeepOrder:                 false,
+		Desc:                      false,
+		Concurrency:               variable.DefDistSQLScanConcurrency,
+		IsolationLevel:            0,
+		Priority:                  0,
+		NotFillCache:              false,
+		SyncLog:                   false,
+		Streaming:                 false,
+		ReplicaRead:               kv.ReplicaReadLeader,
+		TxnScope:                  oracle.GlobalTxnScope,
+		BatchCopMaxTaskRebuilds:   variable.DefTiDBBatchCopMaxTaskRebuilds,
+		BatchCopDuplicateStartKey: variable.DefTiDBBatchCopDuplicateStartKey,
 	}
 	require.Equal(t, expect, actual)
 }
@@ -330,17 +333,19 @@ func TestRequestBuilder2(t *testing.T) {
 				EndKey:   kv.Key{0x74, 0x80, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0xc, 0x5f, 0x69, 0x80, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0xf, 0x3, 0x80, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x23},
 			},
 		},
-		Cacheable:      true,
-		KeepOrder:      false,
-		Desc:           false,
-		Concurrency:    variable.DefDistSQLScanConcurrency,
-		IsolationLevel: 0,
-		Priority:       0,
-		NotFillCache:   false,
-		SyncLog:        false,
-		Streaming:      false,
-		ReplicaRead:    kv.ReplicaReadLeader,
-		TxnScope:       oracle.GlobalTxnScope,
+		Cacheable:                 true,
+		KeepOrder:                 false,
+		Desc:                      false,
+		Concurrency:               variable.DefDistSQLScanConcurrency,
+		IsolationLevel:            0,
+		Priority:                  0,
+		NotFillCache:              false,
+		SyncLog:                   false,
+		Streaming:                 false,
+		ReplicaRead:               kv.ReplicaReadLeader,
+		TxnScope:                  oracle.GlobalTxnScope,
+		BatchCopMaxTaskRebuilds:   variable.DefTiDBBatchCopMaxTaskRebuilds,
+		BatchCopDuplicateStartKey: variable.DefTiDBBatchCopDuplicateStartKey,
 	}
 	require.Equal(t, expect, actual)
 }
@@ -379,17 +384,19 @@ func TestRequestBuilder3(t *testing.T) {
 				EndKey:   kv.Key{0x74, 0x80, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0xf, 0x5f, 0x72, 0x80, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x65},
 			},
 		},
-		Cacheable:      true,
-		KeepOrder:      false,
-		Desc:           false,
-		Concurrency:    variable.DefDistSQLScanConcurrency,
-		IsolationLevel: 0,
-		Priority:       0,
-		NotFillCache:   false,
-		SyncLog:        false,
-		Streaming:      false,
-		ReplicaRead:    kv.ReplicaReadLeader,
-		TxnScope:       oracle.GlobalTxnScope,
+		Cacheable:                 true,
+		KeepOrder:                 false,
+		Desc:                      false,
+		Concurrency:               variable.DefDistSQLScanConcurrency,
+		IsolationLevel:            0,
+		Priority:                  0,
+		NotFillCache:              false,
+		SyncLog:                   false,
+		Streaming:                 false,
+		ReplicaRead:               kv.ReplicaReadLeader,
+		TxnScope:                  oracle.GlobalTxnScope,
+		BatchCopMaxTaskRebuilds:   variable.DefTiDBBatchCopMaxTaskRebuilds,
+		BatchCopDuplicateStartKey: variable.DefTiDBBatchCopDuplicateStartKey,
 	}
 	require.Equal(t, expect, actual)
 }
@@ -424,21 +431,23 @@ func TestRequestBuilder4(t *testing.T) {
 		Build()
 	require.NoError(t, err)
 	expect := &kv.Request{
-		Tp:             103,
-		StartTs:        0x0,
-		Data:           []uint8{0x18, 0x0, 0x20, 0x0, 0x40, 0x0, 0x5a, 0x0},
-		KeyRanges:      keyRanges,
-		Cacheable:      true,
-		KeepOrder:      false,
-		Desc:           false,
-		Concurrency:    variable.DefDistSQLScanConcurrency,
-		IsolationLevel: 0,
-		Priority:       0,
-		Streaming:      true,
-		NotFillCache:   false,
-		SyncLog:        false,
-		ReplicaRead:    kv.ReplicaReadLeader,
-		TxnScope:       oracle.GlobalTxnScope,
+		Tp:                        103,
+		StartTs:                   0x0,
+		Data:                      []uint8{0x18, 0x0, 0x20, 0x0, 0x40, 0x0, 0x5a, 0x0},
+		KeyRanges:                 keyRanges,
+		Cacheable:                 true,
+		KeepOrder:                 false,
+		Desc:                      false,
+		Concurrency:               variable.DefDistSQLScanConcurrency,
+		IsolationLevel:            0,
+		Priority:                  0,
+		Streaming:                 true,
+		NotFillCache:              false,
+		SyncLog:                   false,
+		ReplicaRead:               kv.ReplicaReadLeader,
+		TxnScope:                  oracle.GlobalTxnScope,
+		BatchCopMaxTaskRebuilds:   variable.DefTiDBBatchCopMaxTaskRebuilds,
+		BatchCopDuplicateStartKey: variable.DefTiDBBatchCopDuplicateStartKey,
 	}
 	require.Equal(t, expect, actual)
 }
@@ -541,18 +550,20 @@ func TestRequestBuilder7(t *testing.T) {
 				Build()
 			require.NoError(t, err)
 			expect := &kv.Request{
-				Tp:             0,
-				StartTs:        0x0,
-				KeepOrder:      false,
-				Desc:           false,
-				Concurrency:    concurrency,
-				IsolationLevel: 0,
-				Priority:       0,
-				NotFillCache:   false,
-				SyncLog:        false,
-				Streaming:      false,
-				ReplicaRead:    replicaRead.replicaReadType,
-				TxnScope:       oracle.GlobalTxnScope,
+				Tp:                        0,
+				StartTs:                   0x0,
+				KeepOrder:                 false,
+				Desc:                      false,
+				Concurrency:               concurrency,
+				IsolationLevel:            0,
+				Priority:                  0,
+				NotFillCache:              false,
+				SyncLog:                   false,
+				Streaming:                 false,
+				ReplicaRead:               replicaRead.replicaReadType,
+				TxnScope:                  oracle.GlobalTxnScope,
+				BatchCopMaxTaskRebuilds:   variable.DefTiDBBatchCopMaxTaskRebuilds,
+				BatchCopDuplicateStartKey: variable.DefTiDBBatchCopDuplicateStartKey,
 			}
 			require.Equal(t, expect, actual)
 		})
@@ -567,19 +578,54 @@ func TestRequestBuilder8(t *testing.T) {
 		Build()
 	require.NoError(t, err)
 	expect := &kv.Request{
-		Tp:             0,
-		StartTs:        0x0,
-		Data:           []uint8(nil),
-		Concurrency:    variable.DefDistSQLScanConcurrency,
-		IsolationLevel: 0,
-		Priority:       0,
-		MemTracker:     (*memory.Tracker)(nil),
-		SchemaVar:      0,
-		TxnScope:       oracle.GlobalTxnScope,
+		Tp:                        0,
+		StartTs:                   0x0,
+		Data:                      []uint8(nil),
+		Concurrency:               variable.DefDistSQLScanConcurrency,
+		IsolationLevel:            0,
+		Priority:                  0,
+		MemTracker:                (*memory.Tracker)(nil),
+		SchemaVar:                 0,
+		TxnScope:                  oracle.GlobalTxnScope,
+		BatchCopMaxTaskRebuilds:   variable.DefTiDBBatchCopMaxTaskRebuilds,
+		BatchCopDuplicateStartKey: variable.DefTiDBBatchCopDuplicateStartKey,
 	}
 	require.Equal(t, expect, actual)
 }
 
+func TestRequestBuilderBatchCopVars(t *testing.T) {
+	t.Parallel()
+	sv := variable.NewSessionVars()
+	require.NoError(t, sv.SetSystemVar(variable.TiDBBatchCopMaxRegions, "100"))
+	require.NoError(t, sv.SetSystemVar(variable.TiDBBatchCopStrictDuplicateRegion, variable.On))
+	require.NoError(t, sv.SetSystemVar(variable.TiDBBatchCopVerifyCoverage, variable.On))
+	require.NoError(t, sv.SetSystemVar(variable.TiDBBatchCopDisableBalance, variable.On))
+	require.NoError(t, sv.SetSystemVar(variable.TiDBBatchCopMaxTaskRebuilds, "3"))
+	require.NoError(t, sv.SetSystemVar(variable.TiDBBatchCopBackoffSoftCap, "3s"))
+	require.NoError(t, sv.SetSystemVar(variable.TiDBBatchCopDuplicateStartKey, "error"))
+	require.NoError(t, sv.SetSystemVar(variable.TiDBBatchCopMetricLabel, "tenant-1"))
+	require.NoError(t, sv.SetSystemVar(variable.TiDBBatchCopStoreMaxBytes, "1073741824"))
+	require.NoError(t, sv.SetSystemVar(variable.TiDBBatchCopReplicaFailFast, variable.On))
+	require.NoError(t, sv.SetSystemVar(variable.TiDBBatchCopCloseGracePeriod, "500ms"))
+	require.NoError(t, sv.SetSystemVar(variable.TiDBTiFlashMaxExecutionTime, "30s"))
+	actual, err := (&RequestBuilder{}).
+		SetFromSessionVars(sv).
+		Build()
+	require.NoError(t, err)
+	require.Equal(t, 100, actual.BatchCopMaxRegions)
+	require.True(t, actual.BatchCopStrictDuplicateRegion)
+	require.True(t, actual.BatchCopVerifyCoverage)
+	require.True(t, actual.BatchCopDisableBalance)
+	require.Equal(t, 3, actual.BatchCopMaxTaskRebuilds)
+	require.Equal(t, 3*time.Second, actual.BatchCopBackoffSoftCap)
+	require.Equal(t, "error", actual.BatchCopDuplicateStartKey)
+	require.Equal(t, "tenant-1", actual.MetricLabel)
+	require.Equal(t, int64(1073741824), actual.BatchCopStoreMaxBytes)
+	require.True(t, actual.FailOnAllTiFlashReplicasFailed)
+	require.Equal(t, 500*time.Millisecond, actual.BatchCopCloseGracePeriod)
+	require.Equal(t, 30*time.Second, actual.TiFlashMaxExecutionTime)
+}
+
 func TestTableRangesToKVRangesWithFbs(t *testing.T) {
 	t.Parallel()
 	ranges := []*ranger.Range{
@@ -841,6 +841,9 @@ func UpdateLabelRules(ctx context.Context, patch *label.RulePatch) error {
 	if patch == nil || (len(patch.DeleteRules) == 0 && len(patch.SetRules) == 0) {
 		return nil
 	}
+	if err := patch.Validate(); err != nil {
+		return err
+	}
 
 	is, err := getGlobalInfoSyncer()
 	if err != nil {
@@ -849,7 +852,13 @@ func UpdateLabelRules(ctx context.Context, patch *label.RulePatch) error {
 	if is.labelRuleManager == nil {
 		return nil
 	}
-	return is.labelRuleManager.UpdateLabelRules(ctx, patch)
+	err = is.labelRuleManager.UpdateLabelRules(ctx, patch)
+	if err != nil {
+		return err
+	}
+	summary := patch.Summary()
+	logutil.BgLogger().Info("update label rules", zap.Stringer("summary", &summary))
+	return nil
 }
 
 // GetAllLabelRules gets all label rules from PD.
@@ -2802,17 +2802,17 @@ func (e *memtableRetriever) setDataForRegionLabel(ctx sessionctx.Context) error
 		}
 
 		labels := rule.Labels.Restore()
-		keyRange := make(map[string]string)
-		for k, v := range rule.Rule.(map[string]interface{}) {
-			keyRange[k] = v.(string)
+		startKey, endKey, err := rule.HexKeyRange()
+		if err != nil {
+			return err
 		}
 
 		row := types.MakeDatums(
 			rule.ID,
 			rule.RuleType,
 			labels,
-			keyRange["start_key"],
-			keyRange["end_key"],
+			startKey,
+			endKey,
 		)
 		rows = append(rows, row)
 	}
@@ -326,6 +326,8 @@ type Request struct {
 	BatchCop bool
 	// TaskID is an unique ID for an execution of a statement
 	TaskID uint64
+	// ConnID is the ID of the connection which sends the request.
+	ConnID uint64
 	// TiDBServerID is the specified TiDB serverID to execute request. `0` means all TiDB instances.
 	TiDBServerID uint64
 	// TxnScope is the scope of the current txn.
@@ -336,6 +338,93 @@ type Request struct {
 	MatchStoreLabels []*metapb.StoreLabel
 	// ResourceGroupTag indicates the kv request task group.
 	ResourceGroupTag []byte
+	// MetricLabel is the label of the query attached to the batch cop metrics, only the labels
+	// in the allowlist of the copr package are recorded as they are.
+	MetricLabel string
+	// AttachTopology indicates whether the first batch cop response carries the resolved topology of the request.
+	AttachTopology bool
+	// BatchCopMemoryReserve is the memory budget consumed from MemTracker when a batch cop request starts,
+	// it's released when the response is closed. `0` means nothing is reserved.
+	BatchCopMemoryReserve int64
+	// BatchCopMinChunkInterval is the min interval between two batch cop responses delivered to the consumer,
+	// it smooths the load of the consumer at the cost of latency. `0` means no limit.
+	BatchCopMinChunkInterval time.Duration
+	// SampleMode makes a batch cop request only read the first region of each store, it gives a fast sample
+	// of the data without a full scan. The results are incomplete, so it's only set by the callers asking for
+	// a sample explicitly.
+	SampleMode bool
+	// BatchCopRespChanBytes is the max total bytes of the batch cop responses buffered for the consumer,
+	// the producers are blocked when it's exceeded. `0` means the buffer is only bounded by count.
+	BatchCopRespChanBytes int64
+	// BatchCopStoreMaxBytes is the max bytes a single TiFlash store may return for a batch cop request,
+	// the request fails when it's exceeded. `0` means no limit.
+	BatchCopStoreMaxBytes int64
+	// FailOnAllTiFlashReplicasFailed makes a batch cop request fail promptly once all the TiFlash replicas
+	// of a region have failed, instead of retrying until the backoff budget is exhausted.
+	FailOnAllTiFlashReplicasFailed bool
+	// BatchCopStoreKeyOrder makes the batch cop responses of each store buffered and delivered in the order of
+	// the region keys. It's narrower than KeepOrder, the responses of different stores are not ordered.
+	BatchCopStoreKeyOrder bool
+	// BatchCopCloseGracePeriod is how long closing a batch cop iterator waits for the in-flight responses before
+	// cancelling the RPCs. `0` means the RPCs are cancelled immediately.
+	BatchCopCloseGracePeriod time.Duration
+	// TiFlashMaxExecutionTime is the read timeout of a batch cop stream, the task is retried on other stores
+	// once it's exceeded. `0` means the streams may last for an hour.
+	TiFlashMaxExecutionTime time.Duration
+	// BatchCopSkipEmptyChunks makes the batch cop responses without data dropped instead of being delivered to
+	// the consumer, they are still counted by the iterator.
+	BatchCopSkipEmptyChunks bool
+	// BatchCopLazyBuildRegions makes the batch cop tasks built group by group of this many regions as the consumer
+	// pulls the results, so the regions after the ones the consumer stops at are never built or sent, e.g. when the
+	// limit is satisfied. `0` means all the tasks are built at once.
+	BatchCopLazyBuildRegions int
+	// BatchCopMaxRegions is the max number of regions a batch cop request can touch, it guards against
+	// unexpected full table scans. `0` means no limit.
+	BatchCopMaxRegions int
+	// BatchCopStrictDuplicateRegion indicates whether building the batch cop tasks fails when a region is referenced
+	// twice, it helps to catch bugs. Otherwise the duplicated regions are merged into one.
+	BatchCopStrictDuplicateRegion bool
+	// BatchCopVerifyCoverage indicates whether building the batch cop tasks verifies that the tasks cover all the
+	// requested key ranges, it helps to catch the bugs which make the results incomplete silently.
+	BatchCopVerifyCoverage bool
+	// BatchCopDisableBalance indicates whether balancing the batch cop tasks between the TiFlash stores is disabled,
+	// the regions are sent to their current stores then.
+	BatchCopDisableBalance bool
+	// BatchCopBalanceMinRegions is the min number of regions the batch cop tasks are balanced for, the tasks touching
+	// fewer regions are sent to the current stores of their regions. `0` means the tasks are always balanced.
+	BatchCopBalanceMinRegions int
+	// BatchCopRespChanSize is the buffer size of the response channel of a batch cop iterator, it decides when the
+	// workers are blocked by the consumer. `0` means it's derived from the number of workers.
+	BatchCopRespChanSize int
+	// BatchCopTaskOrder is the order of the rebuilt batch cop tasks queued by a worker, see copr.TaskOrderPolicy.
+	// Empty means they are handled in the order they are queued.
+	BatchCopTaskOrder string
+	// BatchCopMaxTaskRebuilds is the max number of times the regions of a batch cop task can be rebuilt on retry,
+	// the request fails with copr.ErrBatchCopTooManyRebuilds once it's exceeded. `0` means no limit.
+	BatchCopMaxTaskRebuilds int
+	// BatchCopMaxRegionRetries is the max number of times a region can be retried across the task rebuilds, the request
+	// fails with copr.ErrBatchCopRegionTooManyRetries once it's exceeded. `0` means no limit.
+	BatchCopMaxRegionRetries int
+	// BatchCopBackoffSoftCap is the backoff sleep of a batch cop task beyond which a warning is logged, the query still
+	// goes on until the backoff budget is used up. `0` means no soft cap.
+	BatchCopBackoffSoftCap time.Duration
+	// BatchCopDrainLimit is the max number of remaining chunks received and discarded from a stream after the
+	// iterator is closed, so that TiFlash can flush its send buffer and stop cleanly. `0` means the stream is
+	// closed immediately.
+	BatchCopDrainLimit int
+	// BatchCopDuplicateStartKey is how the duplicate start keys of the batch cop responses within a request are
+	// handled, see copr.DuplicateStartKeyPolicy. Empty means they are not checked.
+	BatchCopDuplicateStartKey string
+	// BatchCopReplicaSelectPolicy is how a replica store is chosen for a region when the batch cop tasks are rebuilt on
+	// retry, see copr.NewReplicaSelectPolicy. Empty means the rebuilt tasks are kept as they are balanced.
+	BatchCopReplicaSelectPolicy string
+	// BatchCopStoreRolePreference is the role of the TiFlash peers preferred by the batch cop tasks, see
+	// copr.StoreRolePreference. Empty means no role is preferred.
+	BatchCopStoreRolePreference string
+	// BatchCopMaxSendAttempts is the max number of times the requests of a batch cop task are sent, including the ones
+	// of the tasks it's rebuilt into. A failed send isn't retried once it's reached, no matter how much of the backoff
+	// budget remains. `0` means no limit.
+	BatchCopMaxSendAttempts int
 }
 
 // ResultSubset represents a result subset from a single storage unit.
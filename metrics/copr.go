@@ -0,0 +1,98 @@
+// Copyright 2018 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// batch coprocessor metrics.
+var (
+	BatchCopSendHistogram = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "tidb",
+			Subsystem: "batch_cop",
+			Name:      "send_duration_seconds",
+			Help:      "Bucketed histogram of sending time (s) of batch cop requests.",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 20), // 0.5ms ~ 524s
+		}, []string{LblQueryLabel})
+
+	TiFlashBatchCopSendHistogram = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "tidb",
+			Subsystem: "batch_cop",
+			Name:      "store_send_duration_seconds",
+			Help:      "Bucketed histogram of sending time (s) of batch cop requests to each TiFlash store.",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 20), // 0.5ms ~ 524s
+		}, []string{LblAddress})
+
+	BatchCopResponseBytesCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "tidb",
+			Subsystem: "batch_cop",
+			Name:      "response_bytes",
+			Help:      "Counter of bytes received from batch cop responses.",
+		}, []string{LblQueryLabel})
+
+	BatchCopRetryCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "tidb",
+			Subsystem: "batch_cop",
+			Name:      "retry_total",
+			Help:      "Counter of retried batch cop tasks.",
+		}, []string{LblQueryLabel})
+
+	BatchCopBuildTaskHistogram = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "tidb",
+			Subsystem: "batch_cop",
+			Name:      "build_task_duration_seconds",
+			Help:      "Bucketed histogram of building time (s) of batch cop tasks, a build is cold if it meets region misses.",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 20), // 0.5ms ~ 524s
+		}, []string{LblType})
+
+	TiFlashBatchCopTaskRetryCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "tidb",
+			Subsystem: "batch_cop",
+			Name:      "task_retry_total",
+			Help:      "Counter of batch cop tasks rebuilt because they fail to be sent to a TiFlash store.",
+		}, []string{LblAddress, LblType})
+
+	BatchCopNonPreferredStoreCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "tidb",
+			Subsystem: "batch_cop",
+			Name:      "non_preferred_store_total",
+			Help:      "Counter of batch cop tasks sent to a store which is not the preferred one of some of their regions.",
+		}, []string{LblQueryLabel})
+
+	BatchCopBackoffSoftCapCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "tidb",
+			Subsystem: "batch_cop",
+			Name:      "backoff_soft_cap_exceeded_total",
+			Help:      "Counter of batch cop queries whose backoff sleep exceeds the soft cap.",
+		}, []string{LblQueryLabel})
+
+	BatchCopRegionImbalanceHistogram = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: "tidb",
+			Subsystem: "batch_cop",
+			Name:      "region_imbalance_ratio",
+			Help:      "Bucketed histogram of the max regions per store divided by the mean after balancing batch cop tasks.",
+			Buckets:   prometheus.ExponentialBuckets(1, 1.5, 12), // 1 ~ 86
+		})
+)
@@ -70,6 +70,15 @@ func RegisterMetrics() {
 	prometheus.MustRegister(AutoAnalyzeHistogram)
 	prometheus.MustRegister(AutoIDHistogram)
 	prometheus.MustRegister(BatchAddIdxHistogram)
+	prometheus.MustRegister(BatchCopSendHistogram)
+	prometheus.MustRegister(TiFlashBatchCopSendHistogram)
+	prometheus.MustRegister(BatchCopResponseBytesCounter)
+	prometheus.MustRegister(BatchCopRetryCounter)
+	prometheus.MustRegister(TiFlashBatchCopTaskRetryCounter)
+	prometheus.MustRegister(BatchCopNonPreferredStoreCounter)
+	prometheus.MustRegister(BatchCopBackoffSoftCapCounter)
+	prometheus.MustRegister(BatchCopBuildTaskHistogram)
+	prometheus.MustRegister(BatchCopRegionImbalanceHistogram)
 	prometheus.MustRegister(BindUsageCounter)
 	prometheus.MustRegister(BindTotalGauge)
 	prometheus.MustRegister(BindMemoryUsage)
@@ -156,4 +156,5 @@ const (
 	LblVersion     = "version"
 	LblHash        = "hash"
 	LblCTEType     = "cte_type"
+	LblQueryLabel  = "query_label"
 )
@@ -947,6 +947,42 @@ type SessionVars struct {
 	// MPPStoreFailTTL indicates the duration that protect TiDB from sending task to a new recovered TiFlash.
 	MPPStoreFailTTL string
 
+	// BatchCopMaxRegions is the max number of regions a batch cop request can touch.
+	BatchCopMaxRegions int
+
+	// BatchCopStrictDuplicateRegion indicates whether building the batch cop tasks fails on the duplicated regions.
+	BatchCopStrictDuplicateRegion bool
+
+	// BatchCopVerifyCoverage indicates whether the batch cop tasks are verified to cover all the requested key ranges.
+	BatchCopVerifyCoverage bool
+
+	// BatchCopDisableBalance indicates whether balancing the batch cop tasks between the TiFlash stores is disabled.
+	BatchCopDisableBalance bool
+
+	// BatchCopMaxTaskRebuilds is the max number of times the regions of a batch cop task can be rebuilt on retry.
+	BatchCopMaxTaskRebuilds int
+
+	// BatchCopBackoffSoftCap is the backoff sleep of a batch cop task beyond which a warning is logged.
+	BatchCopBackoffSoftCap time.Duration
+
+	// BatchCopDuplicateStartKey is how the duplicate start keys of the batch cop responses within a request are handled.
+	BatchCopDuplicateStartKey string
+
+	// BatchCopMetricLabel is the label of the query attached to the batch cop metrics.
+	BatchCopMetricLabel string
+
+	// BatchCopStoreMaxBytes is the max bytes a single TiFlash store may return for a batch cop request.
+	BatchCopStoreMaxBytes int64
+
+	// BatchCopReplicaFailFast makes a batch cop request fail once all the TiFlash replicas of a region have failed.
+	BatchCopReplicaFailFast bool
+
+	// BatchCopCloseGracePeriod is how long closing a batch cop request waits for the in-flight responses.
+	BatchCopCloseGracePeriod time.Duration
+
+	// TiFlashMaxExecutionTime is the read timeout of a batch cop stream.
+	TiFlashMaxExecutionTime time.Duration
+
 	// cached is used to optimze the object allocation.
 	cached struct {
 		curr int8
@@ -1233,6 +1269,18 @@ func NewSessionVars() *SessionVars {
 	vars.HashExchangeWithNewCollation = DefTiDBHashExchangeWithNewCollation
 	vars.enforceMPPExecution = DefTiDBEnforceMPPExecution
 	vars.MPPStoreFailTTL = DefTiDBMPPStoreFailTTL
+	vars.BatchCopMaxRegions = DefTiDBBatchCopMaxRegions
+	vars.BatchCopStrictDuplicateRegion = DefTiDBBatchCopStrictDuplicateRegion
+	vars.BatchCopVerifyCoverage = DefTiDBBatchCopVerifyCoverage
+	vars.BatchCopDisableBalance = DefTiDBBatchCopDisableBalance
+	vars.BatchCopMaxTaskRebuilds = DefTiDBBatchCopMaxTaskRebuilds
+	vars.BatchCopBackoffSoftCap = DefTiDBBatchCopBackoffSoftCap
+	vars.BatchCopDuplicateStartKey = DefTiDBBatchCopDuplicateStartKey
+	vars.BatchCopMetricLabel = DefTiDBBatchCopMetricLabel
+	vars.BatchCopStoreMaxBytes = DefTiDBBatchCopStoreMaxBytes
+	vars.BatchCopReplicaFailFast = DefTiDBBatchCopReplicaFailFast
+	vars.BatchCopCloseGracePeriod = DefTiDBBatchCopCloseGracePeriod
+	vars.TiFlashMaxExecutionTime = DefTiDBTiFlashMaxExecutionTime
 
 	var enableChunkRPC string
 	if config.GetGlobalConfig().TiKVClient.EnableChunkRPC {
@@ -860,6 +860,66 @@ var defaultSysVars = []*SysVar{
 		s.MPPStoreFailTTL = val
 		return nil
 	}},
+	{Scope: ScopeGlobal | ScopeSession, Name: TiDBBatchCopMaxRegions, Type: TypeUnsigned, Value: strconv.Itoa(DefTiDBBatchCopMaxRegions), MinValue: 0, MaxValue: math.MaxInt32, SetSession: func(s *SessionVars, val string) error {
+		s.BatchCopMaxRegions = int(tidbOptInt64(val, DefTiDBBatchCopMaxRegions))
+		return nil
+	}},
+	{Scope: ScopeSession, Name: TiDBBatchCopStrictDuplicateRegion, Type: TypeBool, Value: BoolToOnOff(DefTiDBBatchCopStrictDuplicateRegion), SetSession: func(s *SessionVars, val string) error {
+		s.BatchCopStrictDuplicateRegion = TiDBOptOn(val)
+		return nil
+	}},
+	{Scope: ScopeSession, Name: TiDBBatchCopVerifyCoverage, Type: TypeBool, Value: BoolToOnOff(DefTiDBBatchCopVerifyCoverage), SetSession: func(s *SessionVars, val string) error {
+		s.BatchCopVerifyCoverage = TiDBOptOn(val)
+		return nil
+	}},
+	{Scope: ScopeSession, Name: TiDBBatchCopDisableBalance, Type: TypeBool, Value: BoolToOnOff(DefTiDBBatchCopDisableBalance), SetSession: func(s *SessionVars, val string) error {
+		s.BatchCopDisableBalance = TiDBOptOn(val)
+		return nil
+	}},
+	{Scope: ScopeGlobal | ScopeSession, Name: TiDBBatchCopMaxTaskRebuilds, Type: TypeUnsigned, Value: strconv.Itoa(DefTiDBBatchCopMaxTaskRebuilds), MinValue: 0, MaxValue: math.MaxInt32, SetSession: func(s *SessionVars, val string) error {
+		s.BatchCopMaxTaskRebuilds = int(tidbOptInt64(val, DefTiDBBatchCopMaxTaskRebuilds))
+		return nil
+	}},
+	{Scope: ScopeGlobal | ScopeSession, Name: TiDBBatchCopBackoffSoftCap, Type: TypeDuration, Value: time.Duration(DefTiDBBatchCopBackoffSoftCap).String(), MinValue: 0, MaxValue: uint64(time.Hour), SetSession: func(s *SessionVars, val string) error {
+		d, err := time.ParseDuration(val)
+		if err != nil {
+			return err
+		}
+		s.BatchCopBackoffSoftCap = d
+		return nil
+	}},
+	{Scope: ScopeSession, Name: TiDBBatchCopDuplicateStartKey, Type: TypeEnum, Value: DefTiDBBatchCopDuplicateStartKey, PossibleValues: []string{"ignore", "log", "error"}, SetSession: func(s *SessionVars, val string) error {
+		s.BatchCopDuplicateStartKey = val
+		return nil
+	}},
+	{Scope: ScopeSession, Name: TiDBBatchCopMetricLabel, Value: DefTiDBBatchCopMetricLabel, SetSession: func(s *SessionVars, val string) error {
+		s.BatchCopMetricLabel = val
+		return nil
+	}},
+	{Scope: ScopeGlobal | ScopeSession, Name: TiDBBatchCopStoreMaxBytes, Type: TypeUnsigned, Value: strconv.Itoa(DefTiDBBatchCopStoreMaxBytes), MinValue: 0, MaxValue: math.MaxInt64, SetSession: func(s *SessionVars, val string) error {
+		s.BatchCopStoreMaxBytes = tidbOptInt64(val, DefTiDBBatchCopStoreMaxBytes)
+		return nil
+	}},
+	{Scope: ScopeGlobal | ScopeSession, Name: TiDBBatchCopReplicaFailFast, Type: TypeBool, Value: BoolToOnOff(DefTiDBBatchCopReplicaFailFast), SetSession: func(s *SessionVars, val string) error {
+		s.BatchCopReplicaFailFast = TiDBOptOn(val)
+		return nil
+	}},
+	{Scope: ScopeGlobal | ScopeSession, Name: TiDBBatchCopCloseGracePeriod, Type: TypeDuration, Value: time.Duration(DefTiDBBatchCopCloseGracePeriod).String(), MinValue: 0, MaxValue: uint64(time.Minute), SetSession: func(s *SessionVars, val string) error {
+		d, err := time.ParseDuration(val)
+		if err != nil {
+			return err
+		}
+		s.BatchCopCloseGracePeriod = d
+		return nil
+	}},
+	{Scope: ScopeGlobal | ScopeSession, Name: TiDBTiFlashMaxExecutionTime, Type: TypeDuration, Value: time.Duration(DefTiDBTiFlashMaxExecutionTime).String(), MinValue: 0, MaxValue: uint64(time.Hour * 24), SetSession: func(s *SessionVars, val string) error {
+		d, err := time.ParseDuration(val)
+		if err != nil {
+			return err
+		}
+		s.TiFlashMaxExecutionTime = d
+		return nil
+	}},
 	{Scope: ScopeGlobal | ScopeSession, Name: TiDBHashExchangeWithNewCollation, Type: TypeBool, Value: BoolToOnOff(DefTiDBHashExchangeWithNewCollation), SetSession: func(s *SessionVars, val string) error {
 		s.HashExchangeWithNewCollation = TiDBOptOn(val)
 		return nil
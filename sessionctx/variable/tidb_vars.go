@@ -208,6 +208,25 @@ const (
 
 	// TiDBTxnReadTS indicates the next transaction should be staleness transaction and provide the startTS
 	TiDBTxnReadTS = "tx_read_ts"
+
+	// TiDBBatchCopStrictDuplicateRegion indicates whether building the batch cop tasks fails when a region is referenced
+	// twice, otherwise the duplicated regions are merged into one.
+	TiDBBatchCopStrictDuplicateRegion = "tidb_batch_cop_strict_duplicate_region"
+
+	// TiDBBatchCopVerifyCoverage indicates whether building the batch cop tasks verifies that the tasks cover all the
+	// requested key ranges.
+	TiDBBatchCopVerifyCoverage = "tidb_batch_cop_verify_coverage"
+
+	// TiDBBatchCopDisableBalance indicates whether balancing the batch cop tasks between the TiFlash stores is disabled.
+	TiDBBatchCopDisableBalance = "tidb_batch_cop_disable_balance"
+
+	// TiDBBatchCopDuplicateStartKey is how the duplicate start keys of the batch cop responses within a request are
+	// handled, it can be "ignore", "log" or "error".
+	TiDBBatchCopDuplicateStartKey = "tidb_batch_cop_duplicate_start_key"
+
+	// TiDBBatchCopMetricLabel is the label of the query attached to the batch cop metrics, only the labels in the allowlist
+	// are recorded as they are.
+	TiDBBatchCopMetricLabel = "tidb_batch_cop_metric_label"
 )
 
 // TiDB system variable names that both in session and global scope.
@@ -320,6 +339,34 @@ const (
 	// TiFlash even though the failed TiFlash node has been recovered.
 	TiDBMPPStoreFailTTL = "tidb_mpp_store_fail_ttl"
 
+	// TiDBBatchCopMaxRegions is the max number of regions a batch cop request can touch, the request fails once
+	// it's exceeded. `0` means no limit.
+	TiDBBatchCopMaxRegions = "tidb_batch_cop_max_regions"
+
+	// TiDBBatchCopMaxTaskRebuilds is the max number of times the regions of a batch cop task can be rebuilt on retry,
+	// `0` means no limit.
+	TiDBBatchCopMaxTaskRebuilds = "tidb_batch_cop_max_task_rebuilds"
+
+	// TiDBBatchCopBackoffSoftCap is the backoff sleep of a batch cop task beyond which a warning is logged, in Go format.
+	// `0s` means no soft cap.
+	TiDBBatchCopBackoffSoftCap = "tidb_batch_cop_backoff_soft_cap"
+
+	// TiDBBatchCopStoreMaxBytes is the max bytes a single TiFlash store may return for a batch cop request, the request fails
+	// when it's exceeded. `0` means no limit.
+	TiDBBatchCopStoreMaxBytes = "tidb_batch_cop_store_max_bytes"
+
+	// TiDBBatchCopReplicaFailFast makes a batch cop request fail promptly once all the TiFlash replicas of a region have
+	// failed, instead of retrying until the backoff budget is exhausted.
+	TiDBBatchCopReplicaFailFast = "tidb_batch_cop_replica_fail_fast"
+
+	// TiDBBatchCopCloseGracePeriod is how long closing a batch cop request waits for the in-flight responses before
+	// cancelling the RPCs, in Go format. `0s` means the RPCs are cancelled immediately.
+	TiDBBatchCopCloseGracePeriod = "tidb_batch_cop_close_grace_period"
+
+	// TiDBTiFlashMaxExecutionTime is the read timeout of a batch cop stream in Go format, the task is retried on other stores
+	// once it's exceeded. `0s` means the streams may last for an hour.
+	TiDBTiFlashMaxExecutionTime = "tidb_tiflash_max_execution_time"
+
 	// TiDBInitChunkSize is used to control the init chunk size during query execution.
 	TiDBInitChunkSize = "tidb_init_chunk_size"
 
@@ -745,6 +792,20 @@ const (
 	DefTMPTableSize                       = 16777216
 	DefTiDBEnableLocalTxn                 = false
 	DefTiDBEnableOrderedResultMode        = false
+
+	// The default values of the batch cop variables.
+	DefTiDBBatchCopMaxRegions            = 0
+	DefTiDBBatchCopStrictDuplicateRegion = false
+	DefTiDBBatchCopVerifyCoverage        = false
+	DefTiDBBatchCopDisableBalance        = false
+	DefTiDBBatchCopMaxTaskRebuilds       = 10
+	DefTiDBBatchCopBackoffSoftCap        = 0
+	DefTiDBBatchCopDuplicateStartKey     = "ignore"
+	DefTiDBBatchCopMetricLabel           = ""
+	DefTiDBBatchCopStoreMaxBytes         = 0
+	DefTiDBBatchCopReplicaFailFast       = false
+	DefTiDBBatchCopCloseGracePeriod      = 0
+	DefTiDBTiFlashMaxExecutionTime       = 0
 )
 
 // Process global variables.
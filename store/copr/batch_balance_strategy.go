@@ -0,0 +1,284 @@
+// Copyright 2021 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package copr
+
+import (
+	"math"
+	"sort"
+
+	"github.com/tikv/client-go/v2/tikv"
+)
+
+// BalanceStrategy assigns the regions which have more than one available store when the batch cop tasks
+// are balanced. The available stores of a region are the ones in both its AllStores and assigned.
+type BalanceStrategy interface {
+	// Assign returns the store id of each region, assigned holds the regions which already belong to each
+	// available store. A region left unassigned gets math.MaxUint64, then the balance is given up.
+	// The stores with higher weights are expected to take more regions, nil weights mean uniform ones.
+	Assign(regions []RegionInfo, assigned map[uint64][]RegionInfo, weights StoreWeightProvider) []uint64
+}
+
+// StoreWeightProvider provides the capacity of each TiFlash store when the batch cop tasks are balanced, e.g.
+// from the store stats of PD. The regions are assigned in proportion to the weights.
+type StoreWeightProvider interface {
+	// Weight returns the weight of the store, a non-positive weight is regarded as 1.
+	Weight(storeID uint64) float64
+}
+
+// RegionRowsEstimator estimates the number of rows of a region when the batch cop tasks are built, e.g. from the
+// statistics of the table. A non-positive estimation means it's unknown.
+type RegionRowsEstimator func(region tikv.RegionVerID) int64
+
+// estimateRegionRows returns the rows of the region estimated by the estimator of the store, 0 means it's unknown.
+func (s *kvStore) estimateRegionRows(region tikv.RegionVerID) int64 {
+	if s == nil || s.regionRowsEstimator == nil {
+		return 0
+	}
+	if rows := s.regionRowsEstimator(region); rows > 0 {
+		return rows
+	}
+	return 0
+}
+
+type uniformStoreWeightProvider struct{}
+
+// NewUniformStoreWeightProvider returns the default provider, all the stores have the same weight.
+func NewUniformStoreWeightProvider() StoreWeightProvider {
+	return uniformStoreWeightProvider{}
+}
+
+func (uniformStoreWeightProvider) Weight(uint64) float64 {
+	return 1
+}
+
+func storeWeight(weights StoreWeightProvider, storeID uint64) float64 {
+	if weights == nil {
+		return 1
+	}
+	if w := weights.Weight(storeID); w > 0 {
+		return w
+	}
+	return 1
+}
+
+// sortedAssignedStoreIDs returns the store ids of assigned in ascending order.
+func sortedAssignedStoreIDs(assigned map[uint64][]RegionInfo) []uint64 {
+	storeIDs := make([]uint64, 0, len(assigned))
+	for storeID := range assigned {
+		storeIDs = append(storeIDs, storeID)
+	}
+	sort.Slice(storeIDs, func(i, j int) bool {
+		return storeIDs[i] < storeIDs[j]
+	})
+	return storeIDs
+}
+
+// newUnassignedStores returns the store ids of the regions, they are all unassigned.
+func newUnassignedStores(regionNum int) []uint64 {
+	stores := make([]uint64, regionNum)
+	for i := range stores {
+		stores[i] = math.MaxUint64
+	}
+	return stores
+}
+
+type greedyBalanceStrategy struct{}
+
+// NewGreedyBalanceStrategy returns the default strategy, it puts each region into the store with the
+// lowest weighted region number, which counts both the assigned regions and the candidate ones, and is
+// divided by the store weight.
+func NewGreedyBalanceStrategy() BalanceStrategy {
+	return greedyBalanceStrategy{}
+}
+
+func (greedyBalanceStrategy) Assign(regions []RegionInfo, assigned map[uint64][]RegionInfo, weights StoreWeightProvider) []uint64 {
+	stores := newUnassignedStores(len(regions))
+	regionIdx := make(map[string]int, len(regions))
+	regionNum := make(map[uint64]int, len(assigned))
+	for storeID, ris := range assigned {
+		regionNum[storeID] = len(ris)
+	}
+	// storeCandidateRegionMap stores all the possible store->region map. Its content is
+	// store id -> region signature -> region info. We can see it as store id -> region lists.
+	storeCandidateRegionMap := make(map[uint64]map[string]RegionInfo)
+	totalRegionCandidateNum := 0
+	totalRemainingRegionNum := len(regions)
+	for i, ri := range regions {
+		taskKey := ri.Region.String()
+		regionIdx[taskKey] = i
+		for _, storeID := range ri.AllStores {
+			if _, validStore := assigned[storeID]; !validStore {
+				continue
+			}
+			if _, ok := storeCandidateRegionMap[storeID]; !ok {
+				storeCandidateRegionMap[storeID] = make(map[string]RegionInfo)
+			}
+			storeCandidateRegionMap[storeID][taskKey] = ri
+			totalRegionCandidateNum++
+		}
+	}
+	if totalRemainingRegionNum == 0 {
+		return stores
+	}
+
+	sortedStoreIDs := sortedAssignedStoreIDs(assigned)
+	avgStorePerRegion := float64(totalRegionCandidateNum) / float64(totalRemainingRegionNum)
+	findNextStore := func(candidateStores []uint64) uint64 {
+		store := uint64(math.MaxUint64)
+		weightedRegionNum := math.MaxFloat64
+		if candidateStores != nil {
+			for _, storeID := range candidateStores {
+				if _, validStore := storeCandidateRegionMap[storeID]; !validStore {
+					continue
+				}
+				num := (float64(len(storeCandidateRegionMap[storeID]))/avgStorePerRegion + float64(regionNum[storeID])) / storeWeight(weights, storeID)
+				if num < weightedRegionNum {
+					store = storeID
+					weightedRegionNum = num
+				}
+			}
+			if store != uint64(math.MaxUint64) {
+				return store
+			}
+		}
+		for _, storeID := range sortedStoreIDs {
+			if _, validStore := storeCandidateRegionMap[storeID]; !validStore {
+				continue
+			}
+			num := (float64(len(storeCandidateRegionMap[storeID]))/avgStorePerRegion + float64(regionNum[storeID])) / storeWeight(weights, storeID)
+			if num < weightedRegionNum {
+				store = storeID
+				weightedRegionNum = num
+			}
+		}
+		return store
+	}
+
+	store := findNextStore(nil)
+	for totalRemainingRegionNum > 0 {
+		if store == uint64(math.MaxUint64) {
+			break
+		}
+		key, ri := firstCandidateRegion(storeCandidateRegionMap[store])
+		stores[regionIdx[key]] = store
+		regionNum[store]++
+		totalRemainingRegionNum--
+		for _, id := range ri.AllStores {
+			if _, ok := storeCandidateRegionMap[id]; ok {
+				delete(storeCandidateRegionMap[id], key)
+				totalRegionCandidateNum--
+				if len(storeCandidateRegionMap[id]) == 0 {
+					delete(storeCandidateRegionMap, id)
+				}
+			}
+		}
+		if totalRemainingRegionNum > 0 {
+			avgStorePerRegion = float64(totalRegionCandidateNum) / float64(totalRemainingRegionNum)
+			// it is not optimal because we only check the stores that affected by this region, in fact in order
+			// to find out the store with the lowest weightedRegionNum, all stores should be checked, but I think
+			// check only the affected stores is more simple and will get a good enough result
+			store = findNextStore(ri.AllStores)
+		}
+	}
+	return stores
+}
+
+type roundRobinBalanceStrategy struct{}
+
+// NewRoundRobinBalanceStrategy returns a strategy putting the regions into the stores in turn, a store
+// without a replica of the region is skipped. Neither the regions already assigned nor the store weights are
+// taken into account.
+func NewRoundRobinBalanceStrategy() BalanceStrategy {
+	return roundRobinBalanceStrategy{}
+}
+
+func (roundRobinBalanceStrategy) Assign(regions []RegionInfo, assigned map[uint64][]RegionInfo, _ StoreWeightProvider) []uint64 {
+	stores := newUnassignedStores(len(regions))
+	storeIDs := sortedAssignedStoreIDs(assigned)
+	next := 0
+	for i, ri := range regions {
+		for j := 0; j < len(storeIDs); j++ {
+			idx := (next + j) % len(storeIDs)
+			if containsStore(ri.AllStores, storeIDs[idx]) {
+				stores[i] = storeIDs[idx]
+				next = idx + 1
+				break
+			}
+		}
+	}
+	return stores
+}
+
+type sizeWeightedBalanceStrategy struct{}
+
+// NewSizeWeightedBalanceStrategy returns a strategy putting the larger regions first, each into the store
+// with the least total size per weight. The size of a region is its estimated rows, it's approximated by the
+// number of its key ranges if the rows are unknown.
+func NewSizeWeightedBalanceStrategy() BalanceStrategy {
+	return sizeWeightedBalanceStrategy{}
+}
+
+func regionSize(ri RegionInfo) int64 {
+	if ri.EstRows > 0 {
+		return ri.EstRows
+	}
+	if ri.Ranges == nil || ri.Ranges.Len() == 0 {
+		return 1
+	}
+	return int64(ri.Ranges.Len())
+}
+
+func (sizeWeightedBalanceStrategy) Assign(regions []RegionInfo, assigned map[uint64][]RegionInfo, weights StoreWeightProvider) []uint64 {
+	stores := newUnassignedStores(len(regions))
+	storeIDs := sortedAssignedStoreIDs(assigned)
+	storeSize := make(map[uint64]int64, len(assigned))
+	for storeID, ris := range assigned {
+		for _, ri := range ris {
+			storeSize[storeID] += regionSize(ri)
+		}
+	}
+	order := make([]int, len(regions))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return regionSize(regions[order[i]]) > regionSize(regions[order[j]])
+	})
+	for _, i := range order {
+		selected := uint64(math.MaxUint64)
+		for _, storeID := range storeIDs {
+			if !containsStore(regions[i].AllStores, storeID) {
+				continue
+			}
+			if selected == math.MaxUint64 || float64(storeSize[storeID])/storeWeight(weights, storeID) < float64(storeSize[selected])/storeWeight(weights, selected) {
+				selected = storeID
+			}
+		}
+		if selected != math.MaxUint64 {
+			stores[i] = selected
+			storeSize[selected] += regionSize(regions[i])
+		}
+	}
+	return stores
+}
+
+func containsStore(storeIDs []uint64, storeID uint64) bool {
+	for _, id := range storeIDs {
+		if id == storeID {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,163 @@
+// Copyright 2021 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package copr
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tikv/client-go/v2/tikv"
+)
+
+func newBalanceRegionInfo(id uint64, ranges *KeyRanges, stores ...uint64) RegionInfo {
+	return RegionInfo{Region: tikv.NewRegionVerID(id, 1, 1), Ranges: ranges, AllStores: stores}
+}
+
+func TestGreedyBalanceStrategy(t *testing.T) {
+	t.Parallel()
+	assigned := map[uint64][]RegionInfo{
+		1: {newBalanceRegionInfo(0, nil, 1, 2)},
+		2: {newBalanceRegionInfo(1, nil, 2, 1)},
+	}
+	var regions []RegionInfo
+	for id := uint64(2); id < 6; id++ {
+		regions = append(regions, newBalanceRegionInfo(id, nil, 1, 2))
+	}
+	require.Equal(t, []uint64{1, 2, 1, 2}, NewGreedyBalanceStrategy().Assign(regions, assigned, nil))
+}
+
+func TestRoundRobinBalanceStrategy(t *testing.T) {
+	t.Parallel()
+	assigned := map[uint64][]RegionInfo{
+		1: {newBalanceRegionInfo(0, nil, 1, 2, 3)},
+		2: {newBalanceRegionInfo(1, nil, 2, 1, 3)},
+		3: {newBalanceRegionInfo(2, nil, 3, 1, 2)},
+	}
+	var regions []RegionInfo
+	for id := uint64(3); id < 7; id++ {
+		regions = append(regions, newBalanceRegionInfo(id, nil, 1, 2))
+	}
+	regions = append(regions, newBalanceRegionInfo(7, nil, 2))
+	// Store 3 doesn't hold the regions, so it's always skipped.
+	require.Equal(t, []uint64{1, 2, 1, 2, 2}, NewRoundRobinBalanceStrategy().Assign(regions, assigned, nil))
+}
+
+func TestSizeWeightedBalanceStrategy(t *testing.T) {
+	t.Parallel()
+	assigned := map[uint64][]RegionInfo{
+		1: {newBalanceRegionInfo(0, nil, 1, 2)},
+		2: {newBalanceRegionInfo(1, nil, 2, 1)},
+	}
+	regions := []RegionInfo{
+		newBalanceRegionInfo(2, buildCopRanges("a", "b", "c", "d", "e", "f"), 1, 2),
+		newBalanceRegionInfo(3, buildCopRanges("g", "h"), 1, 2),
+		newBalanceRegionInfo(4, buildCopRanges("i", "j", "k", "l"), 1, 2),
+		newBalanceRegionInfo(5, buildCopRanges("m", "n"), 1, 2),
+	}
+	// The largest region goes first, then each region goes to the store with the least total size.
+	require.Equal(t, []uint64{1, 2, 2, 1}, NewSizeWeightedBalanceStrategy().Assign(regions, assigned, nil))
+}
+
+func TestSizeWeightedBalanceStrategyWithEstRows(t *testing.T) {
+	t.Parallel()
+	assigned := map[uint64][]RegionInfo{
+		1: {newBalanceRegionInfo(0, nil, 1, 2)},
+		2: {newBalanceRegionInfo(1, nil, 2, 1)},
+	}
+	regions := []RegionInfo{
+		newBalanceRegionInfo(2, buildCopRanges("a", "b", "c", "d", "e", "f"), 1, 2),
+		newBalanceRegionInfo(3, buildCopRanges("g", "h"), 1, 2),
+		newBalanceRegionInfo(4, buildCopRanges("i", "j", "k", "l"), 1, 2),
+		newBalanceRegionInfo(5, buildCopRanges("m", "n"), 1, 2),
+	}
+	regions[0].EstRows = 10
+	regions[1].EstRows = 1000
+	regions[3].EstRows = 500
+	// The estimated rows take the place of the number of key ranges, region 4 is still sized by its ranges.
+	require.Equal(t, []uint64{2, 1, 2, 2}, NewSizeWeightedBalanceStrategy().Assign(regions, assigned, nil))
+}
+
+func TestBalanceBatchCopTaskWithStrategy(t *testing.T) {
+	t.Parallel()
+	store := &kvStore{balanceStrategy: NewRoundRobinBalanceStrategy()}
+	tasks := []*batchCopTask{
+		{storeAddr: "store1", regionInfos: []RegionInfo{newBalanceRegionInfo(0, nil, 1, 2)}},
+		{storeAddr: "store2", regionInfos: []RegionInfo{newBalanceRegionInfo(1, nil, 2, 1)}},
+	}
+	for id := uint64(2); id < 6; id++ {
+		tasks[0].regionInfos = append(tasks[0].regionInfos, newBalanceRegionInfo(id, nil, 1, 2))
+	}
+	tasks = balanceBatchCopTask(context.Background(), store, tasks, nil, 0)
+	require.Len(t, tasks, 2)
+	require.Equal(t, []uint64{0, 2, 4}, regionIDsOfTasks(tasks[:1]))
+	require.Equal(t, []uint64{1, 3, 5}, regionIDsOfTasks(tasks[1:]))
+}
+
+type mockStoreWeightProvider map[uint64]float64
+
+func (p mockStoreWeightProvider) Weight(storeID uint64) float64 {
+	return p[storeID]
+}
+
+func TestBalanceStrategyWithStoreWeights(t *testing.T) {
+	t.Parallel()
+	newAssigned := func() map[uint64][]RegionInfo {
+		return map[uint64][]RegionInfo{
+			1: {newBalanceRegionInfo(0, nil, 1, 2)},
+			2: {newBalanceRegionInfo(1, nil, 2, 1)},
+		}
+	}
+	var regions []RegionInfo
+	for id := uint64(2); id < 10; id++ {
+		regions = append(regions, newBalanceRegionInfo(id, buildCopRanges("a", "b"), 1, 2))
+	}
+	countRegions := func(stores []uint64) map[uint64]int {
+		nums := make(map[uint64]int)
+		for _, store := range stores {
+			nums[store]++
+		}
+		return nums
+	}
+
+	for _, strategy := range []BalanceStrategy{NewGreedyBalanceStrategy(), NewSizeWeightedBalanceStrategy()} {
+		// The behavior is kept when all the weights are equal.
+		expected := strategy.Assign(regions, newAssigned(), nil)
+		require.Equal(t, expected, strategy.Assign(regions, newAssigned(), NewUniformStoreWeightProvider()))
+		require.Equal(t, expected, strategy.Assign(regions, newAssigned(), mockStoreWeightProvider{1: 2, 2: 2}))
+		require.Equal(t, expected, strategy.Assign(regions, newAssigned(), mockStoreWeightProvider{}))
+
+		// Store 1 has 3 times the capacity of store 2, so it takes about 3/4 of the 10 regions in total.
+		nums := countRegions(strategy.Assign(regions, newAssigned(), mockStoreWeightProvider{1: 3, 2: 1}))
+		require.Equal(t, 8, nums[1]+nums[2])
+		require.InDelta(t, 7.5, float64(nums[1]+1), 0.5)
+	}
+}
+
+func TestBalanceBatchCopTaskWithStoreWeights(t *testing.T) {
+	t.Parallel()
+	store := &kvStore{storeWeights: mockStoreWeightProvider{1: 3, 2: 1}}
+	tasks := []*batchCopTask{
+		{storeAddr: "store1", regionInfos: []RegionInfo{newBalanceRegionInfo(0, nil, 1, 2)}},
+		{storeAddr: "store2", regionInfos: []RegionInfo{newBalanceRegionInfo(1, nil, 2, 1)}},
+	}
+	for id := uint64(2); id < 10; id++ {
+		tasks[1].regionInfos = append(tasks[1].regionInfos, newBalanceRegionInfo(id, buildCopRanges("a", "b"), 1, 2))
+	}
+	tasks = balanceBatchCopTask(context.Background(), store, tasks, nil, 0)
+	require.Len(t, tasks, 2)
+	// Store 1 has 3 times the capacity of store 2, so it takes about 3/4 of the 10 regions.
+	require.InDelta(t, 7.5, float64(len(tasks[0].regionInfos)), 0.5)
+}
@@ -15,10 +15,18 @@
 package copr
 
 import (
+	"bytes"
+	"container/heap"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"io"
 	"math"
+	"runtime"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -34,10 +42,14 @@ import (
 	"github.com/pingcap/tidb/store/driver/backoff"
 	derr "github.com/pingcap/tidb/store/driver/error"
 	"github.com/pingcap/tidb/util/logutil"
+	"github.com/pingcap/tidb/util/memory"
 	"github.com/tikv/client-go/v2/metrics"
 	"github.com/tikv/client-go/v2/tikv"
 	"github.com/tikv/client-go/v2/tikvrpc"
+	"github.com/tikv/client-go/v2/util"
 	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // batchCopTask comprises of multiple copTask that will send to same store.
@@ -47,17 +59,111 @@ type batchCopTask struct {
 	ctx       *tikv.RPCContext
 
 	regionInfos []RegionInfo
+	// hasData indicates whether any response of this task carries data.
+	hasData bool
+	// buffered are the responses held back until they can be delivered in the order of the region keys.
+	buffered []*batchCopResponse
+	// retryRegions are the ids of the regions which TiFlash reports stale, only they are retried after the
+	// stream of the task finishes.
+	retryRegions map[uint64]struct{}
+	// regionIDs caches the ids of the regions, they are shared by the responses of the task.
+	regionIDs []uint64
+	// respChan receives the responses of the task in the keep order mode, it holds at most one response.
+	// It's nil otherwise, and the responses go to the respChan of the iterator.
+	respChan chan *batchCopResponse
+	// rebuilds is the number of times the regions of the task have been rebuilt on retry.
+	rebuilds int
+	// storeID is the id of the store serving the task, it's set once the request of the task is sent.
+	storeID uint64
+	// started is set once a worker takes the task, it's accessed atomically.
+	started uint32
+}
+
+// startKey returns the smallest start key of the regions of the task.
+func (t *batchCopTask) startKey() kv.Key {
+	var startKey kv.Key
+	for i, ri := range t.regionInfos {
+		if ri.Ranges.Len() == 0 {
+			continue
+		}
+		if key := ri.Ranges.At(0).StartKey; i == 0 || bytes.Compare(key, startKey) < 0 {
+			startKey = key
+		}
+	}
+	return startKey
+}
+
+// regionIDsOf returns the ids of the regions of the tasks.
+func regionIDsOf(tasks ...*batchCopTask) []uint64 {
+	var ids []uint64
+	for _, task := range tasks {
+		for _, ri := range task.regionInfos {
+			ids = append(ids, ri.Region.GetID())
+		}
+	}
+	return ids
+}
+
+// retryRegionsOf returns a task holding only the regions of the task which need to be retried.
+func (t *batchCopTask) retryRegionsOf() *batchCopTask {
+	retryTask := &batchCopTask{storeAddr: t.storeAddr, cmdType: t.cmdType, ctx: t.ctx, respChan: t.respChan, rebuilds: t.rebuilds}
+	for _, ri := range t.regionInfos {
+		if _, ok := t.retryRegions[ri.Region.GetID()]; ok {
+			retryTask.regionInfos = append(retryTask.regionInfos, ri)
+		}
+	}
+	return retryTask
+}
+
+// sortBatchCopTasksByKey sorts the tasks by their start keys.
+func sortBatchCopTasksByKey(tasks []*batchCopTask) {
+	sort.SliceStable(tasks, func(i, j int) bool {
+		return bytes.Compare(tasks[i].startKey(), tasks[j].startKey()) < 0
+	})
 }
 
 type batchCopResponse struct {
 	pbResp *coprocessor.BatchResponse
 	detail *CopRuntimeStats
 
-	// batch Cop Response is yet to return startKey. So batchCop cannot retry partially.
+	// batch Cop Response is yet to return startKey. So batchCop can only retry partially by the stale regions
+	// reported by TiFlash. startKey is only set in the keep order mode or BatchCopStoreKeyOrder, it's the smallest
+	// start key of the regions of the task then.
 	startKey kv.Key
 	err      error
 	respSize int64
 	respTime time.Duration
+
+	// topology is only attached to the first response when req.AttachTopology is set.
+	topology *BatchCopTopology
+	// handleTime is the time spent on handling the response before it's sent to respChan.
+	handleTime time.Duration
+	// regionIDs are the ids of the regions the response comes from.
+	regionIDs []uint64
+	// regionBytes are the bytes of the data from each region, it's nil if the data can't be attributed to regions.
+	regionBytes map[uint64]int64
+}
+
+// BatchCopTopology is the resolved topology of a batch cop request.
+type BatchCopTopology struct {
+	Stores []StoreTopology
+}
+
+// StoreTopology describes how many regions are sent to a store.
+type StoreTopology struct {
+	Addr      string
+	RegionNum int
+}
+
+func newBatchCopTopology(tasks []*batchCopTask) *BatchCopTopology {
+	topology := &BatchCopTopology{Stores: make([]StoreTopology, 0, len(tasks))}
+	for _, task := range tasks {
+		topology.Stores = append(topology.Stores, StoreTopology{Addr: task.storeAddr, RegionNum: len(task.regionInfos)})
+	}
+	sort.Slice(topology.Stores, func(i, j int) bool {
+		return topology.Stores[i].Addr < topology.Stores[j].Addr
+	})
+	return topology
 }
 
 // GetData implements the kv.ResultSubset GetData interface.
@@ -70,8 +176,8 @@ func (rs *batchCopResponse) GetStartKey() kv.Key {
 	return rs.startKey
 }
 
-// GetExecDetails is unavailable currently, because TiFlash has not collected exec details for batch cop.
-// TODO: Will fix in near future.
+// GetCopRuntimeStats returns the runtime stats of the response, the exec details are only filled when
+// TiFlash reports them.
 func (rs *batchCopResponse) GetCopRuntimeStats() *CopRuntimeStats {
 	return rs.detail
 }
@@ -98,27 +204,76 @@ func (rs *batchCopResponse) RespTime() time.Duration {
 	return rs.respTime
 }
 
+// HandleTime returns the time spent on handling the response, the time waiting for the network is excluded.
+func (rs *batchCopResponse) HandleTime() time.Duration {
+	return rs.handleTime
+}
+
+// RegionIDs returns the ids of the regions the response comes from. TiFlash doesn't frame the response by
+// region, so they are all the regions of the task, which is exact when the task holds a single region.
+func (rs *batchCopResponse) RegionIDs() []uint64 {
+	return rs.regionIDs
+}
+
+// RegionBytes returns the bytes of the data contributed by each region, it can be used to find the skewed regions.
+// TiFlash doesn't report the regions of the data, so the breakdown is only known when the response comes from
+// a single region, e.g. in the keep order mode, and it's nil otherwise.
+func (rs *batchCopResponse) RegionBytes() map[uint64]int64 {
+	return rs.regionBytes
+}
+
+// GetTopology returns the topology attached to the response, it's nil unless this is the first response
+// and req.AttachTopology is set.
+func (rs *batchCopResponse) GetTopology() *BatchCopTopology {
+	return rs.topology
+}
+
+// sortedStoreIDs returns the store ids in ascending order, iterating them makes the balance stable for
+// identical input, and the store with the smaller id wins a tie.
+func sortedStoreIDs(storeTaskMap map[uint64]*batchCopTask) []uint64 {
+	storeIDs := make([]uint64, 0, len(storeTaskMap))
+	for storeID := range storeTaskMap {
+		storeIDs = append(storeIDs, storeID)
+	}
+	sort.Slice(storeIDs, func(i, j int) bool {
+		return storeIDs[i] < storeIDs[j]
+	})
+	return storeIDs
+}
+
+// firstCandidateRegion returns the candidate region with the smallest key.
+func firstCandidateRegion(candidates map[string]RegionInfo) (string, RegionInfo) {
+	var firstKey string
+	for key := range candidates {
+		if firstKey == "" || key < firstKey {
+			firstKey = key
+		}
+	}
+	return firstKey, candidates[firstKey]
+}
+
 // balanceBatchCopTask balance the regions between available stores, the basic rule is
-// 1. the first region of each original batch cop task belongs to its original store because some
-//    meta data(like the rpc context) in batchCopTask is related to it
-// 2. for the remaining regions:
-//    if there is only 1 available store, then put the region to the related store
-//    otherwise, use a greedy algorithm to put it into the store with highest weight
+//  1. the first region of each original batch cop task belongs to its original store because some
+//     meta data(like the rpc context) in batchCopTask is related to it
+//  2. for the remaining regions:
+//     if there is only 1 available store, then put the region to the related store
+//     otherwise, the balance strategy of the store decides which store to put it into, the default one is a greedy
+//     algorithm putting it into the store with highest weight, the regions are assigned in proportion
+//     to the store weights given by the store
 func balanceBatchCopTask(ctx context.Context, kvStore *kvStore, originalTasks []*batchCopTask, mppStoreLastFailTime map[string]time.Time, ttl time.Duration) []*batchCopTask {
 	if len(originalTasks) <= 1 {
 		return originalTasks
 	}
 	isMPP := mppStoreLastFailTime != nil
-	cache := kvStore.GetRegionCache()
 	storeTaskMap := make(map[uint64]*batchCopTask)
-	// storeCandidateRegionMap stores all the possible store->region map. Its content is
-	// store id -> region signature -> region info. We can see it as store id -> region lists.
-	storeCandidateRegionMap := make(map[uint64]map[string]RegionInfo)
-	totalRegionCandidateNum := 0
-	totalRemainingRegionNum := 0
 
 	if !isMPP {
 		for _, task := range originalTasks {
+			if len(task.regionInfos[0].AllStores) == 0 {
+				logutil.BgLogger().Warn("Meet regions that don't have any store. Give up balancing",
+					zap.Uint64("region id", task.regionInfos[0].Region.GetID()))
+				return originalTasks
+			}
 			taskStoreID := task.regionInfos[0].AllStores[0]
 			batchTask := &batchCopTask{
 				storeAddr:   task.storeAddr,
@@ -131,7 +286,7 @@ func balanceBatchCopTask(ctx context.Context, kvStore *kvStore, originalTasks []
 	} else {
 		logutil.BgLogger().Info("detecting available mpp stores")
 		// decide the available stores
-		stores := cache.RegionCache.GetTiFlashStores()
+		stores := kvStore.GetRegionCache().RegionCache.GetTiFlashStores()
 		var wg sync.WaitGroup
 		var mu sync.Mutex
 		wg.Add(len(stores))
@@ -183,6 +338,9 @@ func balanceBatchCopTask(ctx context.Context, kvStore *kvStore, originalTasks []
 		wg.Wait()
 	}
 
+	// regions are the regions which have more than one available store, they are assigned by the strategy.
+	var regions []RegionInfo
+	regionKeys := make(map[string]struct{})
 	for _, task := range originalTasks {
 		for index, ri := range task.regionInfos {
 			// for each region, figure out the valid store num
@@ -205,120 +363,203 @@ func balanceBatchCopTask(ctx context.Context, kvStore *kvStore, originalTasks []
 				// if only one store is valid, just put it to storeTaskMap
 				storeTaskMap[validStoreID].regionInfos = append(storeTaskMap[validStoreID].regionInfos, ri)
 			} else {
-				// if more than one store is valid, put the region
-				// to store candidate map
-				totalRegionCandidateNum += validStoreNum
-				totalRemainingRegionNum += 1
+				// if more than one store is valid, leave the region to the balance strategy
 				taskKey := ri.Region.String()
-				for _, storeID := range ri.AllStores {
-					if _, validStore := storeTaskMap[storeID]; !validStore {
-						continue
-					}
-					if _, ok := storeCandidateRegionMap[storeID]; !ok {
-						candidateMap := make(map[string]RegionInfo)
-						storeCandidateRegionMap[storeID] = candidateMap
-					}
-					if _, duplicateRegion := storeCandidateRegionMap[storeID][taskKey]; duplicateRegion {
-						// duplicated region, should not happen, just give up balance
-						logutil.BgLogger().Warn("Meet duplicated region info during when trying to balance batch cop task, give up balancing")
-						return originalTasks
-					}
-					storeCandidateRegionMap[storeID][taskKey] = ri
+				if _, duplicateRegion := regionKeys[taskKey]; duplicateRegion {
+					// duplicated region, should not happen, just give up balance
+					logutil.BgLogger().Warn("Meet duplicated region info during when trying to balance batch cop task, give up balancing")
+					return originalTasks
 				}
+				regionKeys[taskKey] = struct{}{}
+				regions = append(regions, ri)
 			}
 		}
 	}
-	if totalRemainingRegionNum == 0 {
+	if len(regions) == 0 {
 		return originalTasks
 	}
 
-	avgStorePerRegion := float64(totalRegionCandidateNum) / float64(totalRemainingRegionNum)
-	findNextStore := func(candidateStores []uint64) uint64 {
-		store := uint64(math.MaxUint64)
-		weightedRegionNum := math.MaxFloat64
-		if candidateStores != nil {
-			for _, storeID := range candidateStores {
-				if _, validStore := storeCandidateRegionMap[storeID]; !validStore {
-					continue
-				}
-				num := float64(len(storeCandidateRegionMap[storeID]))/avgStorePerRegion + float64(len(storeTaskMap[storeID].regionInfos))
-				if num < weightedRegionNum {
-					store = storeID
-					weightedRegionNum = num
-				}
-			}
-			if store != uint64(math.MaxUint64) {
-				return store
-			}
-		}
-		for storeID := range storeTaskMap {
-			if _, validStore := storeCandidateRegionMap[storeID]; !validStore {
-				continue
-			}
-			num := float64(len(storeCandidateRegionMap[storeID]))/avgStorePerRegion + float64(len(storeTaskMap[storeID].regionInfos))
-			if num < weightedRegionNum {
-				store = storeID
-				weightedRegionNum = num
-			}
+	assigned := make(map[uint64][]RegionInfo, len(storeTaskMap))
+	for storeID, task := range storeTaskMap {
+		assigned[storeID] = task.regionInfos
+	}
+	for i, storeID := range kvStore.batchCopBalanceStrategy().Assign(regions, assigned, kvStore.batchCopStoreWeights()) {
+		task, ok := storeTaskMap[storeID]
+		if !ok {
+			logutil.BgLogger().Warn("Some regions are not used when trying to balance batch cop task, give up balancing")
+			return originalTasks
 		}
-		return store
+		task.regionInfos = append(task.regionInfos, regions[i])
 	}
 
-	store := findNextStore(nil)
-	for totalRemainingRegionNum > 0 {
-		if store == uint64(math.MaxUint64) {
-			break
+	var ret []*batchCopTask
+	for _, storeID := range sortedStoreIDs(storeTaskMap) {
+		if task := storeTaskMap[storeID]; len(task.regionInfos) > 0 {
+			ret = append(ret, task)
 		}
-		var key string
-		var ri RegionInfo
-		for key, ri = range storeCandidateRegionMap[store] {
-			// get the first region
-			break
+	}
+	return ret
+}
+
+// batchCopBuildOptions are the options of building the batch cop tasks, they are set by the request.
+type batchCopBuildOptions struct {
+	// maxRegions is the max number of regions the tasks can touch. `0` means no limit.
+	maxRegions int
+	// strictDuplicateRegion indicates whether the build fails when a region is referenced twice.
+	strictDuplicateRegion bool
+	// verifyCoverage indicates whether the tasks are verified to cover all the requested key ranges.
+	verifyCoverage bool
+	// disableBalance indicates whether the balance between the TiFlash stores is disabled.
+	disableBalance bool
+	// balanceMinRegions is the min number of regions the tasks are balanced for.
+	balanceMinRegions int
+	// storeRolePreference is the role of the TiFlash peers preferred by the tasks.
+	storeRolePreference StoreRolePreference
+}
+
+func buildOptionsOfRequest(req *kv.Request) batchCopBuildOptions {
+	return batchCopBuildOptions{
+		maxRegions:            req.BatchCopMaxRegions,
+		strictDuplicateRegion: req.BatchCopStrictDuplicateRegion,
+		verifyCoverage:        req.BatchCopVerifyCoverage,
+		disableBalance:        req.BatchCopDisableBalance,
+		balanceMinRegions:     req.BatchCopBalanceMinRegions,
+		storeRolePreference:   StoreRolePreference(req.BatchCopStoreRolePreference),
+	}
+}
+
+// The paths the batch cop tasks are built through.
+const (
+	// BuildPathBalanced means the tasks are balanced between the TiFlash stores.
+	BuildPathBalanced = "balanced"
+	// BuildPathSingleRegion means the tasks touch only one region, there is nothing to balance.
+	BuildPathSingleRegion = "single-region"
+	// BuildPathSkippedSmall means the tasks touch fewer regions than kv.Request.BatchCopBalanceMinRegions.
+	BuildPathSkippedSmall = "skipped-small"
+	// BuildPathDisabled means the balance is disabled by kv.Request.BatchCopDisableBalance.
+	BuildPathDisabled = "disabled"
+)
+
+// batchCopBuildPath decides the path of building the tasks touching regionNum regions. The tasks of MPP are
+// always balanced since the balance detects the available stores.
+func batchCopBuildPath(regionNum int, isMPP bool, opts batchCopBuildOptions) string {
+	switch {
+	case isMPP:
+		return BuildPathBalanced
+	case opts.disableBalance:
+		return BuildPathDisabled
+	case regionNum <= 1:
+		return BuildPathSingleRegion
+	case regionNum < opts.balanceMinRegions:
+		return BuildPathSkippedSmall
+	default:
+		return BuildPathBalanced
+	}
+}
+
+// ErrBatchCopCoverageHoles is returned when the batch cop tasks don't cover some of the requested key ranges.
+type ErrBatchCopCoverageHoles struct {
+	// Holes are the key ranges which no task is responsible for.
+	Holes []kv.KeyRange
+}
+
+func (e *ErrBatchCopCoverageHoles) Error() string {
+	return fmt.Sprintf("batch cop tasks don't cover the key ranges %s", NewKeyRanges(e.Holes))
+}
+
+// verifyBatchCopCoverage checks whether the union of the ranges of the tasks covers all the requested ranges.
+func verifyBatchCopCoverage(ranges *KeyRanges, tasks []*batchCopTask) error {
+	var covered []kv.KeyRange
+	for _, task := range tasks {
+		for _, ri := range task.regionInfos {
+			ri.Ranges.Do(func(ran *kv.KeyRange) {
+				covered = append(covered, *ran)
+			})
 		}
-		storeTaskMap[store].regionInfos = append(storeTaskMap[store].regionInfos, ri)
-		totalRemainingRegionNum--
-		for _, id := range ri.AllStores {
-			if _, ok := storeCandidateRegionMap[id]; ok {
-				delete(storeCandidateRegionMap[id], key)
-				totalRegionCandidateNum--
-				if len(storeCandidateRegionMap[id]) == 0 {
-					delete(storeCandidateRegionMap, id)
-				}
+	}
+	sort.Slice(covered, func(i, j int) bool { return bytes.Compare(covered[i].StartKey, covered[j].StartKey) < 0 })
+	var holes []kv.KeyRange
+	ranges.Do(func(ran *kv.KeyRange) {
+		cur := ran.StartKey
+		for _, c := range covered {
+			if bytes.Compare(cur, ran.EndKey) >= 0 || bytes.Compare(c.StartKey, ran.EndKey) >= 0 {
+				break
+			}
+			if bytes.Compare(c.EndKey, cur) <= 0 {
+				continue
+			}
+			if bytes.Compare(c.StartKey, cur) > 0 {
+				holes = append(holes, kv.KeyRange{StartKey: cur, EndKey: c.StartKey})
 			}
+			cur = c.EndKey
 		}
-		if totalRemainingRegionNum > 0 {
-			avgStorePerRegion = float64(totalRegionCandidateNum) / float64(totalRemainingRegionNum)
-			// it is not optimal because we only check the stores that affected by this region, in fact in order
-			// to find out the store with the lowest weightedRegionNum, all stores should be checked, but I think
-			// check only the affected stores is more simple and will get a good enough result
-			store = findNextStore(ri.AllStores)
+		if bytes.Compare(cur, ran.EndKey) < 0 {
+			holes = append(holes, kv.KeyRange{StartKey: cur, EndKey: ran.EndKey})
 		}
+	})
+	if len(holes) > 0 {
+		return &ErrBatchCopCoverageHoles{Holes: holes}
 	}
-	if totalRemainingRegionNum > 0 {
-		logutil.BgLogger().Warn("Some regions are not used when trying to balance batch cop task, give up balancing")
-		return originalTasks
-	}
+	return nil
+}
 
-	var ret []*batchCopTask
-	for _, task := range storeTaskMap {
-		if len(task.regionInfos) > 0 {
-			ret = append(ret, task)
+// batchCopRegionCache is the subset of RegionCache used to build batch cop tasks, tests can supply a fake one.
+type batchCopRegionCache interface {
+	SplitKeyRangesByLocations(bo *Backoffer, ranges *KeyRanges) ([]*LocationKeyRanges, error)
+	GetTiFlashRPCContext(bo *tikv.Backoffer, id tikv.RegionVerID, loadBalance bool) (*tikv.RPCContext, error)
+	GetAllValidTiFlashStores(id tikv.RegionVerID, currentStore *tikv.Store) []uint64
+	ResolveTiFlashStoreAddr(bo *Backoffer, storeID uint64) (string, error)
+}
+
+// dropUnresolvedStores drops the candidate stores of the region whose addresses can't be resolved, so the regions
+// are never balanced to them. The first store is the current store of the region, it's always kept since its
+// address is resolved along with the RPC context. The resolved results are memorized in `resolved`.
+func dropUnresolvedStores(bo *Backoffer, cache batchCopRegionCache, region tikv.RegionVerID, stores []uint64, resolved map[uint64]bool) []uint64 {
+	if len(stores) <= 1 {
+		return stores
+	}
+	candidates := append(make([]uint64, 0, len(stores)), stores[0])
+	for _, storeID := range stores[1:] {
+		ok, checked := resolved[storeID]
+		if !checked {
+			addr, err := cache.ResolveTiFlashStoreAddr(bo, storeID)
+			ok = err == nil && addr != ""
+			resolved[storeID] = ok
+			if !ok {
+				logutil.Logger(bo.GetCtx()).Warn("drop the TiFlash store whose address is not resolved from the batch cop candidates",
+					zap.Uint64("region id", region.GetID()),
+					zap.Uint64("store id", storeID),
+					zap.Error(err))
+			}
+		}
+		if ok {
+			candidates = append(candidates, storeID)
 		}
 	}
-	return ret
+	return candidates
 }
 
-func buildBatchCopTasks(bo *backoff.Backoffer, store *kvStore, ranges *KeyRanges, storeType kv.StoreType, mppStoreLastFailTime map[string]time.Time, ttl time.Duration) ([]*batchCopTask, error) {
-	cache := store.GetRegionCache()
-	start := time.Now()
+func buildBatchCopTasks(bo *backoff.Backoffer, store *kvStore, cache batchCopRegionCache, ranges *KeyRanges, storeType kv.StoreType, mppStoreLastFailTime map[string]time.Time, ttl time.Duration, retryReasons *batchCopRetryReasons, opts batchCopBuildOptions) ([]*batchCopTask, error) {
+	start := store.batchCopClock().Now()
 	const cmdType = tikvrpc.CmdBatchCop
 	rangesLen := ranges.Len()
-	for {
+	// cold indicates whether the build meets region misses, which means the region cache is stale.
+	cold := false
+	// The resolved regions are kept across the rounds, only the ranges of the missed regions are split again.
+	storeTaskMap := make(map[string]*batchCopTask)
+	// regionIndexes records where each region is put, it's used to detect the duplicated regions.
+	regionIndexes := make(map[uint64]regionIndex)
+	splitRanges := ranges
+	resolvedStores := make(map[uint64]bool)
+	for round := 0; ; round++ {
 
-		locations, err := cache.SplitKeyRangesByLocations(bo, ranges)
+		locations, err := cache.SplitKeyRangesByLocations(bo, splitRanges)
 		if err != nil {
 			return nil, errors.Trace(err)
 		}
+		if regionNum := len(regionIndexes) + len(locations); opts.maxRegions > 0 && regionNum > opts.maxRegions {
+			return nil, errors.Errorf("batch cop request touches %d regions, which exceeds the limit %d", regionNum, opts.maxRegions)
+		}
 		var tasks []*copTask
 		for _, lo := range locations {
 			tasks = append(tasks, &copTask{
@@ -331,45 +572,82 @@ func buildBatchCopTasks(bo *backoff.Backoffer, store *kvStore, ranges *KeyRanges
 
 		var batchTasks []*batchCopTask
 
-		storeTaskMap := make(map[string]*batchCopTask)
-		needRetry := false
+		// missRanges are the ranges of the regions missed in this round.
+		var missRanges []kv.KeyRange
 		for _, task := range tasks {
+			if idx, ok := regionIndexes[task.region.GetID()]; ok {
+				// A region resolved in an earlier round may cover the ranges of a missed region after they merge.
+				if opts.strictDuplicateRegion && idx.round == round {
+					return nil, errors.Errorf("region %d is referenced by more than one batch cop task", task.region.GetID())
+				}
+				ri := &idx.task.regionInfos[idx.offset]
+				ri.Ranges = mergeKeyRanges(ri.Ranges, task.ranges)
+				continue
+			}
 			rpcCtx, err := cache.GetTiFlashRPCContext(bo.TiKVBackoffer(), task.region, false)
 			if err != nil {
 				return nil, errors.Trace(err)
 			}
+			failpoint.Inject("mockBatchCopRegionMiss", func(val failpoint.Value) {
+				// The regions are missed in the first val rounds.
+				if round < val.(int) {
+					rpcCtx = nil
+				}
+			})
 			// When rpcCtx is nil, it's not only attributed to the miss region, but also
 			// some TiFlash stores crash and can't be recovered.
 			// That is not an error that can be easily recovered, so we regard this error
 			// same as rpc error.
 			if rpcCtx == nil {
-				needRetry = true
+				retryReasons.record(retryReasonRegionMiss)
 				logutil.BgLogger().Info("retry for TiFlash peer with region missing", zap.Uint64("region id", task.region.GetID()))
-				// Probably all the regions are invalid. Make the loop continue and mark all the regions invalid.
-				// Then `splitRegion` will reloads these regions.
+				// The ranges of the missed region are split again in the next round, so the region is reloaded.
+				task.ranges.Do(func(ran *kv.KeyRange) {
+					missRanges = append(missRanges, *ran)
+				})
 				continue
 			}
-			allStores := cache.GetAllValidTiFlashStores(task.region, rpcCtx.Store)
-			if batchCop, ok := storeTaskMap[rpcCtx.Addr]; ok {
-				batchCop.regionInfos = append(batchCop.regionInfos, RegionInfo{Region: task.region, Meta: rpcCtx.Meta, Ranges: task.ranges, AllStores: allStores})
+			if rpcCtx, err = preferRPCContextByRole(bo, cache, task.region, rpcCtx, opts.storeRolePreference); err != nil {
+				return nil, errors.Trace(err)
+			}
+			allStores := dropUnresolvedStores(bo, cache, task.region, cache.GetAllValidTiFlashStores(task.region, rpcCtx.Store), resolvedStores)
+			allStores = preferStoresByRole(allStores, rpcCtx.Meta, opts.storeRolePreference)
+			if len(allStores) == 0 {
+				return nil, errNoAvailableTiFlashStore(task.region)
+			}
+			ri := RegionInfo{Region: task.region, Meta: rpcCtx.Meta, Ranges: task.ranges, AllStores: allStores, EstRows: store.estimateRegionRows(task.region)}
+			batchCop, ok := storeTaskMap[rpcCtx.Addr]
+			if ok {
+				batchCop.regionInfos = append(batchCop.regionInfos, ri)
 			} else {
-				batchTask := &batchCopTask{
+				batchCop = &batchCopTask{
 					storeAddr:   rpcCtx.Addr,
 					cmdType:     cmdType,
 					ctx:         rpcCtx,
-					regionInfos: []RegionInfo{{Region: task.region, Meta: rpcCtx.Meta, Ranges: task.ranges, AllStores: allStores}},
+					regionInfos: []RegionInfo{ri},
 				}
-				storeTaskMap[rpcCtx.Addr] = batchTask
+				storeTaskMap[rpcCtx.Addr] = batchCop
 			}
+			regionIndexes[task.region.GetID()] = regionIndex{task: batchCop, offset: len(batchCop.regionInfos) - 1, round: round}
 		}
-		if needRetry {
+		if len(missRanges) > 0 {
+			cold = true
 			// As mentioned above, nil rpcCtx is always attributed to failed stores.
 			// It's equal to long poll the store but get no response. Here we'd better use
 			// TiFlash error to trigger the TiKV fallback mechanism.
+			// The backoffer doesn't report the cancellation of the context, especially the one interrupting its
+			// sleep, so the context is checked around the backoff to stop building for a cancelled query promptly.
+			if err = bo.GetCtx().Err(); err != nil {
+				return nil, errors.Trace(err)
+			}
 			err = bo.Backoff(tikv.BoTiFlashRPC(), errors.New("Cannot find region with TiFlash peer"))
 			if err != nil {
 				return nil, errors.Trace(err)
 			}
+			if err = bo.GetCtx().Err(); err != nil {
+				return nil, errors.Trace(err)
+			}
+			splitRanges = NewKeyRanges(missRanges)
 			continue
 		}
 
@@ -383,7 +661,16 @@ func buildBatchCopTasks(bo *backoff.Backoffer, store *kvStore, ranges *KeyRanges
 			}
 			logutil.BgLogger().Debug(msg)
 		}
-		batchTasks = balanceBatchCopTask(bo.GetCtx(), store, batchTasks, mppStoreLastFailTime, ttl)
+		buildPath := batchCopBuildPath(len(regionIndexes), mppStoreLastFailTime != nil, opts)
+		retryReasons.recordBuildPath(buildPath)
+		if buildPath == BuildPathBalanced {
+			batchTasks = balanceBatchCopTask(bo.GetCtx(), store, batchTasks, mppStoreLastFailTime, ttl)
+		}
+		if opts.verifyCoverage {
+			if err := verifyBatchCopCoverage(ranges, batchTasks); err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
 		if log.GetLevel() <= zap.DebugLevel {
 			msg := "After region balance:"
 			for _, task := range batchTasks {
@@ -392,172 +679,1377 @@ func buildBatchCopTasks(bo *backoff.Backoffer, store *kvStore, ranges *KeyRanges
 			logutil.BgLogger().Debug(msg)
 		}
 
-		if elapsed := time.Since(start); elapsed > time.Millisecond*500 {
+		if elapsed := store.batchCopClock().Since(start); elapsed > time.Millisecond*500 {
 			logutil.BgLogger().Warn("buildBatchCopTasks takes too much time",
 				zap.Duration("elapsed", elapsed),
 				zap.Int("range len", rangesLen),
 				zap.Int("task len", len(batchTasks)))
 		}
 		metrics.TxnRegionsNumHistogramWithBatchCoprocessor.Observe(float64(len(batchTasks)))
+		buildType := "warm"
+		if cold {
+			buildType = "cold"
+		}
+		store.batchCopMetricSink().ObserveBuildTasks(buildType, store.batchCopClock().Since(start))
+		if len(batchTasks) > 0 {
+			ratio := regionImbalanceRatio(batchTasks)
+			store.batchCopMetricSink().ObserveRegionImbalance(ratio)
+			if ratio > batchCopImbalanceLogThreshold && log.GetLevel() <= zap.DebugLevel {
+				regionNums := make(map[string]int, len(batchTasks))
+				for _, task := range batchTasks {
+					regionNums[task.storeAddr] += len(task.regionInfos)
+				}
+				logutil.BgLogger().Debug("batch cop regions are imbalanced", zap.Float64("ratio", ratio), zap.Any("region nums", regionNums))
+			}
+		}
 		return batchTasks, nil
 	}
 }
 
-func (c *CopClient) sendBatch(ctx context.Context, req *kv.Request, vars *tikv.Variables) kv.Response {
-	if req.KeepOrder || req.Desc {
-		return copErrorResponse{errors.New("batch coprocessor cannot prove keep order or desc property")}
-	}
-	ctx = context.WithValue(ctx, tikv.TxnStartKey(), req.StartTs)
-	bo := backoff.NewBackofferWithVars(ctx, copBuildTaskMaxBackoff, vars)
-	ranges := NewKeyRanges(req.KeyRanges)
-	tasks, err := buildBatchCopTasks(bo, c.store.kvStore, ranges, req.StoreType, nil, 0)
-	if err != nil {
-		return copErrorResponse{err}
+// errNoAvailableTiFlashStore is returned when none of the TiFlash stores of the region is available, e.g. all of
+// them are restarting.
+func errNoAvailableTiFlashStore(region tikv.RegionVerID) error {
+	return errors.Errorf("region %d has no available TiFlash store, all its TiFlash peers may be down", region.GetID())
+}
+
+// batchCopImbalanceLogThreshold is the region imbalance ratio above which the region numbers of the stores
+// are logged at debug level.
+const batchCopImbalanceLogThreshold = 2.0
+
+// regionImbalanceRatio returns the max number of regions per store divided by the mean.
+func regionImbalanceRatio(tasks []*batchCopTask) float64 {
+	regionNums := make(map[string]int, len(tasks))
+	total, maxNum := 0, 0
+	for _, task := range tasks {
+		regionNums[task.storeAddr] += len(task.regionInfos)
+		total += len(task.regionInfos)
+		if regionNums[task.storeAddr] > maxNum {
+			maxNum = regionNums[task.storeAddr]
+		}
 	}
-	it := &batchCopIterator{
-		store:     c.store.kvStore,
-		req:       req,
-		finishCh:  make(chan struct{}),
-		vars:      vars,
-		rpcCancel: tikv.NewRPCanceller(),
+	if total == 0 {
+		return 1
 	}
-	ctx = context.WithValue(ctx, tikv.RPCCancellerCtxKey{}, it.rpcCancel)
-	it.tasks = tasks
-	it.respChan = make(chan *batchCopResponse, 2048)
-	go it.run(ctx)
-	return it
+	return float64(maxNum) / (float64(total) / float64(len(regionNums)))
 }
 
-type batchCopIterator struct {
-	store    *kvStore
-	req      *kv.Request
-	finishCh chan struct{}
+// regionIndex locates a region in the batch cop tasks.
+type regionIndex struct {
+	task   *batchCopTask
+	offset int
+	// round is the round of building the tasks in which the region is resolved.
+	round int
+}
 
-	tasks []*batchCopTask
+// mergeKeyRanges merges two sets of key ranges of a region, the result is sorted by the start key.
+func mergeKeyRanges(a, b *KeyRanges) *KeyRanges {
+	ranges := make([]kv.KeyRange, 0, a.Len()+b.Len())
+	a.Do(func(ran *kv.KeyRange) {
+		ranges = append(ranges, *ran)
+	})
+	b.Do(func(ran *kv.KeyRange) {
+		ranges = append(ranges, *ran)
+	})
+	sort.Slice(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i].StartKey, ranges[j].StartKey) < 0
+	})
+	return NewKeyRanges(ranges)
+}
 
-	// Batch results are stored in respChan.
-	respChan chan *batchCopResponse
+// batchCopRetryReason is the reason why a batch cop task is retried.
+type batchCopRetryReason int
 
-	vars *tikv.Variables
+const (
+	// retryReasonStoreError means the request fails to be sent to the store.
+	retryReasonStoreError batchCopRetryReason = iota
+	// retryReasonStreamError means the stream fails when receiving the responses.
+	retryReasonStreamError
+	// retryReasonRegionMiss means some regions have no TiFlash peer when building the tasks.
+	retryReasonRegionMiss
+)
 
-	rpcCancel *tikv.RPCCanceller
+func (r batchCopRetryReason) String() string {
+	switch r {
+	case retryReasonStoreError:
+		return "store_error"
+	case retryReasonStreamError:
+		return "stream_error"
+	case retryReasonRegionMiss:
+		return "region_miss"
+	}
+	return "unknown"
+}
 
-	wg sync.WaitGroup
-	// closed represents when the Close is called.
-	// There are two cases we need to close the `finishCh` channel, one is when context is done, the other one is
-	// when the Close is called. we use atomic.CompareAndSwap `closed` to to make sure the channel is not closed twice.
-	closed uint32
+// sendFailType classifies the error a request fails to be sent with, it's a network error when the store
+// is unreachable or doesn't answer in time.
+func sendFailType(err error) string {
+	switch status.Code(errors.Cause(err)) {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return "network"
+	default:
+		return retryReasonStoreError.String()
+	}
 }
 
-func (b *batchCopIterator) run(ctx context.Context) {
-	// We run workers for every batch cop.
-	for _, task := range b.tasks {
-		b.wg.Add(1)
-		boMaxSleep := copNextMaxBackoff
-		failpoint.Inject("ReduceCopNextMaxBackoff", func(value failpoint.Value) {
-			if value.(bool) {
-				boMaxSleep = 2
-			}
-		})
-		bo := backoff.NewBackofferWithVars(ctx, boMaxSleep, b.vars)
-		go b.handleTask(ctx, bo, task)
+// batchCopRetryReasons counts the retries of a query by reason, a nil one records nothing.
+type batchCopRetryReasons struct {
+	mu      sync.Mutex
+	reasons map[string]int
+	// buildPath is the path the tasks of the query are built through first, the rebuilds on retry don't change it.
+	buildPath string
+}
+
+func (r *batchCopRetryReasons) recordBuildPath(path string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.buildPath == "" {
+		r.buildPath = path
 	}
-	b.wg.Wait()
-	close(b.respChan)
 }
 
-// Next returns next coprocessor result.
-// NOTE: Use nil to indicate finish, so if the returned ResultSubset is not nil, reader should continue to call Next().
-func (b *batchCopIterator) Next(ctx context.Context) (kv.ResultSubset, error) {
-	var (
-		resp   *batchCopResponse
-		ok     bool
-		closed bool
-	)
+func (r *batchCopRetryReasons) getBuildPath() string {
+	if r == nil {
+		return ""
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.buildPath
+}
 
-	// Get next fetched resp from chan
-	resp, ok, closed = b.recvFromRespCh(ctx)
-	if !ok || closed {
-		return nil, nil
+func (r *batchCopRetryReasons) record(reason batchCopRetryReason) {
+	if r == nil {
+		return
 	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.reasons == nil {
+		r.reasons = make(map[string]int)
+	}
+	r.reasons[reason.String()]++
+}
 
-	if resp.err != nil {
-		return nil, errors.Trace(resp.err)
+func (r *batchCopRetryReasons) snapshot() map[string]int {
+	ret := make(map[string]int)
+	if r == nil {
+		return ret
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for reason, count := range r.reasons {
+		ret[reason] = count
+	}
+	return ret
+}
+
+// batchCopMetricLabels is the allowlist of query labels that can be recorded in the batch cop metrics,
+// the allowlist bounds the cardinality of the metrics.
+var batchCopMetricLabels atomic.Value
+
+// labelOther is the metric label for the query labels that are not in the allowlist.
+const labelOther = "other"
+
+// SetBatchCopMetricLabels sets the allowlist of query labels recorded in the batch cop metrics.
+func SetBatchCopMetricLabels(labels []string) {
+	allowlist := make(map[string]struct{}, len(labels))
+	for _, label := range labels {
+		allowlist[label] = struct{}{}
 	}
+	batchCopMetricLabels.Store(allowlist)
+}
 
-	err := b.store.CheckVisibility(b.req.StartTs)
+func batchCopMetricLabel(label string) string {
+	if label == "" {
+		return ""
+	}
+	if allowlist, ok := batchCopMetricLabels.Load().(map[string]struct{}); ok {
+		if _, ok := allowlist[label]; ok {
+			return label
+		}
+	}
+	return labelOther
+}
+
+func (c *CopClient) sendBatch(ctx context.Context, req *kv.Request, vars *tikv.Variables) kv.Response {
+	if req.Desc {
+		return copErrorResponse{errors.New("batch coprocessor cannot prove desc property")}
+	}
+	ctx = withBatchCopRequest(ctx, req)
+	if req.BatchCopLazyBuildRegions > 0 {
+		return &batchCopLazyIterator{client: c, ctx: ctx, req: req, vars: vars, rest: NewKeyRanges(req.KeyRanges)}
+	}
+	tasks, retryReasons, err := c.buildBatchCopTasksOfRequest(ctx, req, vars)
 	if err != nil {
-		return nil, errors.Trace(err)
+		return copErrorResponse{err}
 	}
-	return resp, nil
+	return c.startBatchCopIterator(ctx, req, vars, tasks, retryReasons)
 }
 
-func (b *batchCopIterator) recvFromRespCh(ctx context.Context) (resp *batchCopResponse, ok bool, exit bool) {
-	ticker := time.NewTicker(3 * time.Second)
-	defer ticker.Stop()
+// batchCopLazyIterator builds the tasks of a group of regions only after the responses of the former group are
+// all received, the regions are grouped in the order of their keys.
+type batchCopLazyIterator struct {
+	client *CopClient
+	ctx    context.Context
+	req    *kv.Request
+	vars   *tikv.Variables
+	// rest are the ranges whose tasks are not built yet.
+	rest *KeyRanges
+	// cur is the iterator of the tasks of the current group, it's nil if the tasks of the next group are not built.
+	cur *batchCopIterator
+	// builtTasks is the number of the tasks built so far.
+	builtTasks int
+}
+
+// Next returns the next response, the tasks of the next group are built once the current group is finished.
+func (l *batchCopLazyIterator) Next(ctx context.Context) (kv.ResultSubset, error) {
 	for {
-		select {
-		case resp, ok = <-b.respChan:
-			return
-		case <-ticker.C:
-			if atomic.LoadUint32(b.vars.Killed) == 1 {
-				resp = &batchCopResponse{err: derr.ErrQueryInterrupted}
-				ok = true
-				return
+		if l.cur == nil {
+			if l.rest.Len() == 0 {
+				return nil, nil
 			}
-		case <-b.finishCh:
-			exit = true
-			return
-		case <-ctx.Done():
-			// We select the ctx.Done() in the thread of `Next` instead of in the worker to avoid the cost of `WithCancel`.
-			if atomic.CompareAndSwapUint32(&b.closed, 0, 1) {
-				close(b.finishCh)
+			if err := l.buildNextGroup(); err != nil {
+				return nil, errors.Trace(err)
 			}
-			exit = true
-			return
+		}
+		resp, err := l.cur.Next(ctx)
+		if err != nil || resp != nil {
+			return resp, err
+		}
+		err = l.cur.Close()
+		l.cur = nil
+		if err != nil {
+			return nil, errors.Trace(err)
 		}
 	}
 }
 
-// Close releases the resource.
-func (b *batchCopIterator) Close() error {
-	if atomic.CompareAndSwapUint32(&b.closed, 0, 1) {
-		close(b.finishCh)
+func (l *batchCopLazyIterator) buildNextGroup() error {
+	bo := backoff.NewBackofferWithVars(l.ctx, copBuildTaskMaxBackoff, l.vars)
+	ranges, rest, err := l.client.store.GetRegionCache().SplitFirstRegions(bo, l.rest, l.req.BatchCopLazyBuildRegions)
+	if err != nil {
+		return err
 	}
-	b.rpcCancel.CancelAll()
-	b.wg.Wait()
+	tasks, retryReasons, err := l.client.buildBatchCopTasksOfRanges(l.ctx, l.req, l.vars, ranges)
+	if err != nil {
+		return err
+	}
+	l.rest = rest
+	l.cur = l.client.startBatchCopIterator(l.ctx, l.req, l.vars, tasks, retryReasons)
+	l.builtTasks += len(l.cur.tasks)
 	return nil
 }
 
-func (b *batchCopIterator) handleTask(ctx context.Context, bo *Backoffer, task *batchCopTask) {
-	tasks := []*batchCopTask{task}
-	for idx := 0; idx < len(tasks); idx++ {
-		ret, err := b.handleTaskOnce(ctx, bo, tasks[idx])
-		if err != nil {
-			resp := &batchCopResponse{err: errors.Trace(err), detail: new(CopRuntimeStats)}
-			b.sendToRespCh(resp)
-			break
-		}
-		tasks = append(tasks, ret...)
+// Close closes the iterator of the current group, the tasks of the rest groups are never built.
+func (l *batchCopLazyIterator) Close() error {
+	if l.cur == nil {
+		return nil
 	}
-	b.wg.Done()
+	err := l.cur.Close()
+	l.cur = nil
+	return err
 }
 
-// Merge all ranges and request again.
-func (b *batchCopIterator) retryBatchCopTask(ctx context.Context, bo *backoff.Backoffer, batchTask *batchCopTask) ([]*batchCopTask, error) {
-	var ranges []kv.KeyRange
-	for _, ri := range batchTask.regionInfos {
-		ri.Ranges.Do(func(ran *kv.KeyRange) {
+// withBatchCopRequest attaches the StartTs of the request to the context.
+func withBatchCopRequest(ctx context.Context, req *kv.Request) context.Context {
+	return context.WithValue(ctx, tikv.TxnStartKey(), req.StartTs)
+}
+
+// buildBatchCopTasksOfRequest builds the tasks of the request.
+func (c *CopClient) buildBatchCopTasksOfRequest(ctx context.Context, req *kv.Request, vars *tikv.Variables) ([]*batchCopTask, *batchCopRetryReasons, error) {
+	return c.buildBatchCopTasksOfRanges(ctx, req, vars, NewKeyRanges(req.KeyRanges))
+}
+
+// buildBatchCopTasksOfRanges builds the tasks of the request for the ranges.
+func (c *CopClient) buildBatchCopTasksOfRanges(ctx context.Context, req *kv.Request, vars *tikv.Variables, ranges *KeyRanges) ([]*batchCopTask, *batchCopRetryReasons, error) {
+	bo := backoff.NewBackofferWithVars(ctx, copBuildTaskMaxBackoff, vars)
+	retryReasons := &batchCopRetryReasons{}
+	tasks, err := buildBatchCopTasks(bo, c.store.kvStore, c.store.GetRegionCache(), ranges, req.StoreType, nil, 0, retryReasons, buildOptionsOfRequest(req))
+	if err != nil {
+		return nil, nil, err
+	}
+	if tasks, err = c.applyBalanceHook(ranges, tasks, buildOptionsOfRequest(req)); err != nil {
+		return nil, nil, err
+	}
+	if req.SampleMode {
+		sampleBatchCopTasks(tasks)
+	}
+	return tasks, retryReasons, nil
+}
+
+// applyBalanceHook passes the balanced tasks through the BalanceHook of the client if it's set.
+func (c *CopClient) applyBalanceHook(ranges *KeyRanges, tasks []*batchCopTask, opts batchCopBuildOptions) ([]*batchCopTask, error) {
+	if c == nil || c.BalanceHook == nil {
+		return tasks, nil
+	}
+	tasks = c.BalanceHook(tasks)
+	if opts.verifyCoverage {
+		if err := verifyBatchCopCoverage(ranges, tasks); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	return tasks, nil
+}
+
+// startBatchCopIterator creates an iterator which handles the tasks and starts its workers.
+func (c *CopClient) startBatchCopIterator(ctx context.Context, req *kv.Request, vars *tikv.Variables, tasks []*batchCopTask,
+	retryReasons *batchCopRetryReasons) *batchCopIterator {
+	if req.KeepOrder {
+		sortBatchCopTasksByKey(tasks)
+		for _, task := range tasks {
+			task.respChan = make(chan *batchCopResponse, 1)
+		}
+	}
+	it := &batchCopIterator{
+		id:            newBatchCopIteratorID(req.StartTs),
+		store:         c.store.kvStore,
+		client:        c,
+		req:           req,
+		finishCh:      make(chan struct{}),
+		vars:          vars,
+		rpcCancel:     tikv.NewRPCanceller(),
+		metricLabel:   batchCopMetricLabel(req.MetricLabel),
+		memTracker:    req.MemTracker,
+		retryReasons:  retryReasons,
+		replicaPolicy: NewReplicaSelectPolicy(req.BatchCopReplicaSelectPolicy),
+	}
+	if req.BatchCopMinChunkInterval > 0 {
+		it.deliveryLimiter = newDeliveryLimiter(it.store.batchCopClock(), req.BatchCopMinChunkInterval, 1)
+	}
+	if it.memTracker != nil && req.BatchCopMemoryReserve > 0 {
+		it.memReserved = req.BatchCopMemoryReserve
+		it.memTracker.Consume(it.memReserved)
+	}
+	// TiFlash logs the task ID and the resource group tag of the request context, so they correlate the logs.
+	it.log = logutil.BgLogger().With(zap.String("iterator id", it.id), zap.Uint64("conn id", req.ConnID), zap.Uint64("task id", req.TaskID))
+	it.startTime = it.store.batchCopClock().Now()
+	ctx = context.WithValue(ctx, tikv.RPCCancellerCtxKey{}, it.rpcCancel)
+	it.tasks = tasks
+	if req.AttachTopology {
+		it.topology = newBatchCopTopology(tasks)
+	}
+	it.respChan = make(chan *batchCopResponse, batchCopRespChanSize(req.BatchCopRespChanSize, batchCopWorkerConcurrency(req.Concurrency, len(tasks))))
+	if req.BatchCopRespChanBytes > 0 {
+		it.respBytes = newRespBytesLimiter(req.BatchCopRespChanBytes)
+	}
+	// The workers are added before run, so Close never misses them.
+	it.wg.Add(len(tasks))
+	go it.run(ctx)
+	return it
+}
+
+const (
+	// defaultBatchCopRespChanSize is the max size of respChan when kv.Request.BatchCopRespChanSize is not set.
+	defaultBatchCopRespChanSize = 2048
+	// batchCopRespChanSizePerWorker is the size of respChan reserved for each worker when the size is not set.
+	batchCopRespChanSizePerWorker = 64
+)
+
+// batchCopRespChanSize returns the buffer size of respChan, it's derived from the number of workers if the size
+// isn't set. Only the running workers produce the responses, so a query with a single task or a low concurrency
+// doesn't need a large buffer.
+func batchCopRespChanSize(size int, workerNum int) int {
+	if size > 0 {
+		return size
+	}
+	size = workerNum * batchCopRespChanSizePerWorker
+	if size <= 0 || size > defaultBatchCopRespChanSize {
+		return defaultBatchCopRespChanSize
+	}
+	return size
+}
+
+// sampleBatchCopTasks trims each task to its first region, the rpc context of the task is related to it.
+func sampleBatchCopTasks(tasks []*batchCopTask) {
+	for _, task := range tasks {
+		task.regionInfos = task.regionInfos[:1]
+	}
+}
+
+// batchCopIteratorSeq is the sequence used to generate the iterator ids.
+var batchCopIteratorSeq uint64
+
+// newBatchCopIteratorID generates an id unique in the process, it's made up of the start ts and a sequence.
+func newBatchCopIteratorID(startTs uint64) string {
+	return strconv.FormatUint(startTs, 10) + "-" + strconv.FormatUint(atomic.AddUint64(&batchCopIteratorSeq, 1), 10)
+}
+
+type batchCopIterator struct {
+	// id identifies the iterator in the logs.
+	id       string
+	log      *zap.Logger
+	store    *kvStore
+	client   *CopClient
+	req      *kv.Request
+	finishCh chan struct{}
+
+	tasks []*batchCopTask
+
+	// Batch results are stored in respChan.
+	respChan chan *batchCopResponse
+	// mergeHeap holds the next responses of the outstanding tasks in the keep order mode, and pendingTasks are the
+	// sorted indexes of the tasks whose next responses are yet to be received. taskStartKeys caches the start keys
+	// of the tasks. They're only used by the goroutine calling Next, and mergeHeap is nil before the first response
+	// is received.
+	mergeHeap     *batchCopMergeHeap
+	pendingTasks  []int
+	taskStartKeys []kv.Key
+
+	vars *tikv.Variables
+
+	rpcCancel *tikv.RPCCanceller
+
+	wg sync.WaitGroup
+	// closed represents when the Close is called.
+	// There are two cases we need to close the `finishCh` channel, one is when context is done, the other one is
+	// when the Close is called. we use atomic.CompareAndSwap `closed` to to make sure the channel is not closed twice.
+	closed uint32
+	// draining is set when Close waits for the tasks being sent, neither new tasks nor retries are sent then.
+	draining uint32
+	// closedByConsumer is set when finishCh is closed by Close, the streams are drained only in this case but not
+	// when the query is cancelled, runs out of memory or panics.
+	closedByConsumer uint32
+	// cancelled indicates whether the context of the consumer is done.
+	cancelled uint32
+	// startTime is when the request is sent, it's used in the summary log.
+	startTime   time.Time
+	summaryOnce sync.Once
+
+	// metricLabel is the query label recorded in the batch cop metrics.
+	metricLabel string
+
+	// topology is attached to the first delivered response, then it's reset to nil.
+	topology *BatchCopTopology
+
+	// handleTimeNs is the total time spent on handling responses in nanoseconds.
+	handleTimeNs int64
+	// tiflashCPUNs is the total CPU time TiFlash spends on the responses in nanoseconds.
+	tiflashCPUNs int64
+	// streamsOpened is the number of the streams established with the stores, the retried tasks are included.
+	streamsOpened int64
+	// emptyChunks is the number of the responses without data.
+	emptyChunks int64
+	// isolationLevel is the kvrpcpb.IsolationLevel of the requests sent to TiFlash, it's set when they are sent.
+	isolationLevel int32
+	// backoffWarned is set once the backoff sleep exceeds kv.Request.BatchCopBackoffSoftCap, so the warning is logged only once.
+	backoffWarned uint32
+
+	memTracker *memory.Tracker
+	// memReserved is the memory consumed from memTracker up front, it's released on Close.
+	memReserved int64
+	// memConsumed is the memory of the responses sent to the consumer but not received yet.
+	memConsumed int64
+	// oomErr is set when the memory quota is exceeded and the query is cancelled.
+	oomErr atomic.Value
+	// panicErr is set when a worker panics, the query is cancelled and the error is returned by Next.
+	panicErr atomic.Value
+
+	// deliveryLimiter limits the rate of responses delivered by Next, it's nil when there is no limit.
+	deliveryLimiter *deliveryLimiter
+
+	retryReasons *batchCopRetryReasons
+	// replicaPolicy chooses the replicas of the regions when the tasks are rebuilt, it's nil if no policy is set.
+	replicaPolicy ReplicaSelectPolicy
+
+	// respBytes bounds the total bytes of the responses in respChan, it's nil when there is no limit.
+	respBytes *respBytesLimiter
+
+	startKeysMu sync.Mutex
+	// startKeyOwners maps the start keys of the delivered responses to the tasks they come from, it's only
+	// used to detect the duplicate start keys.
+	startKeyOwners map[string]*batchCopTask
+
+	storeBackoffMu struct {
+		sync.Mutex
+		// backoff is the total backoff time attributed to each store, it survives task rebuilds.
+		backoff map[string]time.Duration
+	}
+
+	storeBytesMu struct {
+		sync.Mutex
+		// bytes is the total size of the responses received from each store.
+		bytes map[string]int64
+	}
+
+	failedStoresMu struct {
+		sync.Mutex
+		// stores are the failed stores of each region, they survive task rebuilds.
+		stores map[uint64]map[uint64]struct{}
+	}
+
+	regionRetriesMu struct {
+		sync.Mutex
+		// retries are the retry counts of each region, they survive task rebuilds.
+		retries map[uint64]int
+	}
+
+	unreachableMu struct {
+		sync.Mutex
+		// addrs are the addresses of the stores which the requests fail to be sent to, they're reported by
+		// RegionBatchRequestSender.
+		addrs map[string]struct{}
+	}
+
+	emptyRangesMu struct {
+		sync.Mutex
+		// ranges are the key ranges of the tasks which finish without any data.
+		ranges []kv.KeyRange
+	}
+}
+
+// recordEmptyRanges records the ranges of a task which finishes without any data. TiFlash doesn't report
+// the rows per region, so the ranges are collected at the granularity of a task.
+func (b *batchCopIterator) recordEmptyRanges(task *batchCopTask) {
+	b.emptyRangesMu.Lock()
+	defer b.emptyRangesMu.Unlock()
+	for _, ri := range task.regionInfos {
+		ri.Ranges.Do(func(ran *kv.KeyRange) {
+			b.emptyRangesMu.ranges = append(b.emptyRangesMu.ranges, *ran)
+		})
+	}
+}
+
+// EmptyRanges returns the key ranges that produce no rows, they are sorted by the start key.
+func (b *batchCopIterator) EmptyRanges() []kv.KeyRange {
+	b.emptyRangesMu.Lock()
+	defer b.emptyRangesMu.Unlock()
+	ranges := make([]kv.KeyRange, len(b.emptyRangesMu.ranges))
+	copy(ranges, b.emptyRangesMu.ranges)
+	sort.Slice(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i].StartKey, ranges[j].StartKey) < 0
+	})
+	return ranges
+}
+
+func (b *batchCopIterator) recordStoreBackoff(storeAddr string, backoff time.Duration) {
+	if backoff <= 0 {
+		return
+	}
+	b.storeBackoffMu.Lock()
+	defer b.storeBackoffMu.Unlock()
+	if b.storeBackoffMu.backoff == nil {
+		b.storeBackoffMu.backoff = make(map[string]time.Duration)
+	}
+	b.storeBackoffMu.backoff[storeAddr] += backoff
+}
+
+// ID returns the id of the iterator, which is attached to all its logs.
+func (b *batchCopIterator) ID() string {
+	return b.id
+}
+
+func (b *batchCopIterator) logger() *zap.Logger {
+	if b.log == nil {
+		return logutil.BgLogger()
+	}
+	return b.log
+}
+
+// RetryReasons returns how many times the tasks are retried for each reason.
+func (b *batchCopIterator) RetryReasons() map[string]int {
+	return b.retryReasons.snapshot()
+}
+
+// BuildPath returns the path the tasks are built through, it's one of the BuildPath constants.
+func (b *batchCopIterator) BuildPath() string {
+	return b.retryReasons.getBuildPath()
+}
+
+// recordStoreBytes adds the bytes received from the store, it fails if the store returns more bytes than the limit.
+func (b *batchCopIterator) recordStoreBytes(storeAddr string, bytes int64) error {
+	b.storeBytesMu.Lock()
+	defer b.storeBytesMu.Unlock()
+	if b.storeBytesMu.bytes == nil {
+		b.storeBytesMu.bytes = make(map[string]int64)
+	}
+	b.storeBytesMu.bytes[storeAddr] += bytes
+	if limit := b.req.BatchCopStoreMaxBytes; limit > 0 && b.storeBytesMu.bytes[storeAddr] > limit {
+		return errors.Errorf("batch cop responses from store %s exceed the limit %d bytes", storeAddr, limit)
+	}
+	return nil
+}
+
+// ErrAllTiFlashReplicasFailed is returned when the requests to all the TiFlash replicas of a region fail.
+type ErrAllTiFlashReplicasFailed struct {
+	RegionID uint64
+	// Stores are the ids of the attempted stores.
+	Stores []uint64
+}
+
+func (e *ErrAllTiFlashReplicasFailed) Error() string {
+	return fmt.Sprintf("all TiFlash replicas of region %d failed, attempted stores: %v", e.RegionID, e.Stores)
+}
+
+// ErrBatchCopRegionTooManyRetries is returned when a region is retried more than kv.Request.BatchCopMaxRegionRetries
+// times across the task rebuilds.
+type ErrBatchCopRegionTooManyRetries struct {
+	RegionID uint64
+	Retries  int
+	// Ranges are the key ranges of the region which fail.
+	Ranges []kv.KeyRange
+}
+
+func (e *ErrBatchCopRegionTooManyRetries) Error() string {
+	return fmt.Sprintf("region %d is retried %d times, ranges: %s", e.RegionID, e.Retries, NewKeyRanges(e.Ranges))
+}
+
+// ErrTiFlashStoresUnreachable wraps the error a batch cop request fails with, and lists the stores which
+// the requests fail to be sent to before it.
+type ErrTiFlashStoresUnreachable struct {
+	Addrs []string
+	Err   error
+}
+
+func (e *ErrTiFlashStoresUnreachable) Error() string {
+	return fmt.Sprintf("%v, unreachable TiFlash stores: %v", e.Err, e.Addrs)
+}
+
+// Cause returns the wrapped error, so errors.Cause sees through it.
+func (e *ErrTiFlashStoresUnreachable) Cause() error {
+	return e.Err
+}
+
+func (b *batchCopIterator) recordUnreachableStore(storeAddr string) {
+	b.unreachableMu.Lock()
+	defer b.unreachableMu.Unlock()
+	if b.unreachableMu.addrs == nil {
+		b.unreachableMu.addrs = make(map[string]struct{})
+	}
+	b.unreachableMu.addrs[storeAddr] = struct{}{}
+}
+
+// UnreachableStores returns the sorted addresses of the stores which the requests fail to be sent to.
+func (b *batchCopIterator) UnreachableStores() []string {
+	b.unreachableMu.Lock()
+	defer b.unreachableMu.Unlock()
+	addrs := make([]string, 0, len(b.unreachableMu.addrs))
+	for addr := range b.unreachableMu.addrs {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// withUnreachableStores enriches the terminal error of a task with the unreachable stores, if there are any.
+func (b *batchCopIterator) withUnreachableStores(err error) error {
+	addrs := b.UnreachableStores()
+	if len(addrs) == 0 {
+		return err
+	}
+	return &ErrTiFlashStoresUnreachable{Addrs: addrs, Err: err}
+}
+
+// recordRegionRetries counts a retry for each region of the task, it returns ErrBatchCopRegionTooManyRetries
+// once some region is retried more than kv.Request.BatchCopMaxRegionRetries times.
+func (b *batchCopIterator) recordRegionRetries(task *batchCopTask) error {
+	maxRetries := b.req.BatchCopMaxRegionRetries
+	if maxRetries <= 0 {
+		return nil
+	}
+	b.regionRetriesMu.Lock()
+	defer b.regionRetriesMu.Unlock()
+	if b.regionRetriesMu.retries == nil {
+		b.regionRetriesMu.retries = make(map[uint64]int)
+	}
+	var exceeded *ErrBatchCopRegionTooManyRetries
+	for _, ri := range task.regionInfos {
+		regionID := ri.Region.GetID()
+		b.regionRetriesMu.retries[regionID]++
+		if exceeded == nil && b.regionRetriesMu.retries[regionID] > maxRetries {
+			exceeded = &ErrBatchCopRegionTooManyRetries{RegionID: regionID, Retries: maxRetries}
+			ri.Ranges.Do(func(ran *kv.KeyRange) {
+				exceeded.Ranges = append(exceeded.Ranges, *ran)
+			})
+		}
+	}
+	if exceeded != nil {
+		return exceeded
+	}
+	return nil
+}
+
+// recordReplicaFailure records that the store of the task fails for all the regions of the task, it returns
+// ErrAllTiFlashReplicasFailed if all the replicas of some region have failed. It does nothing unless
+// req.FailOnAllTiFlashReplicasFailed is set.
+func (b *batchCopIterator) recordReplicaFailure(task *batchCopTask) error {
+	if !b.req.FailOnAllTiFlashReplicasFailed || task.ctx == nil || task.ctx.Store == nil {
+		return nil
+	}
+	storeID := task.ctx.Store.StoreID()
+	b.failedStoresMu.Lock()
+	defer b.failedStoresMu.Unlock()
+	if b.failedStoresMu.stores == nil {
+		b.failedStoresMu.stores = make(map[uint64]map[uint64]struct{})
+	}
+	for _, ri := range task.regionInfos {
+		regionID := ri.Region.GetID()
+		failed, ok := b.failedStoresMu.stores[regionID]
+		if !ok {
+			failed = make(map[uint64]struct{})
+			b.failedStoresMu.stores[regionID] = failed
+		}
+		failed[storeID] = struct{}{}
+		if len(ri.AllStores) == 0 {
+			continue
+		}
+		exhausted := true
+		for _, id := range ri.AllStores {
+			if _, ok := failed[id]; !ok {
+				exhausted = false
+				break
+			}
+		}
+		if exhausted {
+			stores := make([]uint64, 0, len(failed))
+			for id := range failed {
+				stores = append(stores, id)
+			}
+			sort.Slice(stores, func(i, j int) bool { return stores[i] < stores[j] })
+			return &ErrAllTiFlashReplicasFailed{RegionID: regionID, Stores: stores}
+		}
+	}
+	return nil
+}
+
+// StoreBackoffTime returns the total backoff time attributed to each store.
+func (b *batchCopIterator) StoreBackoffTime() map[string]time.Duration {
+	b.storeBackoffMu.Lock()
+	defer b.storeBackoffMu.Unlock()
+	ret := make(map[string]time.Duration, len(b.storeBackoffMu.backoff))
+	for addr, backoff := range b.storeBackoffMu.backoff {
+		ret[addr] = backoff
+	}
+	return ret
+}
+
+// TotalHandleTime returns the total time spent on handling responses.
+func (b *batchCopIterator) TotalHandleTime() time.Duration {
+	return time.Duration(atomic.LoadInt64(&b.handleTimeNs))
+}
+
+// TotalTiFlashCPU returns the total CPU time TiFlash spends on the responses.
+func (b *batchCopIterator) TotalTiFlashCPU() time.Duration {
+	return time.Duration(atomic.LoadInt64(&b.tiflashCPUNs))
+}
+
+// StreamsOpened returns the number of the streams established with the stores, the retried tasks are included.
+func (b *batchCopIterator) StreamsOpened() int {
+	return int(atomic.LoadInt64(&b.streamsOpened))
+}
+
+// IsolationLevel returns the isolation level of the requests sent to TiFlash, it's the one the requests are
+// actually sent with rather than the one of kv.Request. It's SI, the zero value, before any request is sent.
+func (b *batchCopIterator) IsolationLevel() kvrpcpb.IsolationLevel {
+	return kvrpcpb.IsolationLevel(atomic.LoadInt32(&b.isolationLevel))
+}
+
+// EmptyChunks returns the number of the responses without data, including the ones skipped by
+// BatchCopSkipEmptyChunks.
+func (b *batchCopIterator) EmptyChunks() int {
+	return int(atomic.LoadInt64(&b.emptyChunks))
+}
+
+func (b *batchCopIterator) run(ctx context.Context) {
+	defer func() {
+		// The responses left by a panicked worker are never received, drain them to release their memory.
+		if b.panicErr.Load() != nil {
+			b.drainRespChans()
+		}
+	}()
+	// The tasks are queued in order, so the tasks with smaller keys are handled first in the keep order mode.
+	taskCh := make(chan *batchCopTask, len(b.tasks))
+	for _, task := range b.tasks {
+		taskCh <- task
+	}
+	close(taskCh)
+	for i := 0; i < batchCopWorkerConcurrency(b.req.Concurrency, len(b.tasks)); i++ {
+		go b.runWorker(ctx, taskCh)
+	}
+	b.wg.Wait()
+	close(b.respChan)
+}
+
+// drainRespChans receives all the responses left in the channels, it's called after the workers exit.
+func (b *batchCopIterator) drainRespChans() {
+	for resp := range b.respChan {
+		b.releaseResp(resp)
+	}
+	for _, task := range b.tasks {
+		if task.respChan == nil {
+			continue
+		}
+		for resp := range task.respChan {
+			b.releaseResp(resp)
+		}
+	}
+}
+
+// batchCopWorkerConcurrency returns the number of workers, it's req.Concurrency if set, or twice the number
+// of CPUs otherwise. There are never more workers than tasks.
+func batchCopWorkerConcurrency(concurrency int, taskNum int) int {
+	if concurrency <= 0 {
+		concurrency = 2 * runtime.NumCPU()
+	}
+	if concurrency > taskNum {
+		concurrency = taskNum
+	}
+	return concurrency
+}
+
+func (b *batchCopIterator) runWorker(ctx context.Context, taskCh <-chan *batchCopTask) {
+	for task := range taskCh {
+		atomic.StoreUint32(&task.started, 1)
+		select {
+		case <-b.finishCh:
+			// The queued tasks are skipped once the iterator is finished, but they still have to be done.
+			if task.respChan != nil {
+				close(task.respChan)
+			}
+			b.wg.Done()
+			continue
+		default:
+		}
+		if b.isDraining() {
+			if task.respChan != nil {
+				close(task.respChan)
+			}
+			b.wg.Done()
+			continue
+		}
+		boMaxSleep := copNextMaxBackoff
+		failpoint.Inject("ReduceCopNextMaxBackoff", func(value failpoint.Value) {
+			if value.(bool) {
+				boMaxSleep = 2
+			}
+		})
+		boMaxSleep = batchCopBackoffBudget(ctx, boMaxSleep, b.vars)
+		bo := backoff.NewBackofferWithVars(ctx, boMaxSleep, b.vars)
+		b.handleTask(ctx, bo, task)
+	}
+}
+
+// batchCopBackoffBudget caps the max sleep time(in ms) of the backoffer at the time left before the deadline of
+// the context, so the task doesn't keep retrying after the statement times out. The backoffer scales the budget
+// by the backoff weight of vars, so the time left is divided by it.
+func batchCopBackoffBudget(ctx context.Context, maxSleep int, vars *tikv.Variables) int {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return maxSleep
+	}
+	remaining := int(time.Until(deadline) / time.Millisecond)
+	if vars != nil && vars.BackOffWeight > 1 {
+		remaining /= vars.BackOffWeight
+	}
+	if remaining < maxSleep {
+		maxSleep = remaining
+	}
+	// `0` means no limit for the backoffer, so there is always a budget of at least 1ms.
+	if maxSleep < 1 {
+		maxSleep = 1
+	}
+	return maxSleep
+}
+
+// Next returns next coprocessor result.
+// NOTE: Use nil to indicate finish, so if the returned ResultSubset is not nil, reader should continue to call Next().
+func (b *batchCopIterator) Next(ctx context.Context) (kv.ResultSubset, error) {
+	var (
+		resp   *batchCopResponse
+		ok     bool
+		closed bool
+	)
+
+	// Get next fetched resp from chan
+	resp, ok, closed = b.recvFromRespCh(ctx)
+	if !ok || closed {
+		if err, ok := b.oomErr.Load().(error); ok {
+			return nil, errors.Trace(err)
+		}
+		if err, ok := b.panicErr.Load().(error); ok {
+			return nil, errors.Trace(err)
+		}
+		return nil, nil
+	}
+
+	if resp.err != nil {
+		return nil, errors.Trace(resp.err)
+	}
+
+	err := b.store.CheckVisibility(b.req.StartTs)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if b.topology != nil {
+		resp.topology = b.topology
+		b.topology = nil
+	}
+	if b.deliveryLimiter != nil {
+		if err = b.deliveryLimiter.wait(ctx); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	return resp, nil
+}
+
+// deliveryLimiter is a token bucket which refills a token every interval and holds at most burst tokens.
+// It's only used by the goroutine calling Next, so it needs no lock.
+type deliveryLimiter struct {
+	clock    clock
+	interval time.Duration
+	burst    float64
+	tokens   float64
+	last     time.Time
+}
+
+func newDeliveryLimiter(clock clock, interval time.Duration, burst int) *deliveryLimiter {
+	return &deliveryLimiter{clock: clock, interval: interval, burst: float64(burst), tokens: float64(burst)}
+}
+
+// wait takes a token from the bucket, it blocks until a token is available or the context is done.
+func (l *deliveryLimiter) wait(ctx context.Context) error {
+	now := l.clock.Now()
+	if !l.last.IsZero() {
+		l.tokens = math.Min(l.burst, l.tokens+float64(now.Sub(l.last))/float64(l.interval))
+	}
+	l.last = now
+	if l.tokens < 1 {
+		delay := time.Duration((1 - l.tokens) * float64(l.interval))
+		timer := l.clock.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.Chan():
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		l.tokens = 1
+		l.last = now.Add(delay)
+	}
+	l.tokens--
+	return nil
+}
+
+func (b *batchCopIterator) recvFromRespCh(ctx context.Context) (resp *batchCopResponse, ok bool, exit bool) {
+	if b.req.KeepOrder {
+		return b.recvInKeyOrder(ctx)
+	}
+	return b.recvFrom(ctx, b.respChan)
+}
+
+// recvInKeyOrder merges the responses of the tasks by their start keys in the keep order mode, at most one response
+// of each outstanding task is held in mergeHeap. The responses of a task, including the ones of the tasks rebuilt
+// from it, never have a smaller start key than the task, so the smallest response is returned once no pending task
+// can precede it. The tasks not started yet are never waited for unless they're queued before the smallest
+// response, or the consumer would block the workers. The errors are returned as soon as they're received.
+func (b *batchCopIterator) recvInKeyOrder(ctx context.Context) (resp *batchCopResponse, ok bool, exit bool) {
+	if b.mergeHeap == nil {
+		b.mergeHeap = &batchCopMergeHeap{}
+		b.taskStartKeys = make([]kv.Key, 0, len(b.tasks))
+		for i, task := range b.tasks {
+			b.pendingTasks = append(b.pendingTasks, i)
+			b.taskStartKeys = append(b.taskStartKeys, task.startKey())
+		}
+	}
+	for i := 0; i < len(b.pendingTasks); {
+		idx := b.pendingTasks[i]
+		if !b.mayPrecedeMergeHead(idx) {
+			i++
+			continue
+		}
+		resp, ok, exit = b.recvFrom(ctx, b.tasks[idx].respChan)
+		if exit || (ok && resp.err != nil) {
+			return
+		}
+		b.pendingTasks = append(b.pendingTasks[:i], b.pendingTasks[i+1:]...)
+		if ok {
+			heap.Push(b.mergeHeap, &batchCopMergeItem{resp: resp, task: idx})
+		}
+	}
+	if b.mergeHeap.Len() == 0 {
+		// All the tasks are finished.
+		return b.recvFrom(ctx, b.respChan)
+	}
+	item := heap.Pop(b.mergeHeap).(*batchCopMergeItem)
+	pos := sort.SearchInts(b.pendingTasks, item.task)
+	b.pendingTasks = append(b.pendingTasks[:pos], append([]int{item.task}, b.pendingTasks[pos:]...)...)
+	return item.resp, true, false
+}
+
+// mayPrecedeMergeHead checks whether the next response of the pending task may precede the smallest response held
+// in mergeHeap, and the task can be waited for.
+func (b *batchCopIterator) mayPrecedeMergeHead(idx int) bool {
+	if b.mergeHeap.Len() == 0 {
+		return true
+	}
+	head := (*b.mergeHeap)[0]
+	if idx > head.task && atomic.LoadUint32(&b.tasks[idx].started) == 0 {
+		return false
+	}
+	cmp := bytes.Compare(b.taskStartKeys[idx], head.resp.startKey)
+	return cmp < 0 || (cmp == 0 && idx < head.task)
+}
+
+// recvFrom receives a response from the channel, the response is released once it's received.
+func (b *batchCopIterator) recvFrom(ctx context.Context, respChan <-chan *batchCopResponse) (resp *batchCopResponse, ok bool, exit bool) {
+	ticker := b.store.batchCopClock().NewTicker(3 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case resp, ok = <-respChan:
+			if ok {
+				b.releaseResp(resp)
+			}
+			return
+		case <-ticker.Chan():
+			if atomic.LoadUint32(b.vars.Killed) == 1 {
+				resp = &batchCopResponse{err: derr.ErrQueryInterrupted}
+				ok = true
+				return
+			}
+		case <-b.finishCh:
+			exit = true
+			return
+		case <-ctx.Done():
+			// We select the ctx.Done() in the thread of `Next` instead of in the worker to avoid the cost of `WithCancel`.
+			atomic.StoreUint32(&b.cancelled, 1)
+			if atomic.CompareAndSwapUint32(&b.closed, 0, 1) {
+				close(b.finishCh)
+			}
+			exit = true
+			return
+		}
+	}
+}
+
+type batchCopMergeItem struct {
+	resp *batchCopResponse
+	// task is the index of the task the response comes from.
+	task int
+}
+
+// batchCopMergeHeap is a min heap of the responses ordered by their start keys, the responses sharing a start key
+// are ordered by their tasks.
+type batchCopMergeHeap []*batchCopMergeItem
+
+func (h batchCopMergeHeap) Len() int {
+	return len(h)
+}
+
+func (h batchCopMergeHeap) Less(i, j int) bool {
+	if cmp := bytes.Compare(h[i].resp.startKey, h[j].resp.startKey); cmp != 0 {
+		return cmp < 0
+	}
+	return h[i].task < h[j].task
+}
+
+func (h batchCopMergeHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *batchCopMergeHeap) Push(x interface{}) {
+	*h = append(*h, x.(*batchCopMergeItem))
+}
+
+func (h *batchCopMergeHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
+
+// Close releases the resource.
+func (b *batchCopIterator) Close() error {
+	if grace := b.req.BatchCopCloseGracePeriod; grace > 0 && atomic.LoadUint32(&b.closed) == 0 {
+		// The work of an almost finished query is wasted if it's cancelled abruptly, so the tasks being sent are
+		// given the grace period to finish, but the queued ones are never sent.
+		atomic.StoreUint32(&b.draining, 1)
+		b.waitWorkers(grace)
+	}
+	if atomic.CompareAndSwapUint32(&b.closed, 0, 1) {
+		atomic.StoreUint32(&b.closedByConsumer, 1)
+		close(b.finishCh)
+		if b.req.BatchCopDrainLimit > 0 {
+			// The RPCs are cancelled after the streams are drained, or the drain receives nothing.
+			b.waitWorkers(batchCopDrainTimeout)
+		}
+	}
+	b.rpcCancel.CancelAll()
+	b.wg.Wait()
+	if reserved := atomic.SwapInt64(&b.memReserved, 0); reserved > 0 && b.memTracker != nil {
+		b.memTracker.Consume(-reserved)
+	}
+	// The responses left in respChan are never consumed.
+	b.releaseMemory(atomic.LoadInt64(&b.memConsumed))
+	if b.respBytes != nil {
+		b.respBytes.releaseAll()
+	}
+	b.summaryOnce.Do(b.logSummary)
+	return nil
+}
+
+func (b *batchCopIterator) isDraining() bool {
+	return atomic.LoadUint32(&b.draining) == 1
+}
+
+// waitWorkers waits for the workers to finish until the timeout, it returns whether they are finished.
+func (b *batchCopIterator) waitWorkers(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		b.wg.Wait()
+		close(done)
+	}()
+	timer := b.store.batchCopClock().NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.Chan():
+		return false
+	}
+}
+
+// logSummary logs the summary of the query when the iterator is closed.
+func (b *batchCopIterator) logSummary() {
+	regionNum := 0
+	stores := make(map[string]struct{}, len(b.tasks))
+	for _, task := range b.tasks {
+		regionNum += len(task.regionInfos)
+		stores[task.storeAddr] = struct{}{}
+	}
+	var totalBytes int64
+	b.storeBytesMu.Lock()
+	for addr, bytes := range b.storeBytesMu.bytes {
+		totalBytes += bytes
+		stores[addr] = struct{}{}
+	}
+	b.storeBytesMu.Unlock()
+	retries := 0
+	for _, count := range b.RetryReasons() {
+		retries += count
+	}
+	killed := b.vars != nil && b.vars.Killed != nil && atomic.LoadUint32(b.vars.Killed) == 1
+	fields := []zap.Field{
+		zap.Uint64("txnStartTS", b.req.StartTs),
+		zap.Int("task num", len(b.tasks)),
+		zap.Int("region num", regionNum),
+		zap.Int64("bytes", totalBytes),
+		zap.Int("retries", retries),
+		zap.Int("empty chunks", b.EmptyChunks()),
+		zap.Stringer("isolation level", b.IsolationLevel()),
+	}
+	// The start time is unknown if the iterator isn't started by startBatchCopIterator.
+	if !b.startTime.IsZero() {
+		fields = append(fields, zap.Duration("duration", b.store.batchCopClock().Since(b.startTime)))
+	}
+	fields = append(fields,
+		zap.Int("store num", len(stores)),
+		zap.Bool("killed", killed),
+		zap.Bool("cancelled", atomic.LoadUint32(&b.cancelled) == 1))
+	b.logger().Info("batch cop query summary", fields...)
+}
+
+func (b *batchCopIterator) handleTask(ctx context.Context, bo *Backoffer, task *batchCopTask) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		b.logger().Error("batchCopIterator meet panic",
+			zap.Reflect("r", r),
+			zap.Stack("stack trace"))
+		// The consumer would hang if the query isn't cancelled, since the task never finishes.
+		b.panicErr.Store(errors.Errorf("%v", r))
+		if atomic.CompareAndSwapUint32(&b.closed, 0, 1) {
+			close(b.finishCh)
+		}
+		if task.respChan != nil {
+			close(task.respChan)
+		}
+		b.wg.Done()
+	}()
+	tasks := []*batchCopTask{task}
+	// handled are the tasks whose streams end without error, the stale regions of them may be retried.
+	var handled []*batchCopTask
+	// The sender is shared by the task and the tasks it's rebuilt into, so their sends are counted together.
+	sender := NewRegionBatchRequestSender(b.store.GetRegionCache(), b.store.GetTiKVClient())
+	sender.onSendFail = b.recordUnreachableStore
+	sender.maxSendAttempts = b.req.BatchCopMaxSendAttempts
+	sender.metricSink = b.store.batchCopMetricSink()
+	if b.client != nil {
+		sender.addrValidator = b.client.AddrValidator
+	}
+	for idx := 0; idx < len(tasks); idx++ {
+		sleepBefore := bo.GetTotalSleep()
+		ret, err := b.handleTaskOnce(ctx, bo, sender, tasks[idx])
+		if err == nil {
+			handled = append(handled, tasks[idx])
+		}
+		b.recordStoreBackoff(tasks[idx].storeAddr, time.Duration(bo.GetTotalSleep()-sleepBefore)*time.Millisecond)
+		if b.isDraining() {
+			// The failed and rebuilt tasks are caused by the cancellation, they are neither reported nor retried.
+			break
+		}
+		if err != nil {
+			resp := &batchCopResponse{err: errors.Trace(b.withUnreachableStores(err)), detail: new(CopRuntimeStats)}
+			b.sendToTaskRespCh(task, resp)
+			break
+		}
+		for _, t := range ret {
+			t.respChan = task.respChan
+		}
+		if b.req.KeepOrder {
+			// The retried tasks take the place of the failed one, so the order of the keys is kept.
+			sortBatchCopTasksByKey(ret)
+			tasks = append(tasks[:idx+1], append(ret, tasks[idx+1:]...)...)
+			continue
+		}
+		tasks = append(tasks, ret...)
+		orderBatchCopTasks(tasks[idx+1:], TaskOrderPolicy(b.req.BatchCopTaskOrder))
+	}
+	failpoint.Inject("mockBatchCopTaskPanic", func(val failpoint.Value) {
+		if val.(bool) {
+			panic("mock batch cop task panic")
+		}
+	})
+	if b.req.BatchCopStoreKeyOrder {
+		b.sendInKeyOrder(handled)
+	}
+	if task.respChan != nil {
+		close(task.respChan)
+	}
+	b.wg.Done()
+}
+
+// sendInKeyOrder delivers the buffered responses of the tasks in the order of their region keys.
+func (b *batchCopIterator) sendInKeyOrder(tasks []*batchCopTask) {
+	sortBatchCopTasksByKey(tasks)
+	for _, task := range tasks {
+		startKey := task.startKey()
+		for _, resp := range task.buffered {
+			resp.startKey = startKey
+			if b.sendToTaskRespCh(task, resp) {
+				return
+			}
+		}
+		task.buffered = nil
+	}
+}
+
+// TaskOrderPolicy decides the order of the queued tasks handled by a worker, it's set by kv.Request.BatchCopTaskOrder.
+type TaskOrderPolicy string
+
+const (
+	// TaskOrderFIFO handles the tasks in the order they are queued.
+	TaskOrderFIFO TaskOrderPolicy = "fifo"
+	// TaskOrderSmallestFirst handles the tasks with fewer regions first.
+	TaskOrderSmallestFirst TaskOrderPolicy = "smallest-first"
+	// TaskOrderLargestFirst handles the tasks with more regions first.
+	TaskOrderLargestFirst TaskOrderPolicy = "largest-first"
+)
+
+// orderBatchCopTasks sorts the tasks by the policy, the tasks with the same number of regions keep their order.
+func orderBatchCopTasks(tasks []*batchCopTask, policy TaskOrderPolicy) {
+	switch policy {
+	case TaskOrderSmallestFirst:
+		sort.SliceStable(tasks, func(i, j int) bool {
+			return len(tasks[i].regionInfos) < len(tasks[j].regionInfos)
+		})
+	case TaskOrderLargestFirst:
+		sort.SliceStable(tasks, func(i, j int) bool {
+			return len(tasks[i].regionInfos) > len(tasks[j].regionInfos)
+		})
+	}
+}
+
+// coalesceKeyRanges sorts the ranges by the start key and coalesces the adjacent and overlapping ones.
+// An empty end key means the range is unbounded.
+func coalesceKeyRanges(ranges []kv.KeyRange) []kv.KeyRange {
+	if len(ranges) <= 1 {
+		return ranges
+	}
+	sorted := append(make([]kv.KeyRange, 0, len(ranges)), ranges...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i].StartKey, sorted[j].StartKey) < 0
+	})
+	coalesced := sorted[:1]
+	for _, ran := range sorted[1:] {
+		last := &coalesced[len(coalesced)-1]
+		if len(last.EndKey) == 0 {
+			continue
+		}
+		if bytes.Compare(ran.StartKey, last.EndKey) > 0 {
+			coalesced = append(coalesced, ran)
+			continue
+		}
+		if len(ran.EndKey) == 0 || bytes.Compare(ran.EndKey, last.EndKey) > 0 {
+			last.EndKey = ran.EndKey
+		}
+	}
+	return coalesced
+}
+
+// ErrBatchCopTooManyRebuilds is returned when the regions of a batch cop task keep failing after they are
+// rebuilt kv.Request.BatchCopMaxTaskRebuilds times.
+type ErrBatchCopTooManyRebuilds struct {
+	Rebuilds  int
+	RegionIDs []uint64
+	// StoreAddr is the address of the store the task is sent to last.
+	StoreAddr string
+}
+
+func (e *ErrBatchCopTooManyRebuilds) Error() string {
+	return fmt.Sprintf("batch cop task is rebuilt %d times, regions: %v, last store: %s", e.Rebuilds, e.RegionIDs, e.StoreAddr)
+}
+
+// Merge all ranges and request again.
+func (b *batchCopIterator) retryBatchCopTask(ctx context.Context, bo *backoff.Backoffer, batchTask *batchCopTask) ([]*batchCopTask, error) {
+	if maxRebuilds := b.req.BatchCopMaxTaskRebuilds; maxRebuilds > 0 && batchTask.rebuilds >= maxRebuilds {
+		return nil, errors.Trace(&ErrBatchCopTooManyRebuilds{
+			Rebuilds:  batchTask.rebuilds,
+			RegionIDs: regionIDsOf(batchTask),
+			StoreAddr: batchTask.storeAddr,
+		})
+	}
+	if err := b.recordRegionRetries(batchTask); err != nil {
+		return nil, errors.Trace(err)
+	}
+	var ranges []kv.KeyRange
+	for _, ri := range batchTask.regionInfos {
+		ri.Ranges.Do(func(ran *kv.KeyRange) {
 			ranges = append(ranges, *ran)
 		})
 	}
-	return buildBatchCopTasks(bo, b.store, NewKeyRanges(ranges), b.req.StoreType, nil, 0)
+	// The adjacent and overlapping ranges are coalesced, so the rebuilt tasks carry fewer ranges.
+	keyRanges := NewKeyRanges(coalesceKeyRanges(ranges))
+	tasks, err := buildBatchCopTasks(bo, b.store, b.store.GetRegionCache(), keyRanges, b.req.StoreType, nil, 0, b.retryReasons, buildOptionsOfRequest(b.req))
+	if err != nil {
+		return nil, err
+	}
+	if b.replicaPolicy != nil {
+		tasks = selectReplicas(tasks, b.replicaPolicy)
+	}
+	if tasks, err = b.client.applyBalanceHook(keyRanges, tasks, buildOptionsOfRequest(b.req)); err != nil {
+		return nil, err
+	}
+	for _, task := range tasks {
+		task.rebuilds = batchTask.rebuilds + 1
+	}
+	return tasks, nil
 }
 
 const readTimeoutUltraLong = 3600 * time.Second // For requests that may scan many regions for tiflash.
 
-func (b *batchCopIterator) handleTaskOnce(ctx context.Context, bo *backoff.Backoffer, task *batchCopTask) ([]*batchCopTask, error) {
-	sender := NewRegionBatchRequestSender(b.store.GetRegionCache(), b.store.GetTiKVClient())
+// batchCopReadTimeout returns the read timeout of the batch cop streams. A short timeout makes the tasks
+// on a dead store retried sooner.
+func batchCopReadTimeout(req *kv.Request) time.Duration {
+	if req.TiFlashMaxExecutionTime > 0 {
+		return req.TiFlashMaxExecutionTime
+	}
+	return readTimeoutUltraLong
+}
+
+func (b *batchCopIterator) handleTaskOnce(ctx context.Context, bo *backoff.Backoffer, sender *RegionBatchRequestSender, task *batchCopTask) ([]*batchCopTask, error) {
 	var regionInfos = make([]*coprocessor.RegionInfo, 0, len(task.regionInfos))
 	for _, ri := range task.regionInfos {
 		regionInfos = append(regionInfos, &coprocessor.RegionInfo{
@@ -588,11 +2080,28 @@ func (b *batchCopIterator) handleTaskOnce(ctx context.Context, bo *backoff.Backo
 		ResourceGroupTag: b.req.ResourceGroupTag,
 	})
 	req.StoreTp = tikvrpc.TiFlash
+	atomic.StoreInt32(&b.isolationLevel, int32(req.Context.IsolationLevel))
 
-	logutil.BgLogger().Debug("send batch request to ", zap.String("req info", req.String()), zap.Int("cop task len", len(task.regionInfos)))
-	resp, retry, cancel, err := sender.SendReqToAddr(bo, task.ctx, task.regionInfos, req, readTimeoutUltraLong)
+	logSendBatchRequest(b.logger(), req, task)
+	if b.client != nil && b.client.AuditHook != nil {
+		b.client.AuditHook(newBatchCopAuditRecord(&copReq, task))
+	}
+	if routedToNonPreferredStore(task) {
+		b.store.batchCopMetricSink().IncNonPreferredStore(b.metricLabel)
+	}
+	start := b.store.batchCopClock().Now()
+	resp, retry, cancel, err := sender.SendReqToAddr(bo, task.ctx, task.regionInfos, req, batchCopReadTimeout(b.req))
+	b.store.batchCopMetricSink().ObserveSend(b.metricLabel, b.store.batchCopClock().Since(start))
 	// If there are store errors, we should retry for all regions.
 	if retry {
+		if err = b.recordReplicaFailure(task); err != nil {
+			return nil, errors.Trace(err)
+		}
+		b.retryReasons.record(retryReasonStoreError)
+		b.store.batchCopMetricSink().IncRetry(b.metricLabel, task.storeAddr, sendFailType(sender.GetRPCError()))
+		if b.replicaPolicy != nil && task.ctx.Store != nil {
+			b.replicaPolicy.OnFail(task.ctx.Store.StoreID())
+		}
 		return b.retryBatchCopTask(ctx, bo, task)
 	}
 	if err != nil {
@@ -600,7 +2109,61 @@ func (b *batchCopIterator) handleTaskOnce(ctx context.Context, bo *backoff.Backo
 		return nil, errors.Trace(err)
 	}
 	defer cancel()
-	return nil, b.handleStreamedBatchCopResponse(ctx, bo, resp.Resp.(*tikvrpc.BatchCopStreamResponse), task)
+	task.storeID = sender.StoreID()
+	atomic.AddInt64(&b.streamsOpened, 1)
+	if err = b.handleStreamedBatchCopResponse(ctx, bo, resp.Resp.(*tikvrpc.BatchCopStreamResponse), task); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(task.retryRegions) > 0 {
+		// The other regions are finished, so only the stale ones are rebuilt.
+		return b.retryBatchCopTask(ctx, bo, task.retryRegionsOf())
+	}
+	return nil, nil
+}
+
+// routedToNonPreferredStore checks whether the task is sent to a store which is not the first choice of
+// some of its regions, the first store in AllStores is the one the region cache prefers.
+func routedToNonPreferredStore(task *batchCopTask) bool {
+	if task.ctx == nil || task.ctx.Store == nil {
+		return false
+	}
+	storeID := task.ctx.Store.StoreID()
+	for _, ri := range task.regionInfos {
+		if len(ri.AllStores) > 0 && ri.AllStores[0] != storeID {
+			return true
+		}
+	}
+	return false
+}
+
+// BatchCopAuditRecord is the redacted view of a batch cop request sent to TiFlash.
+type BatchCopAuditRecord struct {
+	StoreAddr string
+	RegionIDs []uint64
+	StartTs   uint64
+	SchemaVer int64
+	// DataHash is the hex encoded SHA-256 hash of the request data, the data itself is never exposed.
+	DataHash string
+}
+
+func newBatchCopAuditRecord(req *coprocessor.BatchRequest, task *batchCopTask) *BatchCopAuditRecord {
+	dataHash := sha256.Sum256(req.Data)
+	return &BatchCopAuditRecord{
+		StoreAddr: task.storeAddr,
+		RegionIDs: regionIDsOf(task),
+		StartTs:   req.StartTs,
+		SchemaVer: req.SchemaVer,
+		DataHash:  hex.EncodeToString(dataHash[:]),
+	}
+}
+
+// logSendBatchRequest logs the request at debug level. `req.String()` is expensive, so it is
+// only computed when the debug log is enabled.
+func logSendBatchRequest(logger *zap.Logger, req *tikvrpc.Request, task *batchCopTask) {
+	if log.GetLevel() > zap.DebugLevel {
+		return
+	}
+	logger.Debug("send batch request to ", zap.String("req info", req.String()), zap.Int("cop task len", len(task.regionInfos)))
 }
 
 func (b *batchCopIterator) handleStreamedBatchCopResponse(ctx context.Context, bo *Backoffer, response *tikvrpc.BatchCopStreamResponse, task *batchCopTask) (err error) {
@@ -608,6 +2171,7 @@ func (b *batchCopIterator) handleStreamedBatchCopResponse(ctx context.Context, b
 	resp := response.BatchResponse
 	if resp == nil {
 		// streaming request returns io.EOF, so the first Response is nil.
+		b.recordEmptyRanges(task)
 		return
 	}
 	for {
@@ -615,31 +2179,109 @@ func (b *batchCopIterator) handleStreamedBatchCopResponse(ctx context.Context, b
 		if err != nil {
 			return errors.Trace(err)
 		}
+		if b.isFinished() {
+			if atomic.LoadUint32(&b.closedByConsumer) == 1 {
+				b.drainStream(response)
+			}
+			return nil
+		}
+		// The stream is received with the context of the backoffer, once it's done the result of Recv is
+		// ambiguous, so exit explicitly.
+		if ctxErr := bo.GetCtx().Err(); ctxErr != nil {
+			return errors.Annotatef(ctxErr, "receive batch cop stream from store %s", task.storeAddr)
+		}
 		resp, err = response.Recv()
 		if err != nil {
 			if errors.Cause(err) == io.EOF {
+				if !task.hasData && len(task.retryRegions) == 0 {
+					b.recordEmptyRanges(task)
+				}
 				return nil
 			}
 
+			b.retryReasons.record(retryReasonStreamError)
 			if err1 := bo.Backoff(tikv.BoTiKVRPC(), errors.Errorf("recv stream response error: %v, task store addr: %s", err, task.storeAddr)); err1 != nil {
 				return errors.Trace(err)
 			}
 
 			// No coprocessor.Response for network error, rebuild task based on the last success one.
 			if errors.Cause(err) == context.Canceled {
-				logutil.BgLogger().Info("stream recv timeout", zap.Error(err))
+				b.logger().Info("stream recv timeout", zap.Error(err))
 			} else {
-				logutil.BgLogger().Info("stream unknown error", zap.Error(err))
+				b.logger().Info("stream unknown error", zap.Error(err))
 			}
 			return derr.ErrTiFlashServerTimeout
 		}
 	}
 }
 
+// checkBackoffSoftCap warns if the total sleep of the backoffer exceeds kv.Request.BatchCopBackoffSoftCap, so the
+// queries which are slow but don't fail can be noticed. The warning is logged at most once for a query.
+func (b *batchCopIterator) checkBackoffSoftCap(bo *Backoffer, task *batchCopTask) {
+	softCap := b.req.BatchCopBackoffSoftCap
+	if softCap <= 0 {
+		return
+	}
+	sleep := time.Duration(bo.GetTotalSleep()) * time.Millisecond
+	if sleep <= softCap || !atomic.CompareAndSwapUint32(&b.backoffWarned, 0, 1) {
+		return
+	}
+	b.store.batchCopMetricSink().IncBackoffSoftCap(b.metricLabel)
+	b.logger().Warn("batch cop backoff exceeds the soft cap",
+		zap.Uint64("txnStartTS", b.req.StartTs),
+		zap.String("storeAddr", task.storeAddr),
+		zap.Duration("backoff", sleep),
+		zap.Duration("soft cap", softCap),
+		zap.Any("backoff times", bo.GetBackoffTimes()))
+}
+
+// batchCopDrainTimeout bounds the time Close waits for the streams to be drained before cancelling the RPCs.
+const batchCopDrainTimeout = time.Second
+
+func (b *batchCopIterator) isFinished() bool {
+	select {
+	case <-b.finishCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// drainStream receives at most kv.Request.BatchCopDrainLimit chunks from the stream and discards them.
+func (b *batchCopIterator) drainStream(response *tikvrpc.BatchCopStreamResponse) (drained int) {
+	for ; drained < b.req.BatchCopDrainLimit; drained++ {
+		if _, err := response.Recv(); err != nil {
+			break
+		}
+	}
+	return
+}
+
+// fillBatchCopExecDetails fills the time and scan details reported by TiFlash, the older versions of TiFlash
+// leave them nil.
+func fillBatchCopExecDetails(detail *CopRuntimeStats, pbDetails *kvrpcpb.ExecDetails) {
+	sd := &util.ScanDetail{}
+	td := util.TimeDetail{}
+	if pbDetails != nil {
+		if timeDetail := pbDetails.TimeDetail; timeDetail != nil {
+			td.MergeFromTimeDetail(timeDetail)
+			// TiFlash doesn't report the CPU time alone, the process wall time is very close to it.
+			detail.TiFlashCPUTime = time.Duration(timeDetail.ProcessWallTimeMs) * time.Millisecond
+		}
+		if scanDetail := pbDetails.ScanDetail; scanDetail != nil && scanDetail.Write != nil {
+			sd.ProcessedKeys = scanDetail.Write.Processed
+			sd.TotalKeys = scanDetail.Write.Total
+		}
+	}
+	detail.ScanDetail = sd
+	detail.TimeDetail = td
+}
+
 func (b *batchCopIterator) handleBatchCopResponse(bo *Backoffer, response *coprocessor.BatchResponse, task *batchCopTask) (err error) {
+	start := b.store.batchCopClock().Now()
 	if otherErr := response.GetOtherError(); otherErr != "" {
 		err = errors.Errorf("other error: %s", otherErr)
-		logutil.BgLogger().Warn("other error",
+		b.logger().Warn("other error",
 			zap.Uint64("txnStartTS", b.req.StartTs),
 			zap.String("storeAddr", task.storeAddr),
 			zap.Error(err))
@@ -647,22 +2289,40 @@ func (b *batchCopIterator) handleBatchCopResponse(bo *Backoffer, response *copro
 	}
 
 	if len(response.RetryRegions) > 0 {
-		logutil.BgLogger().Info("multiple regions are stale and need to be refreshed", zap.Int("region size", len(response.RetryRegions)))
+		b.logger().Info("multiple regions are stale and need to be refreshed", zap.Int("region size", len(response.RetryRegions)))
+		if task.retryRegions == nil {
+			task.retryRegions = make(map[uint64]struct{}, len(response.RetryRegions))
+		}
+		for _, retry := range response.RetryRegions {
+			task.retryRegions[retry.Id] = struct{}{}
+		}
 		for idx, retry := range response.RetryRegions {
 			id := tikv.NewRegionVerID(retry.Id, retry.RegionEpoch.ConfVer, retry.RegionEpoch.Version)
-			logutil.BgLogger().Info("invalid region because tiflash detected stale region", zap.String("region id", id.String()))
+			b.logger().Info("invalid region because tiflash detected stale region", zap.String("region id", id.String()))
 			b.store.GetRegionCache().InvalidateCachedRegionWithReason(id, tikv.EpochNotMatch)
 			if idx >= 10 {
-				logutil.BgLogger().Info("stale regions are too many, so we omit the rest ones")
+				b.logger().Info("stale regions are too many, so we omit the rest ones")
 				break
 			}
 		}
 		return
 	}
 
+	if task.regionIDs == nil {
+		task.regionIDs = regionIDsOf(task)
+	}
 	resp := batchCopResponse{
-		pbResp: response,
-		detail: new(CopRuntimeStats),
+		pbResp:    response,
+		detail:    new(CopRuntimeStats),
+		regionIDs: task.regionIDs,
+	}
+	if b.req.KeepOrder {
+		// TiFlash doesn't report which regions a response comes from, so the responses are merged by the start
+		// key of the task.
+		resp.startKey = task.startKey()
+	}
+	if len(task.regionIDs) == 1 {
+		resp.regionBytes = map[uint64]int64{task.regionIDs[0]: int64(len(response.Data))}
 	}
 
 	backoffTimes := bo.GetBackoffTimes()
@@ -674,17 +2334,227 @@ func (b *batchCopIterator) handleBatchCopResponse(bo *Backoffer, response *copro
 		resp.detail.BackoffSleep[backoff] = time.Duration(bo.GetBackoffSleepMS()[backoff]) * time.Millisecond
 	}
 	resp.detail.CalleeAddress = task.storeAddr
+	resp.detail.CalleeStoreID = task.storeID
+	b.checkBackoffSoftCap(bo, task)
+	fillBatchCopExecDetails(resp.detail, response.GetExecDetails())
+	atomic.AddInt64(&b.tiflashCPUNs, int64(resp.detail.TiFlashCPUTime))
 
-	b.sendToRespCh(&resp)
+	b.store.batchCopMetricSink().AddResponseBytes(b.metricLabel, resp.MemSize())
+	if err = b.recordStoreBytes(task.storeAddr, int64(response.Size())); err != nil {
+		return errors.Trace(err)
+	}
+	resp.handleTime = b.store.batchCopClock().Since(start)
+	atomic.AddInt64(&b.handleTimeNs, int64(resp.handleTime))
+	if len(response.Data) > 0 {
+		task.hasData = true
+	} else {
+		atomic.AddInt64(&b.emptyChunks, 1)
+		if b.req.BatchCopSkipEmptyChunks {
+			return
+		}
+	}
+	if b.req.BatchCopStoreKeyOrder {
+		task.buffered = append(task.buffered, &resp)
+		return
+	}
+	b.sendToTaskRespCh(task, &resp)
 
 	return
 }
 
+// DuplicateStartKeyPolicy decides how the responses of different batch cop tasks sharing a start key are handled.
+// The tasks never share a start key unless there is a bug, but the consumers deduplicating the responses by their
+// start keys are confused by it. It's set by kv.Request.BatchCopDuplicateStartKey.
+type DuplicateStartKeyPolicy string
+
+const (
+	// DuplicateStartKeyIgnore doesn't check the start keys of the responses.
+	DuplicateStartKeyIgnore DuplicateStartKeyPolicy = "ignore"
+	// DuplicateStartKeyLog logs a warning for the duplicate start keys and delivers the responses as usual.
+	DuplicateStartKeyLog DuplicateStartKeyPolicy = "log"
+	// DuplicateStartKeyError fails the request with ErrBatchCopDuplicateStartKey.
+	DuplicateStartKeyError DuplicateStartKeyPolicy = "error"
+)
+
+// ErrBatchCopDuplicateStartKey is returned when the responses of different batch cop tasks share a start key.
+type ErrBatchCopDuplicateStartKey struct {
+	StartKey kv.Key
+	// StoreAddrs are the stores of the task delivering the key first and the one delivering it again.
+	StoreAddrs []string
+}
+
+func (e *ErrBatchCopDuplicateStartKey) Error() string {
+	return fmt.Sprintf("start key %s of the batch cop responses is duplicated, stores: %v", e.StartKey, e.StoreAddrs)
+}
+
+// checkDuplicateStartKey checks whether the non-empty start key of the response has been delivered by another task,
+// the responses of the same task share the start key when they are delivered in the key order.
+func (b *batchCopIterator) checkDuplicateStartKey(task *batchCopTask, resp *batchCopResponse) error {
+	policy := DuplicateStartKeyPolicy(b.req.BatchCopDuplicateStartKey)
+	if (policy != DuplicateStartKeyLog && policy != DuplicateStartKeyError) || len(resp.startKey) == 0 {
+		return nil
+	}
+	b.startKeysMu.Lock()
+	defer b.startKeysMu.Unlock()
+	owner, ok := b.startKeyOwners[string(resp.startKey)]
+	if !ok {
+		if b.startKeyOwners == nil {
+			b.startKeyOwners = make(map[string]*batchCopTask)
+		}
+		b.startKeyOwners[string(resp.startKey)] = task
+		return nil
+	}
+	if owner == task {
+		return nil
+	}
+	err := &ErrBatchCopDuplicateStartKey{StartKey: resp.startKey, StoreAddrs: []string{storeAddrOf(owner), storeAddrOf(task)}}
+	b.logger().Warn("duplicate start key of batch cop responses",
+		zap.Uint64("txnStartTS", b.req.StartTs),
+		zap.Stringer("startKey", resp.startKey),
+		zap.Strings("storeAddrs", err.StoreAddrs))
+	if policy == DuplicateStartKeyError {
+		return err
+	}
+	return nil
+}
+
+func storeAddrOf(task *batchCopTask) string {
+	if task == nil {
+		return ""
+	}
+	return task.storeAddr
+}
+
 func (b *batchCopIterator) sendToRespCh(resp *batchCopResponse) (exit bool) {
+	return b.sendToTaskRespCh(nil, resp)
+}
+
+// sendToTaskRespCh sends the response to the respChan of the task, or the respChan of the iterator if the task
+// doesn't have one.
+func (b *batchCopIterator) sendToTaskRespCh(task *batchCopTask, resp *batchCopResponse) (exit bool) {
+	respChan := b.respChan
+	if task != nil && task.respChan != nil {
+		respChan = task.respChan
+	}
+	if err := b.checkDuplicateStartKey(task, resp); err != nil {
+		resp = &batchCopResponse{err: errors.Trace(err), detail: new(CopRuntimeStats)}
+	}
+	if b.respBytes != nil && !b.respBytes.acquire(resp.MemSize(), b.finishCh) {
+		return true
+	}
+	if b.consumeMemory(resp.MemSize()) != nil {
+		return true
+	}
 	select {
-	case b.respChan <- resp:
+	case respChan <- resp:
 	case <-b.finishCh:
 		exit = true
 	}
 	return
 }
+
+// consumeMemory consumes the memory of a response from memTracker. If the quota is exceeded and the oom action
+// is to cancel, the query is cancelled by closing finishCh and the error is returned by Next.
+func (b *batchCopIterator) consumeMemory(bytes int64) (err error) {
+	if b.memTracker == nil {
+		return nil
+	}
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		if msg, ok := r.(string); !ok || !strings.HasPrefix(msg, memory.PanicMemoryExceed) {
+			panic(r)
+		}
+		err = errors.New(r.(string))
+		b.oomErr.Store(err)
+		if atomic.CompareAndSwapUint32(&b.closed, 0, 1) {
+			close(b.finishCh)
+		}
+	}()
+	// The bytes are consumed even if the action panics.
+	atomic.AddInt64(&b.memConsumed, bytes)
+	b.memTracker.Consume(bytes)
+	return nil
+}
+
+// releaseResp releases the memory and the bytes of a received response.
+func (b *batchCopIterator) releaseResp(resp *batchCopResponse) {
+	b.releaseMemory(resp.MemSize())
+	if b.respBytes != nil {
+		b.respBytes.release(resp.MemSize())
+	}
+}
+
+// releaseMemory releases at most the consumed memory, so the responses drained after a panic
+// are not released twice when Close releases the leftovers concurrently.
+func (b *batchCopIterator) releaseMemory(bytes int64) {
+	if b.memTracker == nil {
+		return
+	}
+	for {
+		consumed := atomic.LoadInt64(&b.memConsumed)
+		if bytes > consumed {
+			bytes = consumed
+		}
+		if bytes <= 0 {
+			return
+		}
+		if atomic.CompareAndSwapInt64(&b.memConsumed, consumed, consumed-bytes) {
+			break
+		}
+	}
+	b.memTracker.Consume(-bytes)
+}
+
+// respBytesLimiter bounds the total bytes of the buffered responses. A response larger than the limit
+// is still accepted when nothing is buffered, otherwise the producer would be blocked forever.
+type respBytesLimiter struct {
+	limit int64
+
+	mu   sync.Mutex
+	used int64
+	// released is closed and renewed whenever some bytes are released.
+	released chan struct{}
+}
+
+func newRespBytesLimiter(limit int64) *respBytesLimiter {
+	return &respBytesLimiter{limit: limit, released: make(chan struct{})}
+}
+
+// acquire blocks until there is enough room for the bytes, it returns false if finishCh is closed before that.
+func (l *respBytesLimiter) acquire(bytes int64, finishCh <-chan struct{}) bool {
+	for {
+		l.mu.Lock()
+		if l.used == 0 || l.used+bytes <= l.limit {
+			l.used += bytes
+			l.mu.Unlock()
+			return true
+		}
+		released := l.released
+		l.mu.Unlock()
+		select {
+		case <-released:
+		case <-finishCh:
+			return false
+		}
+	}
+}
+
+func (l *respBytesLimiter) release(bytes int64) {
+	l.mu.Lock()
+	l.used -= bytes
+	close(l.released)
+	l.released = make(chan struct{})
+	l.mu.Unlock()
+}
+
+func (l *respBytesLimiter) releaseAll() {
+	l.mu.Lock()
+	used := l.used
+	l.mu.Unlock()
+	if used > 0 {
+		l.release(used)
+	}
+}
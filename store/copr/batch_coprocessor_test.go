@@ -0,0 +1,2525 @@
+// Copyright 2021 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package copr
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/failpoint"
+	"github.com/pingcap/kvproto/pkg/coprocessor"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tidb/kv"
+	tidbmetrics "github.com/pingcap/tidb/metrics"
+	"github.com/pingcap/tidb/store/driver/backoff"
+	derr "github.com/pingcap/tidb/store/driver/error"
+	"github.com/pingcap/tidb/util/logutil"
+	"github.com/pingcap/tidb/util/memory"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+	"github.com/tikv/client-go/v2/testutils"
+	"github.com/tikv/client-go/v2/tikv"
+	"github.com/tikv/client-go/v2/tikvrpc"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// mockBatchCopStream mocks the stream client of a batch cop request.
+type mockBatchCopStream struct {
+	grpc.ClientStream
+	resps []*coprocessor.BatchResponse
+	err   error
+	// received is the number of Recv calls which return a response.
+	received int32
+}
+
+func (s *mockBatchCopStream) Recv() (*coprocessor.BatchResponse, error) {
+	if len(s.resps) == 0 {
+		if s.err != nil {
+			return nil, s.err
+		}
+		return nil, io.EOF
+	}
+	resp := s.resps[0]
+	s.resps = s.resps[1:]
+	atomic.AddInt32(&s.received, 1)
+	return resp, nil
+}
+
+func newBatchCopStreamResponse(resps ...*coprocessor.BatchResponse) *tikvrpc.Response {
+	stream := &mockBatchCopStream{}
+	var first *coprocessor.BatchResponse
+	if len(resps) > 0 {
+		first = resps[0]
+		stream.resps = resps[1:]
+	}
+	return &tikvrpc.Response{Resp: &tikvrpc.BatchCopStreamResponse{
+		Tikv_BatchCoprocessorClient: stream,
+		BatchResponse:               first,
+	}}
+}
+
+// mockBatchCopClient hijacks the tikv client and handles requests by the handler.
+type mockBatchCopClient struct {
+	tikv.Client
+	sync.Mutex
+	handler func(addr string, req *tikvrpc.Request) (*tikvrpc.Response, error)
+	// lastTimeout is the timeout of the last request.
+	lastTimeout time.Duration
+}
+
+func (c *mockBatchCopClient) SendRequest(ctx context.Context, addr string, req *tikvrpc.Request, timeout time.Duration) (*tikvrpc.Response, error) {
+	c.Lock()
+	handler := c.handler
+	c.lastTimeout = timeout
+	c.Unlock()
+	return handler(addr, req)
+}
+
+func (c *mockBatchCopClient) setHandler(handler func(addr string, req *tikvrpc.Request) (*tikvrpc.Response, error)) {
+	c.Lock()
+	c.handler = handler
+	c.Unlock()
+}
+
+type batchCopTestCluster struct {
+	cluster         *testutils.MockCluster
+	store           *Store
+	client          *mockBatchCopClient
+	regionIDs       []uint64
+	tikvStoreID     uint64
+	tiflashStoreIDs []uint64
+	close           func()
+}
+
+// newBatchCopTestCluster creates a mock cluster whose regions are split by splitKeys,
+// and every region has a peer on each of the tiflashNum TiFlash stores.
+func newBatchCopTestCluster(t *testing.T, tiflashNum int, splitKeys ...string) *batchCopTestCluster {
+	mockClient, cluster, pdClient, err := testutils.NewMockTiKV("", nil)
+	require.NoError(t, err)
+	keys := make([][]byte, 0, len(splitKeys))
+	for _, key := range splitKeys {
+		keys = append(keys, []byte(key))
+	}
+	tikvStoreID, regionIDs, _ := testutils.BootstrapWithMultiRegions(cluster, keys...)
+	c := &batchCopTestCluster{
+		cluster:     cluster,
+		regionIDs:   regionIDs,
+		tikvStoreID: tikvStoreID,
+		client:      &mockBatchCopClient{},
+	}
+	for i := 0; i < tiflashNum; i++ {
+		storeID := cluster.AllocID()
+		cluster.AddStore(storeID, fmt.Sprintf("tiflash%d", i), &metapb.StoreLabel{Key: "engine", Value: "tiflash"})
+		for _, regionID := range regionIDs {
+			cluster.AddPeer(regionID, storeID, cluster.AllocID())
+		}
+		c.tiflashStoreIDs = append(c.tiflashStoreIDs, storeID)
+	}
+	c.client.Client = mockClient
+	c.client.handler = func(addr string, req *tikvrpc.Request) (*tikvrpc.Response, error) {
+		return newBatchCopStreamResponse(&coprocessor.BatchResponse{Data: []byte(addr)}), nil
+	}
+	kvStore, err := tikv.NewTestTiKVStore(mockClient, pdClient, func(tikv.Client) tikv.Client { return c.client }, nil, 0)
+	require.NoError(t, err)
+	c.store, err = NewStore(kvStore, nil)
+	require.NoError(t, err)
+	c.close = func() {
+		c.store.Close()
+		require.NoError(t, kvStore.Close())
+	}
+	return c
+}
+
+func (c *batchCopTestCluster) sendBatch(req *kv.Request) kv.Response {
+	return c.sendBatchByClient(c.store.GetClient().(*CopClient), req)
+}
+
+// sendBatchPerRegion sends the request with each region in its own task.
+func (c *batchCopTestCluster) sendBatchPerRegion(req *kv.Request) kv.Response {
+	client := c.store.GetClient().(*CopClient)
+	client.BalanceHook = splitBatchCopTasksByRegion
+	return c.sendBatchByClient(client, req)
+}
+
+func (c *batchCopTestCluster) sendBatchByClient(client *CopClient, req *kv.Request) kv.Response {
+	var killed uint32
+	req.StoreType = kv.TiFlash
+	req.BatchCop = true
+	return client.Send(context.Background(), req, kv.NewVariables(&killed), nil, false)
+}
+
+// splitBatchCopTasksByRegion splits the tasks to make each one hold a single region.
+func splitBatchCopTasksByRegion(tasks []*batchCopTask) []*batchCopTask {
+	splitTasks := make([]*batchCopTask, 0, len(tasks))
+	for _, task := range tasks {
+		for _, ri := range task.regionInfos {
+			splitTasks = append(splitTasks, &batchCopTask{
+				storeAddr:   task.storeAddr,
+				cmdType:     task.cmdType,
+				ctx:         task.ctx,
+				regionInfos: []RegionInfo{ri},
+				respChan:    task.respChan,
+				rebuilds:    task.rebuilds,
+			})
+		}
+	}
+	return splitTasks
+}
+
+func readAllBatchCopResponses(t *testing.T, resp kv.Response) ([]*batchCopResponse, error) {
+	var resps []*batchCopResponse
+	for {
+		subset, err := resp.Next(context.Background())
+		if err != nil {
+			return resps, err
+		}
+		if subset == nil {
+			return resps, nil
+		}
+		resps = append(resps, subset.(*batchCopResponse))
+	}
+}
+
+func BenchmarkLogSendBatchRequest(b *testing.B) {
+	task := &batchCopTask{}
+	regionInfos := make([]*coprocessor.RegionInfo, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		task.regionInfos = append(task.regionInfos, RegionInfo{Region: tikv.NewRegionVerID(uint64(i), 1, 1)})
+		regionInfos = append(regionInfos, &coprocessor.RegionInfo{
+			RegionId:    uint64(i),
+			RegionEpoch: &metapb.RegionEpoch{ConfVer: 1, Version: 1},
+			Ranges:      []*coprocessor.KeyRange{{Start: []byte("a"), End: []byte("z")}},
+		})
+	}
+	req := tikvrpc.NewRequest(tikvrpc.CmdBatchCop, &coprocessor.BatchRequest{Regions: regionInfos}, kvrpcpb.Context{})
+
+	level := log.GetLevel()
+	log.SetLevel(zap.InfoLevel)
+	defer log.SetLevel(level)
+	b.Run("guarded", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			logSendBatchRequest(logutil.BgLogger(), req, task)
+		}
+	})
+	b.Run("unguarded", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			log.Debug("send batch request to ", zap.String("req info", req.String()), zap.Int("cop task len", len(task.regionInfos)))
+		}
+	})
+}
+
+func TestBatchCopMetricLabel(t *testing.T) {
+	SetBatchCopMetricLabels([]string{"tenant-720"})
+	defer SetBatchCopMetricLabels(nil)
+	require.Equal(t, "", batchCopMetricLabel(""))
+	require.Equal(t, "tenant-720", batchCopMetricLabel("tenant-720"))
+	require.Equal(t, labelOther, batchCopMetricLabel("unknown"))
+
+	c := newBatchCopTestCluster(t, 1)
+	defer c.close()
+	resp := c.sendBatch(&kv.Request{KeyRanges: buildKeyRanges("a", "z"), MetricLabel: "tenant-720"})
+	_, err := readAllBatchCopResponses(t, resp)
+	require.NoError(t, err)
+	require.NoError(t, resp.Close())
+	require.Greater(t, testutil.ToFloat64(tidbmetrics.BatchCopResponseBytesCounter.WithLabelValues("tenant-720")), float64(0))
+}
+
+func TestBatchCopDrainOnClose(t *testing.T) {
+	t.Parallel()
+	c := newBatchCopTestCluster(t, 1)
+	defer c.close()
+
+	var (
+		mu     sync.Mutex
+		stream *mockBatchCopStream
+	)
+	c.client.setHandler(func(addr string, req *tikvrpc.Request) (*tikvrpc.Response, error) {
+		chunks := make([]*coprocessor.BatchResponse, 0, 10)
+		for i := 0; i < 10; i++ {
+			chunks = append(chunks, &coprocessor.BatchResponse{Data: []byte{byte(i)}})
+		}
+		resp := newBatchCopStreamResponse(chunks...)
+		mu.Lock()
+		defer mu.Unlock()
+		stream = resp.Resp.(*tikvrpc.BatchCopStreamResponse).Tikv_BatchCoprocessorClient.(*mockBatchCopStream)
+		return resp, nil
+	})
+	// send returns the stream once the worker is blocked by the full respChan, after the first chunk is
+	// buffered and the second one is received.
+	send := func() (kv.Response, *mockBatchCopStream) {
+		resp := c.sendBatch(&kv.Request{KeyRanges: buildKeyRanges("a", "z"), BatchCopRespChanSize: 1, BatchCopDrainLimit: 3})
+		require.Eventually(t, func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return stream != nil && atomic.LoadInt32(&stream.received) == 1
+		}, 5*time.Second, time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		s := stream
+		stream = nil
+		return resp, s
+	}
+
+	resp, s := send()
+	require.NoError(t, resp.Close())
+	// 3 chunks are drained after the iterator is closed.
+	require.Equal(t, int32(4), s.received)
+	require.Len(t, s.resps, 5)
+
+	// The stream is not drained if finishCh is closed for other reasons, e.g. the query is cancelled.
+	chunks := make([]*coprocessor.BatchResponse, 0, 10)
+	for i := 0; i < 10; i++ {
+		chunks = append(chunks, &coprocessor.BatchResponse{Data: []byte{byte(i)}})
+	}
+	it := &batchCopIterator{
+		req:      &kv.Request{BatchCopDrainLimit: 3},
+		finishCh: make(chan struct{}),
+		respChan: make(chan *batchCopResponse, 10),
+	}
+	close(it.finishCh)
+	bo := backoff.NewBackofferWithVars(context.Background(), 1000, nil)
+	streamResp := newBatchCopStreamResponse(chunks...).Resp.(*tikvrpc.BatchCopStreamResponse)
+	require.NoError(t, it.handleStreamedBatchCopResponse(context.Background(), bo, streamResp, &batchCopTask{}))
+	require.Len(t, streamResp.Tikv_BatchCoprocessorClient.(*mockBatchCopStream).resps, 9)
+}
+
+func TestBatchCopAttachTopology(t *testing.T) {
+	t.Parallel()
+	c := newBatchCopTestCluster(t, 1, "m")
+	defer c.close()
+	c.client.setHandler(func(addr string, req *tikvrpc.Request) (*tikvrpc.Response, error) {
+		return newBatchCopStreamResponse(&coprocessor.BatchResponse{Data: []byte("1")}, &coprocessor.BatchResponse{Data: []byte("2")}), nil
+	})
+
+	resp := c.sendBatch(&kv.Request{KeyRanges: buildKeyRanges("a", "z"), AttachTopology: true})
+	resps, err := readAllBatchCopResponses(t, resp)
+	require.NoError(t, err)
+	require.NoError(t, resp.Close())
+	require.Len(t, resps, 2)
+	require.Equal(t, &BatchCopTopology{Stores: []StoreTopology{{Addr: "tiflash0", RegionNum: 2}}}, resps[0].GetTopology())
+	require.Nil(t, resps[1].GetTopology())
+}
+
+func TestBatchCopMaxRegions(t *testing.T) {
+	t.Parallel()
+	c := newBatchCopTestCluster(t, 1, "g", "n")
+	defer c.close()
+
+	resp := c.sendBatch(&kv.Request{KeyRanges: buildKeyRanges("a", "m"), BatchCopMaxRegions: 2})
+	_, err := readAllBatchCopResponses(t, resp)
+	require.NoError(t, err)
+	require.NoError(t, resp.Close())
+
+	resp = c.sendBatch(&kv.Request{KeyRanges: buildKeyRanges("a", "z"), BatchCopMaxRegions: 2})
+	_, err = readAllBatchCopResponses(t, resp)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "touches 3 regions, which exceeds the limit 2")
+	require.NoError(t, resp.Close())
+}
+
+// mockBatchCopRegionCache is a fake batchCopRegionCache whose regions are all kept in memory.
+type mockBatchCopRegionCache struct {
+	regions []*tikv.KeyLocation
+	// stores are the TiFlash store ids of each region, the first one serves the region.
+	stores map[uint64][]uint64
+	// missTimes is how many times GetTiFlashRPCContext returns nil for each region.
+	missTimes map[uint64]int
+	// splitRanges are the ranges passed to each call of SplitKeyRangesByLocations.
+	splitRanges []*KeyRanges
+	// learners are the stores whose peers are learners.
+	learners map[uint64]bool
+	// current is the index in stores of the store serving each region, it moves on with load balance.
+	current map[uint64]int
+	// downRegions are the regions whose TiFlash stores are all unavailable.
+	downRegions map[uint64]bool
+	// unresolvedStores are the stores whose addresses are not resolved.
+	unresolvedStores map[uint64]bool
+	resolveTimes     map[uint64]int
+}
+
+// newMockBatchCopRegionCache creates regions split by splitKeys, their ids start from 1.
+func newMockBatchCopRegionCache(splitKeys ...string) *mockBatchCopRegionCache {
+	c := &mockBatchCopRegionCache{
+		stores:           make(map[uint64][]uint64),
+		missTimes:        make(map[uint64]int),
+		learners:         make(map[uint64]bool),
+		current:          make(map[uint64]int),
+		downRegions:      make(map[uint64]bool),
+		unresolvedStores: make(map[uint64]bool),
+		resolveTimes:     make(map[uint64]int),
+	}
+	var start []byte
+	for i := 0; i <= len(splitKeys); i++ {
+		var end []byte
+		if i < len(splitKeys) {
+			end = []byte(splitKeys[i])
+		}
+		c.regions = append(c.regions, &tikv.KeyLocation{Region: tikv.NewRegionVerID(uint64(i+1), 1, 1), StartKey: start, EndKey: end})
+		c.stores[uint64(i+1)] = []uint64{1}
+		start = end
+	}
+	return c
+}
+
+func (c *mockBatchCopRegionCache) SplitKeyRangesByLocations(bo *Backoffer, ranges *KeyRanges) ([]*LocationKeyRanges, error) {
+	c.splitRanges = append(c.splitRanges, ranges)
+	var res []*LocationKeyRanges
+	for _, loc := range c.regions {
+		var locRanges []kv.KeyRange
+		ranges.Do(func(r *kv.KeyRange) {
+			start, end := r.StartKey, r.EndKey
+			if bytes.Compare(start, loc.StartKey) < 0 {
+				start = loc.StartKey
+			}
+			if len(loc.EndKey) > 0 && (len(end) == 0 || bytes.Compare(end, loc.EndKey) > 0) {
+				end = loc.EndKey
+			}
+			if len(end) == 0 || bytes.Compare(start, end) < 0 {
+				locRanges = append(locRanges, kv.KeyRange{StartKey: start, EndKey: end})
+			}
+		})
+		if len(locRanges) > 0 {
+			res = append(res, &LocationKeyRanges{Location: loc, Ranges: NewKeyRanges(locRanges)})
+		}
+	}
+	return res, nil
+}
+
+func (c *mockBatchCopRegionCache) GetTiFlashRPCContext(bo *tikv.Backoffer, id tikv.RegionVerID, loadBalance bool) (*tikv.RPCContext, error) {
+	if c.missTimes[id.GetID()] > 0 {
+		c.missTimes[id.GetID()]--
+		return nil, nil
+	}
+	if loadBalance {
+		c.current[id.GetID()]++
+	}
+	stores := c.stores[id.GetID()]
+	storeID := stores[c.current[id.GetID()]%len(stores)]
+	meta := &metapb.Region{Id: id.GetID()}
+	var peer *metapb.Peer
+	for _, s := range stores {
+		p := &metapb.Peer{StoreId: s}
+		if c.learners[s] {
+			p.Role = metapb.PeerRole_Learner
+		}
+		if s == storeID {
+			peer = p
+		}
+		meta.Peers = append(meta.Peers, p)
+	}
+	return &tikv.RPCContext{
+		Region: id,
+		Meta:   meta,
+		Peer:   peer,
+		Addr:   fmt.Sprintf("store%d", storeID),
+	}, nil
+}
+
+func (c *mockBatchCopRegionCache) GetAllValidTiFlashStores(id tikv.RegionVerID, currentStore *tikv.Store) []uint64 {
+	if c.downRegions[id.GetID()] {
+		return nil
+	}
+	// The current store is always the first one.
+	stores := c.stores[id.GetID()]
+	cur := c.current[id.GetID()] % len(stores)
+	return append(append([]uint64{}, stores[cur:]...), stores[:cur]...)
+}
+
+func (c *mockBatchCopRegionCache) ResolveTiFlashStoreAddr(bo *Backoffer, storeID uint64) (string, error) {
+	c.resolveTimes[storeID]++
+	if c.unresolvedStores[storeID] {
+		return "", nil
+	}
+	return fmt.Sprintf("store%d", storeID), nil
+}
+
+func regionIDsOfTasks(tasks []*batchCopTask) []uint64 {
+	var ids []uint64
+	for _, task := range tasks {
+		for _, ri := range task.regionInfos {
+			ids = append(ids, ri.Region.GetID())
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func TestBuildBatchCopTasksWithFakeCache(t *testing.T) {
+	t.Parallel()
+	cache := newMockBatchCopRegionCache("g", "n")
+	cache.stores[1] = []uint64{1, 2}
+	cache.stores[2] = []uint64{2, 1}
+	cache.stores[3] = []uint64{1, 2}
+	bo := backoff.NewBackofferWithVars(context.Background(), 3000, nil)
+
+	tasks, err := buildBatchCopTasks(bo, nil, cache, buildCopRanges("a", "z"), kv.TiFlash, nil, 0, nil, batchCopBuildOptions{})
+	require.NoError(t, err)
+	require.Len(t, tasks, 2)
+	require.Equal(t, []uint64{1, 2, 3}, regionIDsOfTasks(tasks))
+
+	tasks, err = buildBatchCopTasks(bo, nil, cache, buildCopRanges("h", "i"), kv.TiFlash, nil, 0, nil, batchCopBuildOptions{})
+	require.NoError(t, err)
+	require.Len(t, tasks, 1)
+	require.Equal(t, "store2", tasks[0].storeAddr)
+	require.Equal(t, []uint64{2}, regionIDsOfTasks(tasks))
+
+	// The region misses are retried until all the regions are found.
+	cache.missTimes[3] = 2
+	tasks, err = buildBatchCopTasks(bo, nil, cache, buildCopRanges("a", "z"), kv.TiFlash, nil, 0, nil, batchCopBuildOptions{})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{1, 2, 3}, regionIDsOfTasks(tasks))
+	require.Equal(t, 0, cache.missTimes[3])
+}
+
+func TestBuildBatchCopTasksWithoutAvailableStores(t *testing.T) {
+	t.Parallel()
+	cache := newMockBatchCopRegionCache("g", "n")
+	cache.stores[1] = []uint64{1, 2}
+	cache.stores[2] = []uint64{2, 1}
+	cache.stores[3] = []uint64{1, 2}
+	cache.downRegions[2] = true
+	bo := backoff.NewBackofferWithVars(context.Background(), 3000, nil)
+
+	_, err := buildBatchCopTasks(bo, nil, cache, buildCopRanges("a", "z"), kv.TiFlash, nil, 0, nil, batchCopBuildOptions{})
+	require.EqualError(t, err, "region 2 has no available TiFlash store, all its TiFlash peers may be down")
+	// The other regions are not affected.
+	tasks, err := buildBatchCopTasks(bo, nil, cache, buildCopRanges("a", "c", "o", "z"), kv.TiFlash, nil, 0, nil, batchCopBuildOptions{})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{1, 3}, regionIDsOfTasks(tasks))
+
+	// The balance gives up rather than panics if a task holds such a region.
+	tasks = []*batchCopTask{
+		{storeAddr: "store1", regionInfos: []RegionInfo{newBalanceRegionInfo(0, nil), newBalanceRegionInfo(2, nil, 1, 2)}},
+		{storeAddr: "store2", regionInfos: []RegionInfo{newBalanceRegionInfo(1, nil, 2, 1)}},
+	}
+	require.Equal(t, tasks, balanceBatchCopTask(context.Background(), nil, tasks, nil, 0))
+}
+
+func TestBuildBatchCopTasksDropUnresolvedStores(t *testing.T) {
+	t.Parallel()
+	cache := newMockBatchCopRegionCache("g", "n")
+	cache.stores[1] = []uint64{1, 9, 2}
+	cache.stores[2] = []uint64{2, 9}
+	cache.stores[3] = []uint64{1, 2, 9}
+	cache.unresolvedStores[9] = true
+	bo := backoff.NewBackofferWithVars(context.Background(), 3000, nil)
+
+	allStores := func(tasks []*batchCopTask) map[uint64][]uint64 {
+		stores := make(map[uint64][]uint64)
+		for _, task := range tasks {
+			require.NotEqual(t, "store9", task.storeAddr)
+			for _, ri := range task.regionInfos {
+				stores[ri.Region.GetID()] = ri.AllStores
+			}
+		}
+		return stores
+	}
+	expected := map[uint64][]uint64{1: {1, 2}, 2: {2}, 3: {1, 2}}
+	tasks, err := buildBatchCopTasks(bo, nil, cache, buildCopRanges("a", "z"), kv.TiFlash, nil, 0, nil, batchCopBuildOptions{})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{1, 2, 3}, regionIDsOfTasks(tasks))
+	require.Equal(t, expected, allStores(tasks))
+	// Every store is resolved only once in a build.
+	require.Equal(t, map[uint64]int{2: 1, 9: 1}, cache.resolveTimes)
+
+	// The current store of the region is always kept.
+	cache.unresolvedStores[8] = true
+	region := tikv.NewRegionVerID(1, 1, 1)
+	require.Equal(t, []uint64{9, 1}, dropUnresolvedStores(bo, cache, region, []uint64{9, 1, 8}, make(map[uint64]bool)))
+	require.Equal(t, []uint64{9}, dropUnresolvedStores(bo, cache, region, []uint64{9}, make(map[uint64]bool)))
+}
+
+func TestBuildBatchCopTasksBuildPath(t *testing.T) {
+	t.Parallel()
+	cache := newMockBatchCopRegionCache("g", "n", "t")
+	for id := uint64(1); id <= 3; id++ {
+		cache.stores[id] = []uint64{1, 2}
+	}
+	cache.stores[4] = []uint64{2, 1}
+	bo := backoff.NewBackofferWithVars(context.Background(), 3000, nil)
+	regionNums := func(tasks []*batchCopTask) map[string]int {
+		nums := make(map[string]int)
+		for _, task := range tasks {
+			nums[task.storeAddr] = len(task.regionInfos)
+		}
+		return nums
+	}
+	build := func(ranges *KeyRanges, opts batchCopBuildOptions) ([]*batchCopTask, string) {
+		reasons := &batchCopRetryReasons{}
+		tasks, err := buildBatchCopTasks(bo, nil, cache, ranges, kv.TiFlash, nil, 0, reasons, opts)
+		require.NoError(t, err)
+		return tasks, reasons.getBuildPath()
+	}
+
+	tasks, path := build(buildCopRanges("a", "z"), batchCopBuildOptions{})
+	require.Equal(t, BuildPathBalanced, path)
+	require.Equal(t, map[string]int{"store1": 2, "store2": 2}, regionNums(tasks))
+
+	tasks, path = build(buildCopRanges("a", "c"), batchCopBuildOptions{})
+	require.Equal(t, BuildPathSingleRegion, path)
+	require.Len(t, tasks, 1)
+
+	// The regions stay in their current stores when the balance is skipped.
+	tasks, path = build(buildCopRanges("a", "z"), batchCopBuildOptions{balanceMinRegions: 5})
+	require.Equal(t, BuildPathSkippedSmall, path)
+	require.Equal(t, map[string]int{"store1": 3, "store2": 1}, regionNums(tasks))
+	_, path = build(buildCopRanges("a", "z"), batchCopBuildOptions{balanceMinRegions: 4})
+	require.Equal(t, BuildPathBalanced, path)
+
+	tasks, path = build(buildCopRanges("a", "z"), batchCopBuildOptions{disableBalance: true})
+	require.Equal(t, BuildPathDisabled, path)
+	require.Equal(t, map[string]int{"store1": 3, "store2": 1}, regionNums(tasks))
+
+	// The tasks of MPP are always balanced.
+	require.Equal(t, BuildPathBalanced, batchCopBuildPath(1, true, batchCopBuildOptions{disableBalance: true}))
+
+	// The path of the first build is kept.
+	reasons := &batchCopRetryReasons{}
+	reasons.recordBuildPath(BuildPathSingleRegion)
+	reasons.recordBuildPath(BuildPathBalanced)
+	require.Equal(t, BuildPathSingleRegion, reasons.getBuildPath())
+}
+
+func TestBuildBatchCopTasksWithEstimatedRows(t *testing.T) {
+	t.Parallel()
+	store := &kvStore{balanceStrategy: NewSizeWeightedBalanceStrategy()}
+	cache := newMockBatchCopRegionCache("g", "n", "t")
+	for id := uint64(1); id <= 3; id++ {
+		cache.stores[id] = []uint64{1, 2}
+	}
+	cache.stores[4] = []uint64{2, 1}
+	bo := backoff.NewBackofferWithVars(context.Background(), 3000, nil)
+	build := func() []*batchCopTask {
+		tasks, err := buildBatchCopTasks(bo, store, cache, buildCopRanges("a", "z"), kv.TiFlash, nil, 0, nil, batchCopBuildOptions{})
+		require.NoError(t, err)
+		require.Equal(t, []uint64{1, 2, 3, 4}, regionIDsOfTasks(tasks))
+		return tasks
+	}
+	regionNums := func(tasks []*batchCopTask) []int {
+		var nums []int
+		for _, task := range tasks {
+			nums = append(nums, len(task.regionInfos))
+		}
+		sort.Ints(nums)
+		return nums
+	}
+
+	// The regions are balanced by count when the rows are unknown.
+	tasks := build()
+	for _, task := range tasks {
+		for _, ri := range task.regionInfos {
+			require.Zero(t, ri.EstRows)
+		}
+	}
+	require.Equal(t, []int{2, 2}, regionNums(tasks))
+
+	// Region 1 holds most of the rows, so the other regions are all put into the other store.
+	store.regionRowsEstimator = func(region tikv.RegionVerID) int64 {
+		if region.GetID() == 1 {
+			return 1000
+		}
+		return 10
+	}
+	tasks = build()
+	for _, task := range tasks {
+		for _, ri := range task.regionInfos {
+			require.Equal(t, store.regionRowsEstimator(ri.Region), ri.EstRows)
+		}
+		if regionIDsOfTasks([]*batchCopTask{task})[0] == 1 {
+			require.Len(t, task.regionInfos, 1)
+		}
+	}
+	require.Equal(t, []int{1, 3}, regionNums(tasks))
+}
+
+func TestBatchCopBuildPath(t *testing.T) {
+	t.Parallel()
+	c := newBatchCopTestCluster(t, 1, "m")
+	defer c.close()
+	resp := c.sendBatch(&kv.Request{KeyRanges: buildKeyRanges("a", "c")})
+	_, err := readAllBatchCopResponses(t, resp)
+	require.NoError(t, err)
+	require.NoError(t, resp.Close())
+	require.Equal(t, BuildPathSingleRegion, resp.(*batchCopIterator).BuildPath())
+
+	resp = c.sendBatch(&kv.Request{KeyRanges: buildKeyRanges("a", "z")})
+	_, err = readAllBatchCopResponses(t, resp)
+	require.NoError(t, err)
+	require.NoError(t, resp.Close())
+	require.Equal(t, BuildPathBalanced, resp.(*batchCopIterator).BuildPath())
+}
+
+func TestBuildBatchCopTasksStoreRolePreference(t *testing.T) {
+	t.Parallel()
+	newCache := func() *mockBatchCopRegionCache {
+		cache := newMockBatchCopRegionCache("g", "n")
+		// Store 1 and 3 hold learners, store 2 holds voters.
+		cache.learners[1] = true
+		cache.learners[3] = true
+		cache.stores[1] = []uint64{1, 2}
+		cache.stores[2] = []uint64{2, 1}
+		cache.stores[3] = []uint64{3, 1}
+		return cache
+	}
+	bo := backoff.NewBackofferWithVars(context.Background(), 3000, nil)
+	build := func(preference StoreRolePreference) map[uint64][]uint64 {
+		tasks, err := buildBatchCopTasks(bo, nil, newCache(), buildCopRanges("a", "z"), kv.TiFlash, nil, 0, nil, batchCopBuildOptions{storeRolePreference: preference})
+		require.NoError(t, err)
+		regions := make(map[uint64][]uint64)
+		for _, task := range tasks {
+			for _, ri := range task.regionInfos {
+				regions[ri.Region.GetID()] = ri.AllStores
+			}
+		}
+		require.Equal(t, []uint64{1, 2, 3}, regionIDsOfTasks(tasks))
+		return regions
+	}
+
+	require.Equal(t, map[uint64][]uint64{1: {1, 2}, 2: {2, 1}, 3: {3, 1}}, build(""))
+	require.Equal(t, map[uint64][]uint64{1: {1, 2}, 2: {2, 1}, 3: {3, 1}}, build(StoreRolePreferNone))
+	// Region 1 switches to the voter on store 2, region 3 has no voter so it's kept as it is.
+	require.Equal(t, map[uint64][]uint64{1: {2}, 2: {2}, 3: {3, 1}}, build(StoreRolePreferVoter))
+	// Region 2 switches to the learner on store 1.
+	require.Equal(t, map[uint64][]uint64{1: {1}, 2: {1}, 3: {3, 1}}, build(StoreRolePreferLearner))
+}
+
+func TestBuildBatchCopTasksResplitMissedRegions(t *testing.T) {
+	t.Parallel()
+	cache := newMockBatchCopRegionCache("g", "n")
+	cache.stores[2] = []uint64{2}
+	cache.missTimes[2] = 2
+	bo := backoff.NewBackofferWithVars(context.Background(), 3000, nil)
+
+	tasks, err := buildBatchCopTasks(bo, nil, cache, buildCopRanges("a", "c", "e", "z"), kv.TiFlash, nil, 0, nil, batchCopBuildOptions{})
+	require.NoError(t, err)
+	require.Len(t, tasks, 2)
+	require.Equal(t, []uint64{1, 2, 3}, regionIDsOfTasks(tasks))
+	// Only the ranges of the missed region are split again, the resolved regions are carried over.
+	require.Len(t, cache.splitRanges, 3)
+	require.Equal(t, buildCopRanges("a", "c", "e", "z"), cache.splitRanges[0])
+	require.Equal(t, buildCopRanges("g", "n"), cache.splitRanges[1])
+	require.Equal(t, buildCopRanges("g", "n"), cache.splitRanges[2])
+	var covered []kv.KeyRange
+	for _, task := range tasks {
+		for _, ri := range task.regionInfos {
+			ri.Ranges.Do(func(ran *kv.KeyRange) {
+				covered = append(covered, *ran)
+			})
+		}
+	}
+	sort.Slice(covered, func(i, j int) bool { return bytes.Compare(covered[i].StartKey, covered[j].StartKey) < 0 })
+	require.Equal(t, buildKeyRanges("a", "c", "e", "g", "g", "n", "n", "z"), covered)
+}
+
+func TestBuildBatchCopTasksVerifyCoverage(t *testing.T) {
+	t.Parallel()
+	opts := batchCopBuildOptions{verifyCoverage: true}
+	cache := newMockBatchCopRegionCache("g", "n")
+	bo := backoff.NewBackofferWithVars(context.Background(), 3000, nil)
+
+	tasks, err := buildBatchCopTasks(bo, nil, cache, buildCopRanges("a", "c", "e", "z"), kv.TiFlash, nil, 0, nil, opts)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{1, 2, 3}, regionIDsOfTasks(tasks))
+
+	// Inject a gap between the first two regions.
+	cache.regions[1].StartKey = []byte("i")
+	_, err = buildBatchCopTasks(bo, nil, cache, buildCopRanges("a", "c", "e", "z"), kv.TiFlash, nil, 0, nil, opts)
+	require.Error(t, err)
+	holesErr, ok := errors.Cause(err).(*ErrBatchCopCoverageHoles)
+	require.True(t, ok)
+	require.Equal(t, []kv.KeyRange{{StartKey: kv.Key("g"), EndKey: kv.Key("i")}}, holesErr.Holes)
+	require.Contains(t, err.Error(), `batch cop tasks don't cover the key ranges ["67", "69"]`)
+
+	// The ranges out of the gap are still covered.
+	_, err = buildBatchCopTasks(bo, nil, cache, buildCopRanges("a", "c", "i", "z"), kv.TiFlash, nil, 0, nil, opts)
+	require.NoError(t, err)
+
+	// The holes aren't detected without verification.
+	_, err = buildBatchCopTasks(bo, nil, cache, buildCopRanges("a", "c", "e", "z"), kv.TiFlash, nil, 0, nil, batchCopBuildOptions{})
+	require.NoError(t, err)
+}
+
+func TestVerifyBatchCopCoverage(t *testing.T) {
+	t.Parallel()
+	newTask := func(keys ...string) *batchCopTask {
+		return &batchCopTask{regionInfos: []RegionInfo{{Ranges: buildCopRanges(keys...)}}}
+	}
+	tasks := []*batchCopTask{newTask("d", "f", "k", "m"), newTask("a", "c"), newTask("b", "e")}
+	require.NoError(t, verifyBatchCopCoverage(buildCopRanges("a", "f"), tasks))
+	require.NoError(t, verifyBatchCopCoverage(buildCopRanges("b", "c", "k", "l"), tasks))
+
+	err := verifyBatchCopCoverage(buildCopRanges("a", "z"), tasks)
+	holesErr, ok := err.(*ErrBatchCopCoverageHoles)
+	require.True(t, ok)
+	require.Equal(t, []kv.KeyRange{
+		{StartKey: kv.Key("f"), EndKey: kv.Key("k")},
+		{StartKey: kv.Key("m"), EndKey: kv.Key("z")},
+	}, holesErr.Holes)
+
+	err = verifyBatchCopCoverage(buildCopRanges("a", "f"), nil)
+	require.Equal(t, &ErrBatchCopCoverageHoles{Holes: []kv.KeyRange{{StartKey: kv.Key("a"), EndKey: kv.Key("f")}}}, err)
+}
+
+func TestBatchCopHandleTime(t *testing.T) {
+	t.Parallel()
+	it := &batchCopIterator{
+		req:      &kv.Request{},
+		finishCh: make(chan struct{}),
+		respChan: make(chan *batchCopResponse, 10),
+	}
+	bo := backoff.NewBackofferWithVars(context.Background(), 1000, nil)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, it.handleBatchCopResponse(bo, &coprocessor.BatchResponse{Data: []byte("data")}, &batchCopTask{}))
+	}
+	close(it.respChan)
+	var total time.Duration
+	for resp := range it.respChan {
+		require.Greater(t, resp.HandleTime(), time.Duration(0))
+		total += resp.HandleTime()
+	}
+	require.Equal(t, total, it.TotalHandleTime())
+}
+
+func TestBatchCopStoreBackoff(t *testing.T) {
+	t.Parallel()
+	c := newBatchCopTestCluster(t, 2, "m")
+	defer c.close()
+	var mu sync.Mutex
+	failures := map[string]int{"tiflash0": 2}
+	c.client.setHandler(func(addr string, req *tikvrpc.Request) (*tikvrpc.Response, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failures[addr] > 0 {
+			failures[addr]--
+			return nil, errors.New("mock tiflash failure")
+		}
+		return newBatchCopStreamResponse(&coprocessor.BatchResponse{Data: []byte(addr)}), nil
+	})
+
+	resp := c.sendBatch(&kv.Request{KeyRanges: buildKeyRanges("a", "z")})
+	_, err := readAllBatchCopResponses(t, resp)
+	require.NoError(t, err)
+	require.NoError(t, resp.Close())
+	backoff := resp.(*batchCopIterator).StoreBackoffTime()
+	require.Greater(t, backoff["tiflash0"], time.Duration(0))
+	require.Zero(t, backoff["tiflash1"])
+}
+
+func TestBatchCopEmptyRanges(t *testing.T) {
+	t.Parallel()
+	it := &batchCopIterator{
+		req:      &kv.Request{},
+		finishCh: make(chan struct{}),
+		respChan: make(chan *batchCopResponse, 10),
+	}
+	bo := backoff.NewBackofferWithVars(context.Background(), 1000, nil)
+	newTask := func(ranges ...string) *batchCopTask {
+		task := &batchCopTask{}
+		for i := 0; i < len(ranges); i += 2 {
+			task.regionInfos = append(task.regionInfos, RegionInfo{Ranges: buildCopRanges(ranges[i], ranges[i+1])})
+		}
+		return task
+	}
+	streams := []struct {
+		task   *batchCopTask
+		chunks []*coprocessor.BatchResponse
+	}{
+		{newTask("a", "c"), []*coprocessor.BatchResponse{{Data: []byte("data")}}},
+		{newTask("m", "n", "c", "d"), []*coprocessor.BatchResponse{{}, {}}},
+		{newTask("e", "f"), []*coprocessor.BatchResponse{{}, {Data: []byte("data")}}},
+		{newTask("x", "z"), nil},
+	}
+	for _, stream := range streams {
+		resp := newBatchCopStreamResponse(stream.chunks...).Resp.(*tikvrpc.BatchCopStreamResponse)
+		require.NoError(t, it.handleStreamedBatchCopResponse(context.Background(), bo, resp, stream.task))
+	}
+	require.Equal(t, buildKeyRanges("c", "d", "m", "n", "x", "z"), it.EmptyRanges())
+}
+
+func TestBatchCopMemoryReserve(t *testing.T) {
+	t.Parallel()
+	c := newBatchCopTestCluster(t, 1)
+	defer c.close()
+
+	tracker := memory.NewTracker(0, -1)
+	resp := c.sendBatch(&kv.Request{KeyRanges: buildKeyRanges("a", "z"), MemTracker: tracker, BatchCopMemoryReserve: 1024})
+	require.Equal(t, int64(1024), tracker.BytesConsumed())
+	_, err := readAllBatchCopResponses(t, resp)
+	require.NoError(t, err)
+	require.Equal(t, int64(1024), tracker.BytesConsumed())
+	require.NoError(t, resp.Close())
+	require.Equal(t, int64(0), tracker.BytesConsumed())
+	// The responses are tracked on top of the reservation.
+	require.Greater(t, tracker.MaxConsumed(), int64(1024))
+	// Closing again doesn't release the reservation twice.
+	require.NoError(t, resp.Close())
+	require.Equal(t, int64(0), tracker.BytesConsumed())
+}
+
+func TestBatchCopNilMemTracker(t *testing.T) {
+	t.Parallel()
+	c := newBatchCopTestCluster(t, 1)
+	defer c.close()
+
+	req := &kv.Request{
+		KeyRanges:             buildKeyRanges("a", "z"),
+		BatchCopMemoryReserve: 1024,
+		BatchCopRespChanBytes: 1,
+	}
+	resp := c.sendBatch(req)
+	it := resp.(*batchCopIterator)
+	require.Nil(t, it.memTracker)
+	require.Equal(t, int64(0), atomic.LoadInt64(&it.memReserved))
+	data, err := readAllBatchCopResponses(t, resp)
+	require.NoError(t, err)
+	require.NotEmpty(t, data)
+	require.Equal(t, int64(0), atomic.LoadInt64(&it.memConsumed))
+	require.NoError(t, resp.Close())
+	require.NoError(t, resp.Close())
+
+	// Closing with responses left in the channel doesn't touch the tracker either.
+	resp = c.sendBatch(req)
+	require.NoError(t, resp.Close())
+}
+
+func TestBatchCopNonPreferredStore(t *testing.T) {
+	t.Parallel()
+	c := newBatchCopTestCluster(t, 2, "m")
+	defer c.close()
+	bo := backoff.NewBackofferWithVars(context.Background(), 3000, nil)
+	tasks, err := buildBatchCopTasks(bo, c.store.kvStore, c.store.GetRegionCache(), buildCopRanges("a", "z"), kv.TiFlash, nil, 0, nil, batchCopBuildOptions{})
+	require.NoError(t, err)
+	require.Len(t, tasks, 1)
+	task := tasks[0]
+	require.Len(t, task.regionInfos, 2)
+	require.False(t, routedToNonPreferredStore(task))
+
+	// The second region prefers the other store.
+	allStores := task.regionInfos[1].AllStores
+	require.Len(t, allStores, 2)
+	allStores[0], allStores[1] = allStores[1], allStores[0]
+	require.True(t, routedToNonPreferredStore(task))
+}
+
+func TestBatchCopMinChunkInterval(t *testing.T) {
+	t.Parallel()
+	c := newBatchCopTestCluster(t, 1)
+	defer c.close()
+	clock := newFakeClock()
+	c.store.clock = clock
+	chunks := make([]*coprocessor.BatchResponse, 0, 4)
+	for i := 0; i < 4; i++ {
+		chunks = append(chunks, &coprocessor.BatchResponse{Data: []byte{byte(i)}})
+	}
+	c.client.setHandler(func(addr string, req *tikvrpc.Request) (*tikvrpc.Response, error) {
+		return newBatchCopStreamResponse(chunks...), nil
+	})
+
+	const interval = 20 * time.Millisecond
+	resp := c.sendBatch(&kv.Request{KeyRanges: buildKeyRanges("a", "z"), BatchCopMinChunkInterval: interval})
+	delivered := make(chan time.Time)
+	go func() {
+		defer close(delivered)
+		for {
+			subset, err := resp.Next(context.Background())
+			if err != nil || subset == nil {
+				return
+			}
+			delivered <- clock.Now()
+		}
+	}()
+	first := <-delivered
+	for i := 1; i < 4; i++ {
+		// The consumer is blocked by the limiter until the interval passes.
+		clock.WaitForTimers(1)
+		select {
+		case <-delivered:
+			require.FailNow(t, "the response is delivered before the interval passes")
+		default:
+		}
+		clock.Advance(interval)
+		require.Equal(t, time.Duration(i)*interval, (<-delivered).Sub(first))
+	}
+	_, ok := <-delivered
+	require.False(t, ok)
+	require.NoError(t, resp.Close())
+}
+
+func TestBatchCopKilledWithFakeClock(t *testing.T) {
+	t.Parallel()
+	clock := newFakeClock()
+	killed := uint32(1)
+	it := &batchCopIterator{
+		store:    &kvStore{clock: clock},
+		req:      &kv.Request{},
+		finishCh: make(chan struct{}),
+		respChan: make(chan *batchCopResponse, 10),
+		vars:     kv.NewVariables(&killed),
+	}
+	done := make(chan *batchCopResponse)
+	go func() {
+		resp, _, _ := it.recvFromRespCh(context.Background())
+		done <- resp
+	}()
+	clock.WaitForTimers(1)
+	clock.Advance(3 * time.Second)
+	resp := <-done
+	require.Equal(t, derr.ErrQueryInterrupted, resp.err)
+}
+
+func TestBatchCopCorrelationID(t *testing.T) {
+	t.Parallel()
+	c := newBatchCopTestCluster(t, 1)
+	defer c.close()
+
+	var (
+		mu   sync.Mutex
+		ctxs []kvrpcpb.Context
+	)
+	c.client.setHandler(func(addr string, req *tikvrpc.Request) (*tikvrpc.Response, error) {
+		mu.Lock()
+		ctxs = append(ctxs, req.Context)
+		mu.Unlock()
+		return newBatchCopStreamResponse(&coprocessor.BatchResponse{Data: []byte("a")}), nil
+	})
+	for i := 0; i < 2; i++ {
+		resp := c.sendBatch(&kv.Request{KeyRanges: buildKeyRanges("a", "z"), ConnID: 7, TaskID: 35, ResourceGroupTag: []byte("tag")})
+		_, err := readAllBatchCopResponses(t, resp)
+		require.NoError(t, err)
+		require.NoError(t, resp.Close())
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, ctxs, 2)
+	for _, ctx := range ctxs {
+		require.Equal(t, uint64(35), ctx.TaskId)
+		require.Equal(t, []byte("tag"), ctx.ResourceGroupTag)
+	}
+}
+
+func TestBuildBatchCopTasksDuplicateRegion(t *testing.T) {
+	cache := newMockBatchCopRegionCache("g", "n")
+	// The last location duplicates the first region.
+	cache.regions = append(cache.regions, &tikv.KeyLocation{Region: cache.regions[0].Region, StartKey: []byte("x"), EndKey: []byte("y")})
+	bo := backoff.NewBackofferWithVars(context.Background(), 3000, nil)
+
+	tasks, err := buildBatchCopTasks(bo, nil, cache, buildCopRanges("a", "c", "h", "i", "x", "y"), kv.TiFlash, nil, 0, nil, batchCopBuildOptions{})
+	require.NoError(t, err)
+	require.Len(t, tasks, 1)
+	require.Equal(t, []uint64{1, 2, 3}, regionIDsOfTasks(tasks))
+	for _, ri := range tasks[0].regionInfos {
+		if ri.Region.GetID() == 1 {
+			require.Equal(t, buildCopRanges("a", "c", "x", "y"), ri.Ranges)
+		}
+	}
+
+	_, err = buildBatchCopTasks(bo, nil, cache, buildCopRanges("a", "c", "h", "i", "x", "y"), kv.TiFlash, nil, 0, nil, batchCopBuildOptions{strictDuplicateRegion: true})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "region 1 is referenced by more than one batch cop task")
+}
+
+func TestBatchCopSampleMode(t *testing.T) {
+	t.Parallel()
+	c := newBatchCopTestCluster(t, 2, "g", "n")
+	defer c.close()
+	var mu sync.Mutex
+	regionNums := make(map[string]int)
+	c.client.setHandler(func(addr string, req *tikvrpc.Request) (*tikvrpc.Response, error) {
+		mu.Lock()
+		regionNums[addr] += len(req.BatchCop().Regions)
+		mu.Unlock()
+		return newBatchCopStreamResponse(&coprocessor.BatchResponse{Data: []byte(addr)}), nil
+	})
+
+	resp := c.sendBatch(&kv.Request{KeyRanges: buildKeyRanges("a", "z"), SampleMode: true})
+	_, err := readAllBatchCopResponses(t, resp)
+	require.NoError(t, err)
+	require.NoError(t, resp.Close())
+	tasks := resp.(*batchCopIterator).tasks
+	require.NotEmpty(t, tasks)
+	for _, task := range tasks {
+		require.Len(t, task.regionInfos, 1)
+		require.Equal(t, 1, regionNums[task.storeAddr])
+	}
+}
+
+func TestBatchCopRetryReasons(t *testing.T) {
+	t.Parallel()
+	c := newBatchCopTestCluster(t, 1)
+	defer c.close()
+	var mu sync.Mutex
+	failures := 1
+	c.client.setHandler(func(addr string, req *tikvrpc.Request) (*tikvrpc.Response, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failures > 0 {
+			failures--
+			return nil, errors.New("mock tiflash failure")
+		}
+		return newBatchCopStreamResponse(&coprocessor.BatchResponse{Data: []byte(addr)}), nil
+	})
+	resp := c.sendBatch(&kv.Request{KeyRanges: buildKeyRanges("a", "z")})
+	_, err := readAllBatchCopResponses(t, resp)
+	require.NoError(t, err)
+	require.NoError(t, resp.Close())
+	require.Equal(t, map[string]int{"store_error": 1}, resp.(*batchCopIterator).RetryReasons())
+
+	c.client.setHandler(func(addr string, req *tikvrpc.Request) (*tikvrpc.Response, error) {
+		resp := newBatchCopStreamResponse(&coprocessor.BatchResponse{Data: []byte(addr)})
+		resp.Resp.(*tikvrpc.BatchCopStreamResponse).Tikv_BatchCoprocessorClient.(*mockBatchCopStream).err = errors.New("mock stream failure")
+		return resp, nil
+	})
+	resp = c.sendBatch(&kv.Request{KeyRanges: buildKeyRanges("a", "z")})
+	_, err = readAllBatchCopResponses(t, resp)
+	require.Error(t, err)
+	require.NoError(t, resp.Close())
+	require.Equal(t, map[string]int{"stream_error": 1}, resp.(*batchCopIterator).RetryReasons())
+
+	cache := newMockBatchCopRegionCache("g")
+	cache.missTimes[2] = 2
+	retryReasons := &batchCopRetryReasons{}
+	bo := backoff.NewBackofferWithVars(context.Background(), 3000, nil)
+	_, err = buildBatchCopTasks(bo, nil, cache, buildCopRanges("a", "z"), kv.TiFlash, nil, 0, retryReasons, batchCopBuildOptions{})
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{"region_miss": 2}, retryReasons.snapshot())
+}
+
+func TestBatchCopRespChanBytes(t *testing.T) {
+	t.Parallel()
+	tracker := memory.NewTracker(0, -1)
+	it := &batchCopIterator{
+		req:        &kv.Request{},
+		finishCh:   make(chan struct{}),
+		respChan:   make(chan *batchCopResponse, 10),
+		respBytes:  newRespBytesLimiter(100),
+		rpcCancel:  tikv.NewRPCanceller(),
+		memTracker: tracker,
+	}
+	large := &batchCopResponse{pbResp: &coprocessor.BatchResponse{Data: make([]byte, 200)}}
+	small := &batchCopResponse{pbResp: &coprocessor.BatchResponse{Data: make([]byte, 10)}}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, resp := range []*batchCopResponse{large, small, small} {
+			require.False(t, it.sendToRespCh(resp))
+		}
+	}()
+	// The large response exceeds the limit alone, the small ones have to wait until it's consumed.
+	time.Sleep(50 * time.Millisecond)
+	require.Len(t, it.respChan, 1)
+	require.Equal(t, large.MemSize(), tracker.BytesConsumed())
+
+	resp, ok, exit := it.recvFromRespCh(context.Background())
+	require.True(t, ok)
+	require.False(t, exit)
+	require.Equal(t, large, resp)
+	<-done
+	require.Len(t, it.respChan, 2)
+	require.Equal(t, 2*small.MemSize(), tracker.BytesConsumed())
+
+	// Closing releases the responses which are never consumed.
+	require.NoError(t, it.Close())
+	require.Equal(t, int64(0), tracker.BytesConsumed())
+}
+
+func TestBatchCopIteratorID(t *testing.T) {
+	t.Parallel()
+	id1, id2 := newBatchCopIteratorID(740), newBatchCopIteratorID(740)
+	require.NotEqual(t, id1, id2)
+	require.True(t, strings.HasPrefix(id1, "740-"))
+
+	core, logs := observer.New(zap.InfoLevel)
+	it := &batchCopIterator{
+		id:       id1,
+		req:      &kv.Request{},
+		finishCh: make(chan struct{}),
+		respChan: make(chan *batchCopResponse, 10),
+	}
+	it.log = zap.New(core).With(zap.String("iterator id", it.id))
+	require.Equal(t, id1, it.ID())
+	bo := backoff.NewBackofferWithVars(context.Background(), 1000, nil)
+	require.Error(t, it.handleBatchCopResponse(bo, &coprocessor.BatchResponse{OtherError: "mock error"}, &batchCopTask{}))
+	resp := newBatchCopStreamResponse(&coprocessor.BatchResponse{Data: []byte("data")})
+	resp.Resp.(*tikvrpc.BatchCopStreamResponse).Tikv_BatchCoprocessorClient.(*mockBatchCopStream).err = errors.New("mock stream failure")
+	require.Error(t, it.handleStreamedBatchCopResponse(context.Background(), bo, resp.Resp.(*tikvrpc.BatchCopStreamResponse), &batchCopTask{}))
+
+	entries := logs.All()
+	require.Len(t, entries, 2)
+	for _, entry := range entries {
+		require.Equal(t, id1, entry.ContextMap()["iterator id"])
+	}
+}
+
+func TestBatchCopStoreMaxBytes(t *testing.T) {
+	t.Parallel()
+	it := &batchCopIterator{
+		req:      &kv.Request{BatchCopStoreMaxBytes: 100},
+		finishCh: make(chan struct{}),
+		respChan: make(chan *batchCopResponse, 10),
+	}
+	bo := backoff.NewBackofferWithVars(context.Background(), 1000, nil)
+	small, large := &batchCopTask{storeAddr: "store1"}, &batchCopTask{storeAddr: "store2"}
+	for i := 0; i < 3; i++ {
+		require.NoError(t, it.handleBatchCopResponse(bo, &coprocessor.BatchResponse{Data: make([]byte, 10)}, small))
+	}
+	require.NoError(t, it.handleBatchCopResponse(bo, &coprocessor.BatchResponse{Data: make([]byte, 60)}, large))
+	err := it.handleBatchCopResponse(bo, &coprocessor.BatchResponse{Data: make([]byte, 60)}, large)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "batch cop responses from store store2 exceed the limit 100 bytes")
+	require.Len(t, it.respChan, 4)
+}
+
+func TestOrderBatchCopTasks(t *testing.T) {
+	t.Parallel()
+	newTasks := func() []*batchCopTask {
+		var tasks []*batchCopTask
+		for i, regionNum := range []int{2, 1, 3, 1} {
+			tasks = append(tasks, &batchCopTask{storeAddr: fmt.Sprintf("task%d", i), regionInfos: make([]RegionInfo, regionNum)})
+		}
+		return tasks
+	}
+	addrs := func(tasks []*batchCopTask) []string {
+		var ret []string
+		for _, task := range tasks {
+			ret = append(ret, task.storeAddr)
+		}
+		return ret
+	}
+	cases := []struct {
+		policy TaskOrderPolicy
+		expect []string
+	}{
+		{TaskOrderFIFO, []string{"task0", "task1", "task2", "task3"}},
+		{TaskOrderSmallestFirst, []string{"task1", "task3", "task0", "task2"}},
+		{TaskOrderLargestFirst, []string{"task2", "task0", "task1", "task3"}},
+	}
+	for _, c := range cases {
+		tasks := newTasks()
+		orderBatchCopTasks(tasks, c.policy)
+		require.Equal(t, c.expect, addrs(tasks))
+	}
+}
+
+func TestBatchCopSummaryLog(t *testing.T) {
+	t.Parallel()
+	c := newBatchCopTestCluster(t, 1, "m")
+	defer c.close()
+	resp := c.sendBatch(&kv.Request{StartTs: 743, KeyRanges: buildKeyRanges("a", "z")})
+	_, err := readAllBatchCopResponses(t, resp)
+	require.NoError(t, err)
+
+	core, logs := observer.New(zap.InfoLevel)
+	it := resp.(*batchCopIterator)
+	it.log = zap.New(core)
+	require.NoError(t, resp.Close())
+	// Closing again doesn't log the summary twice.
+	require.NoError(t, resp.Close())
+	entries := logs.FilterMessage("batch cop query summary").All()
+	require.Len(t, entries, 1)
+	fields := entries[0].ContextMap()
+	require.Equal(t, uint64(743), fields["txnStartTS"])
+	require.Equal(t, int64(1), fields["task num"])
+	require.Equal(t, int64(2), fields["region num"])
+	require.Equal(t, int64(len("tiflash0")+2), fields["bytes"])
+	require.Equal(t, int64(0), fields["retries"])
+	require.Equal(t, int64(1), fields["store num"])
+	require.Equal(t, false, fields["killed"])
+	require.Equal(t, false, fields["cancelled"])
+	require.Greater(t, fields["duration"], time.Duration(0))
+
+	// The duration is unknown for the iterator which isn't started.
+	core, logs = observer.New(zap.InfoLevel)
+	it = &batchCopIterator{req: &kv.Request{}, log: zap.New(core)}
+	it.logSummary()
+	entries = logs.FilterMessage("batch cop query summary").All()
+	require.Len(t, entries, 1)
+	require.NotContains(t, entries[0].ContextMap(), "duration")
+}
+
+func TestBatchCopIsolationLevel(t *testing.T) {
+	t.Parallel()
+	c := newBatchCopTestCluster(t, 1)
+	defer c.close()
+	var sent int32
+	c.client.setHandler(func(addr string, req *tikvrpc.Request) (*tikvrpc.Response, error) {
+		if req.Type != tikvrpc.CmdBatchCop {
+			return c.client.Client.SendRequest(context.Background(), addr, req, time.Second)
+		}
+		atomic.StoreInt32(&sent, int32(req.Context.IsolationLevel))
+		return newBatchCopStreamResponse(&coprocessor.BatchResponse{Data: []byte(addr)}), nil
+	})
+
+	for level, expected := range map[kv.IsoLevel]kvrpcpb.IsolationLevel{
+		kv.RC: kvrpcpb.IsolationLevel_RC,
+		kv.SI: kvrpcpb.IsolationLevel_SI,
+	} {
+		resp := c.sendBatch(&kv.Request{KeyRanges: buildKeyRanges("a", "z"), IsolationLevel: level})
+		_, err := readAllBatchCopResponses(t, resp)
+		require.NoError(t, err)
+		core, logs := observer.New(zap.InfoLevel)
+		it := resp.(*batchCopIterator)
+		it.log = zap.New(core)
+		require.NoError(t, resp.Close())
+		require.Equal(t, expected, it.IsolationLevel())
+		require.Equal(t, expected, kvrpcpb.IsolationLevel(atomic.LoadInt32(&sent)))
+		entries := logs.FilterMessage("batch cop query summary").All()
+		require.Len(t, entries, 1)
+		require.Equal(t, expected.String(), entries[0].ContextMap()["isolation level"])
+	}
+}
+
+func TestBatchCopAllReplicasFailed(t *testing.T) {
+	t.Parallel()
+	c := newBatchCopTestCluster(t, 2)
+	defer c.close()
+	c.client.setHandler(func(addr string, req *tikvrpc.Request) (*tikvrpc.Response, error) {
+		return nil, errors.New("mock tiflash failure")
+	})
+
+	resp := c.sendBatch(&kv.Request{KeyRanges: buildKeyRanges("a", "z"), FailOnAllTiFlashReplicasFailed: true})
+	_, err := readAllBatchCopResponses(t, resp)
+	require.NoError(t, resp.Close())
+	require.Error(t, err)
+	failedErr, ok := errors.Cause(err).(*ErrAllTiFlashReplicasFailed)
+	require.True(t, ok)
+	require.Equal(t, c.regionIDs[0], failedErr.RegionID)
+	require.Equal(t, c.tiflashStoreIDs, failedErr.Stores)
+}
+
+func TestBatchCopBuildTaskMetrics(t *testing.T) {
+	sampleCount := func(buildType string) uint64 {
+		var m dto.Metric
+		require.NoError(t, tidbmetrics.BatchCopBuildTaskHistogram.WithLabelValues(buildType).(prometheus.Histogram).Write(&m))
+		return m.GetHistogram().GetSampleCount()
+	}
+	cache := newMockBatchCopRegionCache("g")
+	bo := backoff.NewBackofferWithVars(context.Background(), 3000, nil)
+	warm, cold := sampleCount("warm"), sampleCount("cold")
+	_, err := buildBatchCopTasks(bo, nil, cache, buildCopRanges("a", "z"), kv.TiFlash, nil, 0, nil, batchCopBuildOptions{})
+	require.NoError(t, err)
+	require.Equal(t, warm+1, sampleCount("warm"))
+	require.Equal(t, cold, sampleCount("cold"))
+
+	cache.missTimes[2] = 1
+	_, err = buildBatchCopTasks(bo, nil, cache, buildCopRanges("a", "z"), kv.TiFlash, nil, 0, nil, batchCopBuildOptions{})
+	require.NoError(t, err)
+	require.Equal(t, warm+1, sampleCount("warm"))
+	require.Equal(t, cold+1, sampleCount("cold"))
+}
+
+func TestBatchCopStreamContextDone(t *testing.T) {
+	t.Parallel()
+	it := &batchCopIterator{
+		req:      &kv.Request{},
+		finishCh: make(chan struct{}),
+		respChan: make(chan *batchCopResponse, 10),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	bo := backoff.NewBackofferWithVars(ctx, 1000, nil)
+	chunks := []*coprocessor.BatchResponse{{Data: []byte("1")}, {Data: []byte("2")}, {Data: []byte("3")}}
+	resp := newBatchCopStreamResponse(chunks...).Resp.(*tikvrpc.BatchCopStreamResponse)
+	stream := resp.Tikv_BatchCoprocessorClient.(*mockBatchCopStream)
+	// The first chunk has been received along with the stream when the context expires.
+	cancel()
+	err := it.handleStreamedBatchCopResponse(ctx, bo, resp, &batchCopTask{storeAddr: "store1"})
+	require.Error(t, err)
+	require.Equal(t, context.Canceled, errors.Cause(err))
+	require.Contains(t, err.Error(), "receive batch cop stream from store store1")
+	require.Len(t, stream.resps, 2)
+	require.Len(t, it.respChan, 1)
+}
+
+func TestBatchCopStoreKeyOrder(t *testing.T) {
+	t.Parallel()
+	it := &batchCopIterator{
+		req:      &kv.Request{BatchCopStoreKeyOrder: true},
+		finishCh: make(chan struct{}),
+		respChan: make(chan *batchCopResponse, 10),
+	}
+	bo := backoff.NewBackofferWithVars(context.Background(), 1000, nil)
+	newTask := func(keys ...string) *batchCopTask {
+		task := &batchCopTask{}
+		for i := 0; i < len(keys); i += 2 {
+			task.regionInfos = append(task.regionInfos, RegionInfo{Ranges: buildCopRanges(keys[i], keys[i+1])})
+		}
+		return task
+	}
+	// The tasks of a store are finished in an order different from their keys, e.g. the retried ones.
+	tasks := []*batchCopTask{newTask("m", "n"), newTask("x", "z", "a", "c"), newTask("g", "h")}
+	for _, task := range tasks {
+		for i := 0; i < 2; i++ {
+			data := []byte(fmt.Sprintf("%s%d", string(task.startKey()), i))
+			require.NoError(t, it.handleBatchCopResponse(bo, &coprocessor.BatchResponse{Data: data}, task))
+		}
+	}
+	// Nothing is delivered until all the tasks are finished.
+	require.Len(t, it.respChan, 0)
+	it.sendInKeyOrder(tasks)
+	close(it.respChan)
+	var data []string
+	for resp := range it.respChan {
+		require.Equal(t, kv.Key(resp.GetData()[:1]), resp.GetStartKey())
+		data = append(data, string(resp.GetData()))
+	}
+	require.Equal(t, []string{"a0", "a1", "g0", "g1", "m0", "m1"}, data)
+}
+
+func TestBatchCopDuplicateStartKey(t *testing.T) {
+	t.Parallel()
+	bo := backoff.NewBackofferWithVars(context.Background(), 1000, nil)
+	deliver := func(policy DuplicateStartKeyPolicy) ([]string, error) {
+		it := &batchCopIterator{
+			req:      &kv.Request{BatchCopStoreKeyOrder: true, BatchCopDuplicateStartKey: string(policy)},
+			finishCh: make(chan struct{}),
+			respChan: make(chan *batchCopResponse, 10),
+		}
+		// The regions of the tasks overlap by a bug, so the tasks share the start key "a".
+		tasks := []*batchCopTask{
+			{storeAddr: "store1", regionInfos: []RegionInfo{{Ranges: buildCopRanges("a", "c")}}},
+			{storeAddr: "store2", regionInfos: []RegionInfo{{Ranges: buildCopRanges("a", "b")}}},
+			{storeAddr: "store2", regionInfos: []RegionInfo{{Ranges: buildCopRanges("m", "n")}}},
+		}
+		for _, task := range tasks {
+			for i := 0; i < 2; i++ {
+				data := []byte(fmt.Sprintf("%s%d", task.storeAddr, i))
+				require.NoError(t, it.handleBatchCopResponse(bo, &coprocessor.BatchResponse{Data: data}, task))
+			}
+		}
+		it.sendInKeyOrder(tasks)
+		close(it.respChan)
+		var data []string
+		for resp := range it.respChan {
+			if resp.err != nil {
+				return data, resp.err
+			}
+			data = append(data, string(resp.GetData()))
+		}
+		return data, nil
+	}
+
+	for _, policy := range []DuplicateStartKeyPolicy{"", DuplicateStartKeyIgnore, DuplicateStartKeyLog} {
+		data, err := deliver(policy)
+		require.NoError(t, err)
+		require.Len(t, data, 6)
+	}
+
+	// The responses of the first task are delivered, then the request fails on the second one.
+	data, err := deliver(DuplicateStartKeyError)
+	require.Len(t, data, 2)
+	dupErr, ok := errors.Cause(err).(*ErrBatchCopDuplicateStartKey)
+	require.True(t, ok)
+	require.Equal(t, kv.Key("a"), dupErr.StartKey)
+	require.ElementsMatch(t, []string{"store1", "store2"}, dupErr.StoreAddrs)
+}
+
+func TestBatchCopAddrValidator(t *testing.T) {
+	t.Parallel()
+	c := newBatchCopTestCluster(t, 1)
+	defer c.close()
+	var dialed uint32
+	c.client.setHandler(func(addr string, req *tikvrpc.Request) (*tikvrpc.Response, error) {
+		atomic.StoreUint32(&dialed, 1)
+		return newBatchCopStreamResponse(&coprocessor.BatchResponse{Data: []byte(addr)}), nil
+	})
+
+	client := c.store.GetClient().(*CopClient)
+	client.AddrValidator = NewAddrAllowlistValidator([]string{"tiflash1"})
+	resp := c.sendBatchByClient(client, &kv.Request{KeyRanges: buildKeyRanges("a", "z")})
+	_, err := readAllBatchCopResponses(t, resp)
+	require.NoError(t, resp.Close())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "store address tiflash0 is not in the allowlist")
+	require.Zero(t, atomic.LoadUint32(&dialed))
+
+	client = c.store.GetClient().(*CopClient)
+	client.AddrValidator = NewAddrAllowlistValidator([]string{"tiflash0"})
+	resp = c.sendBatchByClient(client, &kv.Request{KeyRanges: buildKeyRanges("a", "z")})
+	_, err = readAllBatchCopResponses(t, resp)
+	require.NoError(t, err)
+	require.NoError(t, resp.Close())
+	require.Equal(t, uint32(1), atomic.LoadUint32(&dialed))
+}
+
+func TestBatchCopKeepOrder(t *testing.T) {
+	t.Parallel()
+	c := newBatchCopTestCluster(t, 2, "c", "g", "m")
+	defer c.close()
+	c.client.setHandler(func(addr string, req *tikvrpc.Request) (*tikvrpc.Response, error) {
+		regions := req.BatchCop().Regions
+		startKey := regions[0].Ranges[0].Start
+		// Make the responses of the smaller keys come later.
+		time.Sleep(time.Duration('z'-startKey[0]) * time.Millisecond)
+		return newBatchCopStreamResponse(
+			&coprocessor.BatchResponse{Data: []byte(string(startKey) + "0")},
+			&coprocessor.BatchResponse{Data: []byte(string(startKey) + "1")},
+		), nil
+	})
+
+	resp := c.sendBatchPerRegion(&kv.Request{KeyRanges: buildKeyRanges("a", "z"), KeepOrder: true})
+	resps, err := readAllBatchCopResponses(t, resp)
+	require.NoError(t, err)
+	require.NoError(t, resp.Close())
+	var data, startKeys []string
+	for _, r := range resps {
+		data = append(data, string(r.GetData()))
+		startKeys = append(startKeys, string(r.GetStartKey()))
+	}
+	require.Equal(t, []string{"a0", "a1", "c0", "c1", "g0", "g1", "m0", "m1"}, data)
+	require.Equal(t, []string{"a", "a", "c", "c", "g", "g", "m", "m"}, startKeys)
+
+	// The regions are still batched, the responses carry the start key of their task.
+	resp = c.sendBatch(&kv.Request{KeyRanges: buildKeyRanges("a", "z"), KeepOrder: true})
+	resps, err = readAllBatchCopResponses(t, resp)
+	require.NoError(t, err)
+	require.NoError(t, resp.Close())
+	require.Len(t, resps, 2)
+	for _, r := range resps {
+		require.Equal(t, "a", string(r.GetStartKey()))
+	}
+
+	resp = c.sendBatch(&kv.Request{KeyRanges: buildKeyRanges("a", "z"), KeepOrder: true, Desc: true})
+	_, err = readAllBatchCopResponses(t, resp)
+	require.Error(t, err)
+}
+
+func TestBatchCopMergeInKeyOrder(t *testing.T) {
+	t.Parallel()
+	var killed uint32
+	it := &batchCopIterator{
+		req:      &kv.Request{KeepOrder: true},
+		finishCh: make(chan struct{}),
+		respChan: make(chan *batchCopResponse),
+		vars:     kv.NewVariables(&killed),
+	}
+	// The second response of the first task comes from a task rebuilt from it, so it follows the first response of
+	// the second task.
+	for _, keys := range [][]string{{"a", "e"}, {"c", "g"}} {
+		task := &batchCopTask{
+			regionInfos: []RegionInfo{{Ranges: NewKeyRanges(buildKeyRanges(keys[0], "z"))}},
+			respChan:    make(chan *batchCopResponse, len(keys)),
+			started:     1,
+		}
+		for _, key := range keys {
+			task.respChan <- &batchCopResponse{pbResp: &coprocessor.BatchResponse{}, startKey: kv.Key(key)}
+		}
+		close(task.respChan)
+		it.tasks = append(it.tasks, task)
+	}
+	close(it.respChan)
+	var startKeys []string
+	for {
+		resp, ok, exit := it.recvFromRespCh(context.Background())
+		require.False(t, exit)
+		if !ok {
+			break
+		}
+		startKeys = append(startKeys, string(resp.startKey))
+		// At most one response of each task is held.
+		require.LessOrEqual(t, it.mergeHeap.Len(), len(it.tasks))
+	}
+	require.Equal(t, []string{"a", "c", "e", "g"}, startKeys)
+}
+
+func TestBatchCopExecDetails(t *testing.T) {
+	t.Parallel()
+	it := &batchCopIterator{
+		req:      &kv.Request{},
+		finishCh: make(chan struct{}),
+		respChan: make(chan *batchCopResponse, 10),
+	}
+	bo := backoff.NewBackofferWithVars(context.Background(), 1000, nil)
+	require.NoError(t, it.handleBatchCopResponse(bo, &coprocessor.BatchResponse{
+		Data: []byte("data"),
+		ExecDetails: &kvrpcpb.ExecDetails{
+			TimeDetail: &kvrpcpb.TimeDetail{ProcessWallTimeMs: 20, WaitWallTimeMs: 10},
+			ScanDetail: &kvrpcpb.ScanDetail{Write: &kvrpcpb.ScanInfo{Processed: 5, Total: 8}},
+		},
+	}, &batchCopTask{}))
+	// The older versions of TiFlash don't report the exec details.
+	require.NoError(t, it.handleBatchCopResponse(bo, &coprocessor.BatchResponse{Data: []byte("data")}, &batchCopTask{}))
+	close(it.respChan)
+
+	detail := (<-it.respChan).GetCopRuntimeStats()
+	require.Equal(t, 20*time.Millisecond, detail.TimeDetail.ProcessTime)
+	require.Equal(t, 10*time.Millisecond, detail.TimeDetail.WaitTime)
+	require.Equal(t, int64(5), detail.ScanDetail.ProcessedKeys)
+	require.Equal(t, int64(8), detail.ScanDetail.TotalKeys)
+	detail = (<-it.respChan).GetCopRuntimeStats()
+	require.Zero(t, detail.TimeDetail.ProcessTime)
+	require.Zero(t, detail.ScanDetail.ProcessedKeys)
+}
+
+func TestBatchCopTiFlashCPUTime(t *testing.T) {
+	t.Parallel()
+	it := &batchCopIterator{
+		req:      &kv.Request{},
+		finishCh: make(chan struct{}),
+		respChan: make(chan *batchCopResponse, 10),
+	}
+	bo := backoff.NewBackofferWithVars(context.Background(), 1000, nil)
+	for _, cpuMs := range []int64{30, 12} {
+		require.NoError(t, it.handleBatchCopResponse(bo, &coprocessor.BatchResponse{
+			Data:        []byte("data"),
+			ExecDetails: &kvrpcpb.ExecDetails{TimeDetail: &kvrpcpb.TimeDetail{ProcessWallTimeMs: cpuMs}},
+		}, &batchCopTask{}))
+	}
+	// The CPU time is absent in the responses of older TiFlash versions.
+	require.NoError(t, it.handleBatchCopResponse(bo, &coprocessor.BatchResponse{Data: []byte("data")}, &batchCopTask{}))
+	close(it.respChan)
+
+	require.Equal(t, 30*time.Millisecond, (<-it.respChan).GetCopRuntimeStats().TiFlashCPUTime)
+	require.Equal(t, 42*time.Millisecond, it.TotalTiFlashCPU())
+}
+
+func TestBatchCopStreamsOpened(t *testing.T) {
+	t.Parallel()
+	c := newBatchCopTestCluster(t, 2, "m")
+	defer c.close()
+	var mu sync.Mutex
+	failures := map[string]int{"tiflash0": 2}
+	streams := 0
+	c.client.setHandler(func(addr string, req *tikvrpc.Request) (*tikvrpc.Response, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failures[addr] > 0 {
+			failures[addr]--
+			return nil, errors.New("mock tiflash failure")
+		}
+		streams++
+		return newBatchCopStreamResponse(&coprocessor.BatchResponse{Data: []byte(addr)}), nil
+	})
+
+	resp := c.sendBatch(&kv.Request{KeyRanges: buildKeyRanges("a", "z")})
+	_, err := readAllBatchCopResponses(t, resp)
+	require.NoError(t, err)
+	require.NoError(t, resp.Close())
+	// The failed sends establish no stream, while the retried tasks open their own streams.
+	require.Greater(t, resp.(*batchCopIterator).RetryReasons()["store_error"], 0)
+	require.Equal(t, streams, resp.(*batchCopIterator).StreamsOpened())
+}
+
+func TestBatchCopRespChanSize(t *testing.T) {
+	t.Parallel()
+	require.Equal(t, 64, batchCopRespChanSize(0, 1))
+	require.Equal(t, 640, batchCopRespChanSize(0, 10))
+	require.Equal(t, 2048, batchCopRespChanSize(0, 100))
+	require.Equal(t, 2048, batchCopRespChanSize(0, 0))
+
+	// The buffer of a single task query is small.
+	c := newBatchCopTestCluster(t, 1)
+	defer c.close()
+	resp := c.sendBatch(&kv.Request{KeyRanges: buildKeyRanges("a", "z")})
+	require.Equal(t, 64, cap(resp.(*batchCopIterator).respChan))
+	require.NoError(t, resp.Close())
+	// The buffer is bounded by the concurrency rather than the number of tasks.
+	require.Equal(t, 128, batchCopRespChanSize(0, batchCopWorkerConcurrency(2, 100)))
+
+	require.Equal(t, 16, batchCopRespChanSize(16, 100))
+	resp = c.sendBatch(&kv.Request{KeyRanges: buildKeyRanges("a", "z"), BatchCopRespChanSize: 16})
+	_, err := readAllBatchCopResponses(t, resp)
+	require.NoError(t, err)
+	require.NoError(t, resp.Close())
+	require.Equal(t, 16, cap(resp.(*batchCopIterator).respChan))
+}
+
+func TestBatchCopCloseGracePeriod(t *testing.T) {
+	t.Parallel()
+	c := newBatchCopTestCluster(t, 1)
+	defer c.close()
+	var sends int32
+	c.client.setHandler(func(addr string, req *tikvrpc.Request) (*tikvrpc.Response, error) {
+		atomic.AddInt32(&sends, 1)
+		time.Sleep(50 * time.Millisecond)
+		return newBatchCopStreamResponse(&coprocessor.BatchResponse{Data: []byte(addr)}), nil
+	})
+
+	resp := c.sendBatch(&kv.Request{KeyRanges: buildKeyRanges("a", "z"), BatchCopCloseGracePeriod: 10 * time.Second})
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&sends) == 1
+	}, 5*time.Second, time.Millisecond)
+	start := time.Now()
+	require.NoError(t, resp.Close())
+	require.Less(t, time.Since(start), 10*time.Second)
+	// The in-flight response arrives within the grace period.
+	it := resp.(*batchCopIterator)
+	require.Len(t, it.respChan, 1)
+	require.Equal(t, []byte("tiflash0"), (<-it.respChan).GetData())
+}
+
+func TestBatchCopCloseGracePeriodSkipsQueuedTasks(t *testing.T) {
+	t.Parallel()
+	c := newBatchCopTestCluster(t, 1, "g", "n")
+	defer c.close()
+	var sends int32
+	c.client.setHandler(func(addr string, req *tikvrpc.Request) (*tikvrpc.Response, error) {
+		if req.Type != tikvrpc.CmdBatchCop {
+			return c.client.Client.SendRequest(context.Background(), addr, req, time.Second)
+		}
+		atomic.AddInt32(&sends, 1)
+		time.Sleep(50 * time.Millisecond)
+		return newBatchCopStreamResponse(&coprocessor.BatchResponse{Data: []byte(addr)}), nil
+	})
+
+	resp := c.sendBatchPerRegion(&kv.Request{KeyRanges: buildKeyRanges("a", "z"), Concurrency: 1, BatchCopCloseGracePeriod: 10 * time.Second})
+	require.Len(t, resp.(*batchCopIterator).tasks, 3)
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&sends) == 1
+	}, 5*time.Second, time.Millisecond)
+	start := time.Now()
+	require.NoError(t, resp.Close())
+	require.Less(t, time.Since(start), 10*time.Second)
+	// The task being sent finishes within the grace period, the queued ones are never sent.
+	require.Equal(t, int32(1), atomic.LoadInt32(&sends))
+}
+
+func TestBatchCopMemTracker(t *testing.T) {
+	t.Parallel()
+	c := newBatchCopTestCluster(t, 1)
+	defer c.close()
+	c.client.setHandler(func(addr string, req *tikvrpc.Request) (*tikvrpc.Response, error) {
+		return newBatchCopStreamResponse(
+			&coprocessor.BatchResponse{Data: make([]byte, 100)},
+			&coprocessor.BatchResponse{Data: make([]byte, 100)},
+		), nil
+	})
+
+	tracker := memory.NewTracker(0, -1)
+	resp := c.sendBatch(&kv.Request{KeyRanges: buildKeyRanges("a", "z"), MemTracker: tracker})
+	subset, err := resp.Next(context.Background())
+	require.NoError(t, err)
+	// The response handed to the caller is released, only the buffered one of the same size is tracked.
+	require.Eventually(t, func() bool {
+		return tracker.BytesConsumed() == subset.MemSize()
+	}, time.Second, 10*time.Millisecond)
+	_, err = readAllBatchCopResponses(t, resp)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), tracker.BytesConsumed())
+	require.NoError(t, resp.Close())
+
+	// Exceeding the quota cancels the query when the oom action is to cancel.
+	tracker = memory.NewTracker(0, 150)
+	tracker.SetActionOnExceed(&memory.PanicOnExceed{})
+	resp = c.sendBatch(&kv.Request{KeyRanges: buildKeyRanges("a", "z"), MemTracker: tracker})
+	_, err = readAllBatchCopResponses(t, resp)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), memory.PanicMemoryExceed)
+	require.NoError(t, resp.Close())
+	require.Equal(t, int64(0), tracker.BytesConsumed())
+}
+
+func TestBatchCopWorkerConcurrency(t *testing.T) {
+	t.Parallel()
+	require.Equal(t, 3, batchCopWorkerConcurrency(5, 3))
+	require.Equal(t, 2, batchCopWorkerConcurrency(2, 3))
+	require.Equal(t, 1, batchCopWorkerConcurrency(0, 1))
+	require.Equal(t, 0, batchCopWorkerConcurrency(2, 0))
+
+	c := newBatchCopTestCluster(t, 1, "c", "g", "m")
+	defer c.close()
+	var inflight, maxInflight int64
+	c.client.setHandler(func(addr string, req *tikvrpc.Request) (*tikvrpc.Response, error) {
+		cur := atomic.AddInt64(&inflight, 1)
+		defer atomic.AddInt64(&inflight, -1)
+		for {
+			max := atomic.LoadInt64(&maxInflight)
+			if cur <= max || atomic.CompareAndSwapInt64(&maxInflight, max, cur) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		return newBatchCopStreamResponse(&coprocessor.BatchResponse{Data: []byte(addr)}), nil
+	})
+
+	resp := c.sendBatchPerRegion(&kv.Request{KeyRanges: buildKeyRanges("a", "z"), KeepOrder: true, Concurrency: 2})
+	resps, err := readAllBatchCopResponses(t, resp)
+	require.NoError(t, err)
+	require.NoError(t, resp.Close())
+	require.Len(t, resps, 4)
+	require.LessOrEqual(t, atomic.LoadInt64(&maxInflight), int64(2))
+}
+
+func TestBatchCopRetryStaleRegionsOnly(t *testing.T) {
+	t.Parallel()
+	c := newBatchCopTestCluster(t, 1, "m")
+	defer c.close()
+	staleRegion, _ := c.cluster.GetRegion(c.regionIDs[1])
+	var mu sync.Mutex
+	var requested [][]uint64
+	c.client.setHandler(func(addr string, req *tikvrpc.Request) (*tikvrpc.Response, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		var regionIDs []uint64
+		for _, ri := range req.BatchCop().Regions {
+			regionIDs = append(regionIDs, ri.RegionId)
+		}
+		requested = append(requested, regionIDs)
+		if len(requested) == 1 {
+			return newBatchCopStreamResponse(
+				&coprocessor.BatchResponse{RetryRegions: []*metapb.Region{staleRegion}},
+				&coprocessor.BatchResponse{Data: []byte("first")},
+			), nil
+		}
+		return newBatchCopStreamResponse(&coprocessor.BatchResponse{Data: []byte("retried")}), nil
+	})
+
+	resp := c.sendBatch(&kv.Request{KeyRanges: buildKeyRanges("a", "z")})
+	resps, err := readAllBatchCopResponses(t, resp)
+	require.NoError(t, err)
+	require.NoError(t, resp.Close())
+	require.Len(t, resps, 2)
+	// The finished region is not requested again.
+	require.Equal(t, [][]uint64{c.regionIDs, {c.regionIDs[1]}}, requested)
+}
+
+func TestBuildBatchCopTasksRegionMissFailpoint(t *testing.T) {
+	c := newBatchCopTestCluster(t, 1, "m")
+	defer c.close()
+	const fpName = "github.com/pingcap/tidb/store/copr/mockBatchCopRegionMiss"
+	for _, rounds := range []int{1, 3} {
+		require.NoError(t, failpoint.Enable(fpName, fmt.Sprintf("return(%d)", rounds)))
+		retryReasons := &batchCopRetryReasons{}
+		bo := backoff.NewBackofferWithVars(context.Background(), 20000, nil)
+		tasks, err := buildBatchCopTasks(bo, c.store.kvStore, c.store.GetRegionCache(), buildCopRanges("a", "z"), kv.TiFlash, nil, 0, retryReasons, batchCopBuildOptions{})
+		require.NoError(t, failpoint.Disable(fpName))
+		require.NoError(t, err)
+		// Both regions are missed in each round, then they are found.
+		require.Equal(t, map[string]int{"region_miss": 2 * rounds}, retryReasons.snapshot())
+		require.Equal(t, c.regionIDs, regionIDsOfTasks(tasks))
+	}
+}
+
+// cancelingBatchCopRegionCache cancels the context once the TiFlash RPC contexts are got cancelAfter times.
+type cancelingBatchCopRegionCache struct {
+	*mockBatchCopRegionCache
+	cancel      context.CancelFunc
+	cancelAfter int
+	gets        int
+}
+
+func (c *cancelingBatchCopRegionCache) GetTiFlashRPCContext(bo *tikv.Backoffer, id tikv.RegionVerID, loadBalance bool) (*tikv.RPCContext, error) {
+	c.gets++
+	if c.gets == c.cancelAfter {
+		c.cancel()
+	}
+	return c.mockBatchCopRegionCache.GetTiFlashRPCContext(bo, id, loadBalance)
+}
+
+func TestBuildBatchCopTasksContextCanceled(t *testing.T) {
+	t.Parallel()
+	mock := newMockBatchCopRegionCache("m")
+	// The second region keeps missing, so the build never ends unless it's cancelled.
+	mock.missTimes[2] = 1 << 30
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cache := &cancelingBatchCopRegionCache{mockBatchCopRegionCache: mock, cancel: cancel, cancelAfter: 5}
+	bo := backoff.NewBackofferWithVars(ctx, 600000, nil)
+	start := time.Now()
+	_, err := buildBatchCopTasks(bo, nil, cache, buildCopRanges("a", "z"), kv.TiFlash, nil, 0, nil, batchCopBuildOptions{})
+	require.Equal(t, context.Canceled, errors.Cause(err))
+	require.Less(t, time.Since(start), 10*time.Second)
+	// The build stops in the round the context is cancelled.
+	require.Equal(t, 5, cache.gets)
+
+	// The build stops at the first region miss for a cancelled context.
+	cache.gets = 0
+	_, err = buildBatchCopTasks(bo, nil, cache, buildCopRanges("a", "z"), kv.TiFlash, nil, 0, nil, batchCopBuildOptions{})
+	require.Equal(t, context.Canceled, errors.Cause(err))
+	require.Equal(t, 2, cache.gets)
+}
+
+func TestBalanceBatchCopTaskStable(t *testing.T) {
+	t.Parallel()
+	newTasks := func() []*batchCopTask {
+		regionInfo := func(id uint64) RegionInfo {
+			return RegionInfo{Region: tikv.NewRegionVerID(id, 1, 1), AllStores: []uint64{id%3 + 1, (id+1)%3 + 1, (id+2)%3 + 1}}
+		}
+		tasks := []*batchCopTask{{storeAddr: "store1"}, {storeAddr: "store2"}, {storeAddr: "store3"}}
+		for id := uint64(0); id < 3; id++ {
+			tasks[id].regionInfos = append(tasks[id].regionInfos, regionInfo(id))
+		}
+		for id := uint64(3); id < 10; id++ {
+			tasks[0].regionInfos = append(tasks[0].regionInfos, regionInfo(id))
+		}
+		return tasks
+	}
+	expected := balanceBatchCopTask(context.Background(), nil, newTasks(), nil, 0)
+	for i := 0; i < 20; i++ {
+		balanced := balanceBatchCopTask(context.Background(), nil, newTasks(), nil, 0)
+		require.Len(t, balanced, len(expected))
+		for j := range balanced {
+			require.Equal(t, expected[j].storeAddr, balanced[j].storeAddr)
+			require.Equal(t, regionIDsOfTasks(expected[j:j+1]), regionIDsOfTasks(balanced[j:j+1]))
+		}
+	}
+	// The stores are sorted by id, and a tie is won by the store with the smaller id.
+	require.Len(t, expected, 3)
+	require.Equal(t, "store1", expected[0].storeAddr)
+	require.Equal(t, []uint64{0, 3, 7}, regionIDsOfTasks(expected[0:1]))
+	require.Equal(t, []uint64{1, 4, 8}, regionIDsOfTasks(expected[1:2]))
+	require.Equal(t, []uint64{2, 5, 6, 9}, regionIDsOfTasks(expected[2:3]))
+}
+
+func TestBatchCopResponseRegionIDs(t *testing.T) {
+	t.Parallel()
+	c := newBatchCopTestCluster(t, 1, "c", "m")
+	defer c.close()
+
+	// The regions of a multi-region task are all attributed to its responses.
+	resp := c.sendBatch(&kv.Request{KeyRanges: buildKeyRanges("a", "z")})
+	resps, err := readAllBatchCopResponses(t, resp)
+	require.NoError(t, err)
+	require.NoError(t, resp.Close())
+	require.Len(t, resps, 1)
+	regionIDs := resps[0].RegionIDs()
+	sort.Slice(regionIDs, func(i, j int) bool { return regionIDs[i] < regionIDs[j] })
+	require.Equal(t, c.regionIDs, regionIDs)
+	require.Nil(t, resps[0].RegionBytes())
+
+	// The attribution is exact when every region is a task.
+	resp = c.sendBatchPerRegion(&kv.Request{KeyRanges: buildKeyRanges("a", "z"), KeepOrder: true})
+	resps, err = readAllBatchCopResponses(t, resp)
+	require.NoError(t, err)
+	require.NoError(t, resp.Close())
+	require.Len(t, resps, 3)
+	for i, r := range resps {
+		require.Equal(t, []uint64{c.regionIDs[i]}, r.RegionIDs())
+		require.Equal(t, map[uint64]int64{c.regionIDs[i]: int64(len(r.GetData()))}, r.RegionBytes())
+	}
+}
+
+func TestBatchCopRegionImbalance(t *testing.T) {
+	newTask := func(addr string, regionNum int) *batchCopTask {
+		return &batchCopTask{storeAddr: addr, regionInfos: make([]RegionInfo, regionNum)}
+	}
+	require.Equal(t, 1.0, regionImbalanceRatio([]*batchCopTask{newTask("store1", 3)}))
+	require.Equal(t, 1.0, regionImbalanceRatio([]*batchCopTask{newTask("store1", 2), newTask("store2", 2)}))
+	// The mean is 4 regions per store, while store1 gets 10.
+	require.Equal(t, 2.5, regionImbalanceRatio([]*batchCopTask{newTask("store1", 10), newTask("store2", 1), newTask("store3", 1)}))
+	require.Equal(t, 1.0, regionImbalanceRatio([]*batchCopTask{newTask("store1", 0)}))
+
+	sampleCount := func() uint64 {
+		var m dto.Metric
+		require.NoError(t, tidbmetrics.BatchCopRegionImbalanceHistogram.Write(&m))
+		return m.GetHistogram().GetSampleCount()
+	}
+	before := sampleCount()
+	bo := backoff.NewBackofferWithVars(context.Background(), 3000, nil)
+	_, err := buildBatchCopTasks(bo, nil, newMockBatchCopRegionCache("g"), buildCopRanges("a", "z"), kv.TiFlash, nil, 0, nil, batchCopBuildOptions{})
+	require.NoError(t, err)
+	require.Equal(t, before+1, sampleCount())
+}
+
+func TestBatchCopWorkerPanic(t *testing.T) {
+	c := newBatchCopTestCluster(t, 2, "m")
+	defer c.close()
+	const fpName = "github.com/pingcap/tidb/store/copr/mockBatchCopTaskPanic"
+	require.NoError(t, failpoint.Enable(fpName, "return(true)"))
+	defer func() {
+		require.NoError(t, failpoint.Disable(fpName))
+	}()
+
+	tracker := memory.NewTracker(0, -1)
+	resp := c.sendBatch(&kv.Request{KeyRanges: buildKeyRanges("a", "z"), MemTracker: tracker})
+	_, err := readAllBatchCopResponses(t, resp)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "mock batch cop task panic")
+	// The responses left in the channel are drained once the workers exit.
+	it := resp.(*batchCopIterator)
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt64(&it.memConsumed) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, int64(0), tracker.BytesConsumed())
+	require.NoError(t, resp.Close())
+	require.Equal(t, int64(0), tracker.BytesConsumed())
+}
+
+func TestBatchCopReadTimeout(t *testing.T) {
+	t.Parallel()
+	c := newBatchCopTestCluster(t, 2)
+	defer c.close()
+
+	lastTimeout := func() time.Duration {
+		c.client.Lock()
+		defer c.client.Unlock()
+		return c.client.lastTimeout
+	}
+	resp := c.sendBatch(&kv.Request{KeyRanges: buildKeyRanges("a", "z")})
+	_, err := readAllBatchCopResponses(t, resp)
+	require.NoError(t, err)
+	require.NoError(t, resp.Close())
+	require.Equal(t, readTimeoutUltraLong, lastTimeout())
+
+	// The task on the timed out store is retried on the other one.
+	var timedOut int32
+	c.client.setHandler(func(addr string, req *tikvrpc.Request) (*tikvrpc.Response, error) {
+		if atomic.CompareAndSwapInt32(&timedOut, 0, 1) {
+			return nil, context.DeadlineExceeded
+		}
+		return newBatchCopStreamResponse(&coprocessor.BatchResponse{Data: []byte(addr)}), nil
+	})
+	resp = c.sendBatch(&kv.Request{KeyRanges: buildKeyRanges("a", "z"), TiFlashMaxExecutionTime: 2 * time.Second})
+	resps, err := readAllBatchCopResponses(t, resp)
+	require.NoError(t, err)
+	require.Len(t, resps, 1)
+	require.NoError(t, resp.Close())
+	require.Equal(t, 2*time.Second, lastTimeout())
+	require.Equal(t, int32(1), atomic.LoadInt32(&timedOut))
+}
+
+func TestBatchCopMaxTaskRebuilds(t *testing.T) {
+	t.Parallel()
+	c := newBatchCopTestCluster(t, 1, "m")
+	defer c.close()
+
+	var sent int32
+	c.client.setHandler(func(addr string, req *tikvrpc.Request) (*tikvrpc.Response, error) {
+		if req.Type != tikvrpc.CmdBatchCop {
+			return c.client.Client.SendRequest(context.Background(), addr, req, time.Second)
+		}
+		atomic.AddInt32(&sent, 1)
+		return nil, errors.New("mock tiflash failure")
+	})
+	resp := c.sendBatch(&kv.Request{KeyRanges: buildKeyRanges("a", "z"), BatchCopMaxTaskRebuilds: 2})
+	defer func() { require.NoError(t, resp.Close()) }()
+	_, err := readAllBatchCopResponses(t, resp)
+	require.Error(t, err)
+	rebuildErr, ok := errors.Cause(err).(*ErrBatchCopTooManyRebuilds)
+	require.True(t, ok)
+	require.Equal(t, 2, rebuildErr.Rebuilds)
+	require.Equal(t, c.regionIDs, rebuildErr.RegionIDs)
+	require.Equal(t, "tiflash0", rebuildErr.StoreAddr)
+	require.Contains(t, err.Error(), "last store: tiflash0")
+	// The task is sent once, then once more after each rebuild.
+	require.Equal(t, int32(3), atomic.LoadInt32(&sent))
+}
+
+func TestCoalesceKeyRanges(t *testing.T) {
+	t.Parallel()
+	require.Equal(t, buildKeyRanges("a", "f", "g", "h"), coalesceKeyRanges(buildKeyRanges("g", "h", "c", "e", "a", "c", "d", "f")))
+	require.Equal(t, buildKeyRanges("a", "f"), coalesceKeyRanges(buildKeyRanges("a", "f", "b", "c")))
+	require.Equal(t, buildKeyRanges("a", ""), coalesceKeyRanges(buildKeyRanges("b", "c", "a", "", "x", "z")))
+	require.Equal(t, buildKeyRanges("a", "b"), coalesceKeyRanges(buildKeyRanges("a", "b")))
+}
+
+func TestBatchCopRetryCoalesceRanges(t *testing.T) {
+	t.Parallel()
+	c := newBatchCopTestCluster(t, 1, "m")
+	defer c.close()
+
+	var (
+		mu     sync.Mutex
+		ranges [][]*coprocessor.KeyRange
+	)
+	c.client.setHandler(func(addr string, req *tikvrpc.Request) (*tikvrpc.Response, error) {
+		if req.Type != tikvrpc.CmdBatchCop {
+			return c.client.Client.SendRequest(context.Background(), addr, req, time.Second)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		ranges = append(ranges, req.BatchCop().Regions[0].Ranges)
+		if len(ranges) == 1 {
+			return nil, errors.New("mock tiflash failure")
+		}
+		return newBatchCopStreamResponse(&coprocessor.BatchResponse{Data: []byte(addr)}), nil
+	})
+	resp := c.sendBatch(&kv.Request{KeyRanges: buildKeyRanges("a", "c", "c", "e", "f", "g")})
+	_, err := readAllBatchCopResponses(t, resp)
+	require.NoError(t, err)
+	require.NoError(t, resp.Close())
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, ranges, 2)
+	require.Len(t, ranges[0], 3)
+	require.Equal(t, []*coprocessor.KeyRange{
+		{Start: []byte("a"), End: []byte("e")},
+		{Start: []byte("f"), End: []byte("g")},
+	}, ranges[1])
+}
+
+func TestBatchCopMaxRegionRetries(t *testing.T) {
+	t.Parallel()
+	c := newBatchCopTestCluster(t, 1, "m")
+	defer c.close()
+
+	var mu sync.Mutex
+	sent := make(map[uint64]int)
+	c.client.setHandler(func(addr string, req *tikvrpc.Request) (*tikvrpc.Response, error) {
+		if req.Type != tikvrpc.CmdBatchCop {
+			return c.client.Client.SendRequest(context.Background(), addr, req, time.Second)
+		}
+		regionID := req.BatchCop().Regions[0].RegionId
+		mu.Lock()
+		sent[regionID]++
+		mu.Unlock()
+		if regionID == c.regionIDs[1] {
+			return nil, errors.New("mock unstable region")
+		}
+		return newBatchCopStreamResponse(&coprocessor.BatchResponse{Data: []byte(addr)}), nil
+	})
+	// Each region is sent in its own task, so only the unstable region is retried.
+	resp := c.sendBatchPerRegion(&kv.Request{KeyRanges: buildKeyRanges("a", "z"), KeepOrder: true, BatchCopMaxRegionRetries: 2})
+	defer func() { require.NoError(t, resp.Close()) }()
+	_, err := readAllBatchCopResponses(t, resp)
+	require.Error(t, err)
+	retryErr, ok := errors.Cause(err).(*ErrBatchCopRegionTooManyRetries)
+	require.True(t, ok)
+	require.Equal(t, c.regionIDs[1], retryErr.RegionID)
+	require.Equal(t, 2, retryErr.Retries)
+	require.Equal(t, []kv.KeyRange{{StartKey: kv.Key("m"), EndKey: kv.Key("z")}}, retryErr.Ranges)
+	require.Contains(t, err.Error(), fmt.Sprintf("region %d is retried 2 times", c.regionIDs[1]))
+
+	mu.Lock()
+	defer mu.Unlock()
+	// The retry counts survive the rebuilds: the region is sent once, then once more after each retry.
+	require.Equal(t, 3, sent[c.regionIDs[1]])
+	require.Equal(t, 1, sent[c.regionIDs[0]])
+}
+
+func TestBatchCopMaxSendAttempts(t *testing.T) {
+	t.Parallel()
+	c := newBatchCopTestCluster(t, 1, "m")
+	defer c.close()
+
+	var sent int32
+	c.client.setHandler(func(addr string, req *tikvrpc.Request) (*tikvrpc.Response, error) {
+		if req.Type != tikvrpc.CmdBatchCop {
+			return c.client.Client.SendRequest(context.Background(), addr, req, time.Second)
+		}
+		atomic.AddInt32(&sent, 1)
+		return nil, errors.New("mock tiflash failure")
+	})
+	resp := c.sendBatch(&kv.Request{KeyRanges: buildKeyRanges("a", "z"), BatchCopMaxSendAttempts: 3})
+	defer func() { require.NoError(t, resp.Close()) }()
+	_, err := readAllBatchCopResponses(t, resp)
+	require.Error(t, err)
+	attemptsErr, ok := errors.Cause(err).(*ErrBatchCopSendAttemptsExceeded)
+	require.True(t, ok)
+	require.Equal(t, 3, attemptsErr.Attempts)
+	require.Equal(t, "tiflash0", attemptsErr.Addr)
+	require.Contains(t, err.Error(), "batch cop request is sent 3 times, last store: tiflash0, last error: mock tiflash failure")
+	// The sends of the rebuilt tasks are counted, so the task stops well before the rebuild limit.
+	require.Equal(t, int32(3), atomic.LoadInt32(&sent))
+}
+
+func TestBatchCopAuditHook(t *testing.T) {
+	t.Parallel()
+	c := newBatchCopTestCluster(t, 1, "m")
+	defer c.close()
+	var (
+		mu      sync.Mutex
+		records []*BatchCopAuditRecord
+	)
+	client := c.store.GetClient().(*CopClient)
+	client.AuditHook = func(record *BatchCopAuditRecord) {
+		mu.Lock()
+		records = append(records, record)
+		mu.Unlock()
+	}
+
+	resp := c.sendBatchByClient(client, &kv.Request{
+		KeyRanges: buildKeyRanges("a", "z"),
+		StartTs:   42,
+		SchemaVar: 7,
+		Data:      []byte("secret plan"),
+	})
+	_, err := readAllBatchCopResponses(t, resp)
+	require.NoError(t, err)
+	require.NoError(t, resp.Close())
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, records, 1)
+	record := records[0]
+	require.Equal(t, "tiflash0", record.StoreAddr)
+	require.Equal(t, c.regionIDs, record.RegionIDs)
+	require.Equal(t, uint64(42), record.StartTs)
+	require.Equal(t, int64(7), record.SchemaVer)
+	// The data is only exposed as its hash.
+	require.Equal(t, "c894e0fb797a615a884a512483766f2a0a98c0dde0b27ef48a6dbd01e8780c05", record.DataHash)
+}
+
+func TestBatchCopBalanceHook(t *testing.T) {
+	c := newBatchCopTestCluster(t, 2, "g", "n", "t")
+	defer c.close()
+
+	var (
+		mu       sync.Mutex
+		received = make(map[string][]uint64)
+		failed   bool
+	)
+	c.client.setHandler(func(addr string, req *tikvrpc.Request) (*tikvrpc.Response, error) {
+		if req.Type != tikvrpc.CmdBatchCop {
+			return c.client.Client.SendRequest(context.Background(), addr, req, time.Second)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, ri := range req.BatchCop().Regions {
+			received[addr] = append(received[addr], ri.RegionId)
+		}
+		if !failed {
+			failed = true
+			return nil, errors.New("mock tiflash failure")
+		}
+		return newBatchCopStreamResponse(&coprocessor.BatchResponse{Data: []byte(addr)}), nil
+	})
+
+	// The hook puts all the regions into the task of the last store, the first send to it fails.
+	var hooked int32
+	client := c.store.GetClient().(*CopClient)
+	client.BalanceHook = func(tasks []*batchCopTask) []*batchCopTask {
+		atomic.AddInt32(&hooked, 1)
+		sort.Slice(tasks, func(i, j int) bool { return tasks[i].storeAddr < tasks[j].storeAddr })
+		last := tasks[len(tasks)-1]
+		for _, task := range tasks[:len(tasks)-1] {
+			last.regionInfos = append(last.regionInfos, task.regionInfos...)
+		}
+		sort.Slice(last.regionInfos, func(i, j int) bool {
+			return last.regionInfos[i].Region.GetID() < last.regionInfos[j].Region.GetID()
+		})
+		return []*batchCopTask{last}
+	}
+	var killed uint32
+	req := &kv.Request{KeyRanges: buildKeyRanges("a", "z"), StoreType: kv.TiFlash, BatchCop: true}
+	resp := client.Send(context.Background(), req, kv.NewVariables(&killed), nil, false)
+	_, err := readAllBatchCopResponses(t, resp)
+	require.NoError(t, err)
+	require.NoError(t, resp.Close())
+
+	// The tasks rebuilt on retry go through the hook as well.
+	require.Equal(t, int32(2), atomic.LoadInt32(&hooked))
+	// Every send carries all the regions, the failed store is excluded from the rebuilt tasks.
+	mu.Lock()
+	require.Equal(t, map[string][]uint64{"tiflash0": c.regionIDs, "tiflash1": c.regionIDs}, received)
+	mu.Unlock()
+
+	// The tasks returned by the hook are verified if required.
+	client.BalanceHook = func(tasks []*batchCopTask) []*batchCopTask {
+		return nil
+	}
+	req.BatchCopVerifyCoverage = true
+	resp = client.Send(context.Background(), req, kv.NewVariables(&killed), nil, false)
+	_, err = resp.Next(context.Background())
+	require.Error(t, err)
+	_, ok := errors.Cause(err).(*ErrBatchCopCoverageHoles)
+	require.True(t, ok)
+}
+
+func TestBatchCopUnreachableStores(t *testing.T) {
+	t.Parallel()
+	c := newBatchCopTestCluster(t, 2)
+	defer c.close()
+
+	c.client.setHandler(func(addr string, req *tikvrpc.Request) (*tikvrpc.Response, error) {
+		if req.Type != tikvrpc.CmdBatchCop {
+			return c.client.Client.SendRequest(context.Background(), addr, req, time.Second)
+		}
+		return nil, errors.Errorf("mock %s unreachable", addr)
+	})
+	resp := c.sendBatch(&kv.Request{KeyRanges: buildKeyRanges("a", "z"), FailOnAllTiFlashReplicasFailed: true})
+	defer func() { require.NoError(t, resp.Close()) }()
+	_, err := readAllBatchCopResponses(t, resp)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unreachable TiFlash stores: [tiflash0 tiflash1]")
+	// The cause is still the original error.
+	_, ok := errors.Cause(err).(*ErrAllTiFlashReplicasFailed)
+	require.True(t, ok)
+	require.Equal(t, []string{"tiflash0", "tiflash1"}, resp.(*batchCopIterator).UnreachableStores())
+
+	// The error is left as it is if every store is reachable.
+	it := &batchCopIterator{}
+	err = errors.New("mock error")
+	require.Equal(t, err, it.withUnreachableStores(err))
+}
+
+func TestBatchCopTaskRetryCounter(t *testing.T) {
+	c := newBatchCopTestCluster(t, 1, "m")
+	defer c.close()
+	counter := func(typ string) float64 {
+		return testutil.ToFloat64(tidbmetrics.TiFlashBatchCopTaskRetryCounter.WithLabelValues("tiflash0", typ))
+	}
+	network, storeError := counter("network"), counter("store_error")
+
+	var sent int32
+	c.client.setHandler(func(addr string, req *tikvrpc.Request) (*tikvrpc.Response, error) {
+		if req.Type != tikvrpc.CmdBatchCop {
+			return c.client.Client.SendRequest(context.Background(), addr, req, time.Second)
+		}
+		switch atomic.AddInt32(&sent, 1) {
+		case 1:
+			return nil, status.Error(codes.Unavailable, "mock unreachable store")
+		case 2:
+			return nil, errors.New("mock tiflash failure")
+		}
+		return newBatchCopStreamResponse(&coprocessor.BatchResponse{Data: []byte(addr)}), nil
+	})
+	resp := c.sendBatch(&kv.Request{KeyRanges: buildKeyRanges("a", "z")})
+	_, err := readAllBatchCopResponses(t, resp)
+	require.NoError(t, err)
+	require.NoError(t, resp.Close())
+	require.Equal(t, network+1, counter("network"))
+	require.Equal(t, storeError+1, counter("store_error"))
+}
+
+func TestBatchCopStoreSendMetrics(t *testing.T) {
+	c := newBatchCopTestCluster(t, 2, "m")
+	defer c.close()
+	sampleCount := func(addr string) uint64 {
+		var m dto.Metric
+		require.NoError(t, tidbmetrics.TiFlashBatchCopSendHistogram.WithLabelValues(addr).(prometheus.Histogram).Write(&m))
+		return m.GetHistogram().GetSampleCount()
+	}
+	before := map[string]uint64{"tiflash0": sampleCount("tiflash0"), "tiflash1": sampleCount("tiflash1")}
+
+	var (
+		mu     sync.Mutex
+		sent   = make(map[string]uint64)
+		failed bool
+	)
+	c.client.setHandler(func(addr string, req *tikvrpc.Request) (*tikvrpc.Response, error) {
+		if req.Type != tikvrpc.CmdBatchCop {
+			return c.client.Client.SendRequest(context.Background(), addr, req, time.Second)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		sent[addr]++
+		if !failed {
+			failed = true
+			return nil, status.Error(codes.Unavailable, "mock unreachable store")
+		}
+		return newBatchCopStreamResponse(&coprocessor.BatchResponse{Data: []byte(addr)}), nil
+	})
+	resp := c.sendBatch(&kv.Request{KeyRanges: buildKeyRanges("a", "z")})
+	_, err := readAllBatchCopResponses(t, resp)
+	require.NoError(t, err)
+	require.NoError(t, resp.Close())
+
+	// Every send is recorded for the store it's sent to, including the failed one.
+	mu.Lock()
+	defer mu.Unlock()
+	var total uint64
+	for addr, n := range before {
+		require.Equal(t, n+sent[addr], sampleCount(addr))
+		total += sent[addr]
+	}
+	require.Greater(t, total, uint64(1))
+}
+
+func TestBatchCopSkipEmptyChunks(t *testing.T) {
+	t.Parallel()
+	c := newBatchCopTestCluster(t, 1, "m")
+	defer c.close()
+	c.client.setHandler(func(addr string, req *tikvrpc.Request) (*tikvrpc.Response, error) {
+		if req.Type != tikvrpc.CmdBatchCop {
+			return c.client.Client.SendRequest(context.Background(), addr, req, time.Second)
+		}
+		return newBatchCopStreamResponse(
+			&coprocessor.BatchResponse{Data: []byte("a")},
+			&coprocessor.BatchResponse{},
+			&coprocessor.BatchResponse{Data: []byte("b")},
+			&coprocessor.BatchResponse{},
+			&coprocessor.BatchResponse{},
+		), nil
+	})
+
+	for _, skip := range []bool{false, true} {
+		resp := c.sendBatch(&kv.Request{KeyRanges: buildKeyRanges("a", "z"), BatchCopSkipEmptyChunks: skip})
+		resps, err := readAllBatchCopResponses(t, resp)
+		require.NoError(t, err)
+		require.NoError(t, resp.Close())
+		var data []string
+		for _, r := range resps {
+			data = append(data, string(r.GetData()))
+		}
+		if skip {
+			require.Equal(t, []string{"a", "b"}, data)
+		} else {
+			require.Equal(t, []string{"a", "", "b", "", ""}, data)
+		}
+		// The empty chunks are counted either way.
+		require.Equal(t, 3, resp.(*batchCopIterator).EmptyChunks())
+	}
+}
+
+func TestBatchCopBackoffBudget(t *testing.T) {
+	t.Parallel()
+	var killed uint32
+	vars := kv.NewVariables(&killed)
+	require.Equal(t, copNextMaxBackoff, batchCopBackoffBudget(context.Background(), copNextMaxBackoff, vars))
+
+	// The budget is capped at the time left before the deadline, the backoff weight is taken into account.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	budget := batchCopBackoffBudget(ctx, copNextMaxBackoff, vars)
+	require.LessOrEqual(t, budget, 1000/vars.BackOffWeight)
+	require.Greater(t, budget, 0)
+	budget = batchCopBackoffBudget(ctx, copNextMaxBackoff, nil)
+	require.LessOrEqual(t, budget, 1000)
+	require.Greater(t, budget, 1000/vars.BackOffWeight)
+	// A longer deadline doesn't raise the budget.
+	longCtx, longCancel := context.WithTimeout(context.Background(), time.Hour)
+	defer longCancel()
+	require.Equal(t, copNextMaxBackoff, batchCopBackoffBudget(longCtx, copNextMaxBackoff, vars))
+	// The budget is never unlimited even if the deadline has passed.
+	expiredCtx, expiredCancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer expiredCancel()
+	require.Equal(t, 1, batchCopBackoffBudget(expiredCtx, copNextMaxBackoff, vars))
+
+	// The query fails once the budget is used up, rather than retrying until the statement times out.
+	c := newBatchCopTestCluster(t, 1)
+	defer c.close()
+	c.client.setHandler(func(addr string, req *tikvrpc.Request) (*tikvrpc.Response, error) {
+		if req.Type != tikvrpc.CmdBatchCop {
+			return c.client.Client.SendRequest(context.Background(), addr, req, time.Second)
+		}
+		return nil, errors.New("mock tiflash failure")
+	})
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	client := c.store.GetClient().(*CopClient)
+	resp := client.Send(ctx, &kv.Request{KeyRanges: buildKeyRanges("a", "z"), StoreType: kv.TiFlash, BatchCop: true}, vars, nil, false)
+	defer func() { require.NoError(t, resp.Close()) }()
+	_, err := readAllBatchCopResponses(t, resp)
+	require.Error(t, err)
+}
+
+func TestBatchCopBackoffSoftCap(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	it := &batchCopIterator{
+		req:         &kv.Request{},
+		finishCh:    make(chan struct{}),
+		respChan:    make(chan *batchCopResponse, 10),
+		metricLabel: "soft_cap",
+	}
+	it.log = zap.New(core)
+	counter := tidbmetrics.BatchCopBackoffSoftCapCounter.WithLabelValues("soft_cap")
+	before := testutil.ToFloat64(counter)
+	bo := backoff.NewBackofferWithVars(context.Background(), 1000, nil)
+	require.NoError(t, bo.Backoff(tikv.BoTiFlashRPC(), errors.New("mock tiflash failure")))
+	task := &batchCopTask{storeAddr: "tiflash0"}
+
+	// There is no soft cap by default.
+	require.NoError(t, it.handleBatchCopResponse(bo, &coprocessor.BatchResponse{Data: []byte("a")}, task))
+	require.Zero(t, logs.FilterMessage("batch cop backoff exceeds the soft cap").Len())
+
+	// The accumulated backoff exceeds the soft cap, the warning is logged only once for the query.
+	it.req.BatchCopBackoffSoftCap = time.Millisecond
+	require.NoError(t, it.handleBatchCopResponse(bo, &coprocessor.BatchResponse{Data: []byte("b")}, task))
+	require.NoError(t, it.handleBatchCopResponse(bo, &coprocessor.BatchResponse{Data: []byte("c")}, task))
+	entries := logs.FilterMessage("batch cop backoff exceeds the soft cap").All()
+	require.Len(t, entries, 1)
+	fields := entries[0].ContextMap()
+	require.Equal(t, "tiflash0", fields["storeAddr"])
+	require.Equal(t, time.Millisecond, fields["soft cap"])
+	require.Greater(t, fields["backoff"], time.Millisecond)
+	require.Equal(t, before+1, testutil.ToFloat64(counter))
+	// The query isn't failed by the soft cap.
+	require.Len(t, it.respChan, 3)
+}
+
+func TestBatchCopLazyBuild(t *testing.T) {
+	t.Parallel()
+	c := newBatchCopTestCluster(t, 1, "c", "e", "g", "i", "k", "m", "o")
+	defer c.close()
+	var sent int32
+	c.client.setHandler(func(addr string, req *tikvrpc.Request) (*tikvrpc.Response, error) {
+		if req.Type != tikvrpc.CmdBatchCop {
+			return c.client.Client.SendRequest(context.Background(), addr, req, time.Second)
+		}
+		atomic.AddInt32(&sent, 1)
+		regionID := req.BatchCop().Regions[0].RegionId
+		return newBatchCopStreamResponse(&coprocessor.BatchResponse{Data: []byte(fmt.Sprint(regionID))}), nil
+	})
+	readAll := func(lazyBuildRegions int) []string {
+		resp := c.sendBatchPerRegion(&kv.Request{KeyRanges: buildKeyRanges("a", "z"), KeepOrder: true, BatchCopLazyBuildRegions: lazyBuildRegions})
+		resps, err := readAllBatchCopResponses(t, resp)
+		require.NoError(t, err)
+		require.NoError(t, resp.Close())
+		var data []string
+		for _, r := range resps {
+			data = append(data, string(r.GetData()))
+		}
+		return data
+	}
+	// The results are the same no matter how the tasks are built.
+	eager := readAll(0)
+	require.Len(t, eager, len(c.regionIDs))
+	require.Equal(t, eager, readAll(2))
+
+	// The consumer stops after the first response, only the tasks of the first group are built and sent.
+	atomic.StoreInt32(&sent, 0)
+	resp := c.sendBatchPerRegion(&kv.Request{KeyRanges: buildKeyRanges("a", "z"), KeepOrder: true, BatchCopLazyBuildRegions: 2})
+	subset, err := resp.Next(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, eager[0], string(subset.GetData()))
+	require.NoError(t, resp.Close())
+	require.Equal(t, 2, resp.(*batchCopLazyIterator).builtTasks)
+	require.LessOrEqual(t, atomic.LoadInt32(&sent), int32(2))
+}
+
+func TestBatchCopCalleeStoreID(t *testing.T) {
+	t.Parallel()
+	c := newBatchCopTestCluster(t, 2, "g", "n")
+	defer c.close()
+	storeIDs := make(map[string]uint64)
+	for i, storeID := range c.tiflashStoreIDs {
+		storeIDs[fmt.Sprintf("tiflash%d", i)] = storeID
+	}
+	resp := c.sendBatch(&kv.Request{KeyRanges: buildKeyRanges("a", "z")})
+	resps, err := readAllBatchCopResponses(t, resp)
+	require.NoError(t, err)
+	require.NoError(t, resp.Close())
+	require.NotEmpty(t, resps)
+	for _, r := range resps {
+		detail := r.GetCopRuntimeStats()
+		require.Equal(t, storeIDs[detail.CalleeAddress], detail.CalleeStoreID)
+	}
+
+	// The requests failing on tiflash0 are retried on tiflash1, which serves all the responses.
+	c.client.setHandler(func(addr string, req *tikvrpc.Request) (*tikvrpc.Response, error) {
+		if req.Type != tikvrpc.CmdBatchCop {
+			return c.client.Client.SendRequest(context.Background(), addr, req, time.Second)
+		}
+		if addr == "tiflash0" {
+			return nil, errors.New("mock tiflash failure")
+		}
+		return newBatchCopStreamResponse(&coprocessor.BatchResponse{Data: []byte(addr)}), nil
+	})
+	resp = c.sendBatch(&kv.Request{KeyRanges: buildKeyRanges("a", "z")})
+	resps, err = readAllBatchCopResponses(t, resp)
+	require.NoError(t, err)
+	require.NoError(t, resp.Close())
+	require.NotEmpty(t, resps)
+	for _, r := range resps {
+		require.Equal(t, c.tiflashStoreIDs[1], r.GetCopRuntimeStats().CalleeStoreID)
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2021 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package copr
+
+import (
+	"time"
+
+	tidbmetrics "github.com/pingcap/tidb/metrics"
+)
+
+// MetricSink receives the metrics recorded by the batch cop. The label is the query label of the request, it's
+// empty or "other" if the label is not in the allowlist set by SetBatchCopMetricLabels.
+type MetricSink interface {
+	// ObserveBuildTasks records the duration of building the batch cop tasks, buildType is "cold" or "warm".
+	ObserveBuildTasks(buildType string, d time.Duration)
+	// ObserveRegionImbalance records the imbalance ratio of the regions among the built tasks.
+	ObserveRegionImbalance(ratio float64)
+	// ObserveSend records the duration of sending a batch cop request.
+	ObserveSend(label string, d time.Duration)
+	// ObserveStoreSend records the duration of a single send of a batch cop request to the store.
+	ObserveStoreSend(storeAddr string, d time.Duration)
+	// AddResponseBytes records the memory size of a received batch cop response.
+	AddResponseBytes(label string, bytes int64)
+	// IncRetry records a batch cop task retried due to the store error.
+	IncRetry(label string, storeAddr string, failType string)
+	// IncNonPreferredStore records a batch cop task routed to a non-preferred store of its regions.
+	IncNonPreferredStore(label string)
+	// IncBackoffSoftCap records a batch cop request whose backoff exceeds the soft cap.
+	IncBackoffSoftCap(label string)
+}
+
+type prometheusMetricSink struct{}
+
+// NewPrometheusMetricSink returns a sink writing to the Prometheus metrics registered by TiDB.
+func NewPrometheusMetricSink() MetricSink {
+	return prometheusMetricSink{}
+}
+
+func (prometheusMetricSink) ObserveBuildTasks(buildType string, d time.Duration) {
+	tidbmetrics.BatchCopBuildTaskHistogram.WithLabelValues(buildType).Observe(d.Seconds())
+}
+
+func (prometheusMetricSink) ObserveRegionImbalance(ratio float64) {
+	tidbmetrics.BatchCopRegionImbalanceHistogram.Observe(ratio)
+}
+
+func (prometheusMetricSink) ObserveSend(label string, d time.Duration) {
+	tidbmetrics.BatchCopSendHistogram.WithLabelValues(label).Observe(d.Seconds())
+}
+
+func (prometheusMetricSink) ObserveStoreSend(storeAddr string, d time.Duration) {
+	tidbmetrics.TiFlashBatchCopSendHistogram.WithLabelValues(storeAddr).Observe(d.Seconds())
+}
+
+func (prometheusMetricSink) AddResponseBytes(label string, bytes int64) {
+	tidbmetrics.BatchCopResponseBytesCounter.WithLabelValues(label).Add(float64(bytes))
+}
+
+func (prometheusMetricSink) IncRetry(label string, storeAddr string, failType string) {
+	tidbmetrics.BatchCopRetryCounter.WithLabelValues(label).Inc()
+	tidbmetrics.TiFlashBatchCopTaskRetryCounter.WithLabelValues(storeAddr, failType).Inc()
+}
+
+func (prometheusMetricSink) IncNonPreferredStore(label string) {
+	tidbmetrics.BatchCopNonPreferredStoreCounter.WithLabelValues(label).Inc()
+}
+
+func (prometheusMetricSink) IncBackoffSoftCap(label string) {
+	tidbmetrics.BatchCopBackoffSoftCapCounter.WithLabelValues(label).Inc()
+}
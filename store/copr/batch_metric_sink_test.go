@@ -0,0 +1,137 @@
+// Copyright 2021 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package copr
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pingcap/kvproto/pkg/coprocessor"
+	"github.com/pingcap/tidb/kv"
+	"github.com/stretchr/testify/require"
+	"github.com/tikv/client-go/v2/tikvrpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeMetricSink captures the recorded metrics in memory.
+type fakeMetricSink struct {
+	mu            sync.Mutex
+	buildTypes    []string
+	imbalances    int
+	sends         map[string]int
+	storeSends    map[string]int
+	responseBytes map[string]int64
+	retries       []string
+	nonPreferred  int
+	backoffCapped int
+}
+
+func newFakeMetricSink() *fakeMetricSink {
+	return &fakeMetricSink{
+		sends:         make(map[string]int),
+		storeSends:    make(map[string]int),
+		responseBytes: make(map[string]int64),
+	}
+}
+
+func (s *fakeMetricSink) ObserveBuildTasks(buildType string, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buildTypes = append(s.buildTypes, buildType)
+}
+
+func (s *fakeMetricSink) ObserveRegionImbalance(ratio float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.imbalances++
+}
+
+func (s *fakeMetricSink) ObserveSend(label string, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sends[label]++
+}
+
+func (s *fakeMetricSink) ObserveStoreSend(storeAddr string, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.storeSends[storeAddr]++
+}
+
+func (s *fakeMetricSink) AddResponseBytes(label string, bytes int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.responseBytes[label] += bytes
+}
+
+func (s *fakeMetricSink) IncRetry(label string, storeAddr string, failType string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.retries = append(s.retries, label+"/"+storeAddr+"/"+failType)
+}
+
+func (s *fakeMetricSink) IncNonPreferredStore(label string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nonPreferred++
+}
+
+func (s *fakeMetricSink) IncBackoffSoftCap(label string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.backoffCapped++
+}
+
+func TestBatchCopMetricSink(t *testing.T) {
+	SetBatchCopMetricLabels([]string{"tenant-779"})
+	defer SetBatchCopMetricLabels(nil)
+
+	c := newBatchCopTestCluster(t, 1, "m")
+	defer c.close()
+	sink := newFakeMetricSink()
+	c.store.metricSink = sink
+	var sent int32
+	c.client.setHandler(func(addr string, req *tikvrpc.Request) (*tikvrpc.Response, error) {
+		if req.Type != tikvrpc.CmdBatchCop {
+			return c.client.Client.SendRequest(context.Background(), addr, req, time.Second)
+		}
+		if atomic.AddInt32(&sent, 1) == 1 {
+			return nil, status.Error(codes.Unavailable, "mock unreachable store")
+		}
+		return newBatchCopStreamResponse(&coprocessor.BatchResponse{Data: []byte("data")}), nil
+	})
+	resp := c.sendBatch(&kv.Request{KeyRanges: buildKeyRanges("a", "z"), MetricLabel: "tenant-779"})
+	resps, err := readAllBatchCopResponses(t, resp)
+	require.NoError(t, err)
+	require.NoError(t, resp.Close())
+	require.Len(t, resps, 1)
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	// The tasks are built for the request and rebuilt for the retry.
+	require.Len(t, sink.buildTypes, 2)
+	require.Equal(t, 2, sink.imbalances)
+	require.Equal(t, map[string]int{"tenant-779": 2}, sink.sends)
+	// Both the failed send and the successful one are recorded for the store.
+	require.Equal(t, map[string]int{"tiflash0": 2}, sink.storeSends)
+	require.Equal(t, []string{"tenant-779/tiflash0/network"}, sink.retries)
+	require.Equal(t, map[string]int64{"tenant-779": resps[0].MemSize()}, sink.responseBytes)
+	require.Equal(t, 0, sink.nonPreferred)
+	require.Equal(t, 0, sink.backoffCapped)
+}
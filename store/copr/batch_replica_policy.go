@@ -0,0 +1,235 @@
+// Copyright 2021 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package copr
+
+import (
+	"math/rand"
+	"sync"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/tikv/client-go/v2/tikv"
+)
+
+// ReplicaSelectPolicy chooses a store among the equally viable replica stores of a region
+// when the batch cop tasks are rebuilt on retry.
+type ReplicaSelectPolicy interface {
+	// Select returns one of the candidate store ids, candidates is never empty.
+	Select(candidates []uint64) uint64
+	// OnFail is called when a request to the store fails.
+	OnFail(storeID uint64)
+}
+
+// NewReplicaSelectPolicy returns the policy of the name set by kv.Request.BatchCopReplicaSelectPolicy, it's
+// nil for "none" and the unknown names, then the rebuilt tasks are kept as they are balanced. The policy
+// remembers the failures of the stores, so each request uses its own one.
+func NewReplicaSelectPolicy(name string) ReplicaSelectPolicy {
+	switch name {
+	case "random":
+		return NewRandomReplicaSelectPolicy()
+	case "round-robin":
+		return NewRoundRobinReplicaSelectPolicy()
+	case "least-recently-failed":
+		return NewLeastRecentlyFailedReplicaSelectPolicy()
+	default:
+		return nil
+	}
+}
+
+type randomReplicaSelectPolicy struct{}
+
+// NewRandomReplicaSelectPolicy returns a policy selecting a random replica.
+func NewRandomReplicaSelectPolicy() ReplicaSelectPolicy {
+	return randomReplicaSelectPolicy{}
+}
+
+func (randomReplicaSelectPolicy) Select(candidates []uint64) uint64 {
+	/* #nosec G404 */
+	return candidates[rand.Intn(len(candidates))]
+}
+
+func (randomReplicaSelectPolicy) OnFail(uint64) {}
+
+type roundRobinReplicaSelectPolicy struct {
+	mu   sync.Mutex
+	next int
+}
+
+// NewRoundRobinReplicaSelectPolicy returns a policy selecting the replicas in turn.
+func NewRoundRobinReplicaSelectPolicy() ReplicaSelectPolicy {
+	return &roundRobinReplicaSelectPolicy{}
+}
+
+func (p *roundRobinReplicaSelectPolicy) Select(candidates []uint64) uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	storeID := candidates[p.next%len(candidates)]
+	p.next++
+	return storeID
+}
+
+func (p *roundRobinReplicaSelectPolicy) OnFail(uint64) {}
+
+type leastRecentlyFailedReplicaSelectPolicy struct {
+	mu sync.Mutex
+	// failSeq records the sequence number of the last failure of each store, a bigger one fails more recently.
+	failSeq map[uint64]uint64
+	seq     uint64
+}
+
+// NewLeastRecentlyFailedReplicaSelectPolicy returns a policy selecting the replica which fails least recently,
+// the replicas that never fail are preferred.
+func NewLeastRecentlyFailedReplicaSelectPolicy() ReplicaSelectPolicy {
+	return &leastRecentlyFailedReplicaSelectPolicy{failSeq: make(map[uint64]uint64)}
+}
+
+func (p *leastRecentlyFailedReplicaSelectPolicy) Select(candidates []uint64) uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	selected := candidates[0]
+	for _, storeID := range candidates[1:] {
+		if p.failSeq[storeID] < p.failSeq[selected] {
+			selected = storeID
+		}
+	}
+	return selected
+}
+
+func (p *leastRecentlyFailedReplicaSelectPolicy) OnFail(storeID uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.seq++
+	p.failSeq[storeID] = p.seq
+}
+
+// selectReplicas reassigns the regions of the tasks to the stores chosen by the policy. The first region
+// of each task stays with its task because the rpc context of the task is related to it, the other regions
+// can move to any task whose store holds a replica of the region. The tasks are kept as they are if some
+// task has no region or its first region has no store.
+func selectReplicas(tasks []*batchCopTask, policy ReplicaSelectPolicy) []*batchCopTask {
+	for _, task := range tasks {
+		if len(task.regionInfos) == 0 || len(task.regionInfos[0].AllStores) == 0 {
+			return tasks
+		}
+	}
+	storeTasks := make(map[uint64]*batchCopTask, len(tasks))
+	newTasks := make([]*batchCopTask, 0, len(tasks))
+	for _, task := range tasks {
+		newTask := &batchCopTask{
+			storeAddr:   task.storeAddr,
+			cmdType:     task.cmdType,
+			ctx:         task.ctx,
+			regionInfos: []RegionInfo{task.regionInfos[0]},
+		}
+		storeTasks[task.regionInfos[0].AllStores[0]] = newTask
+		newTasks = append(newTasks, newTask)
+	}
+	for i, task := range tasks {
+		for _, ri := range task.regionInfos[1:] {
+			candidates := make([]uint64, 0, len(ri.AllStores))
+			for _, storeID := range ri.AllStores {
+				if _, ok := storeTasks[storeID]; ok {
+					candidates = append(candidates, storeID)
+				}
+			}
+			switch len(candidates) {
+			case 0:
+				newTasks[i].regionInfos = append(newTasks[i].regionInfos, ri)
+			case 1:
+				storeTasks[candidates[0]].regionInfos = append(storeTasks[candidates[0]].regionInfos, ri)
+			default:
+				storeID := policy.Select(candidates)
+				storeTasks[storeID].regionInfos = append(storeTasks[storeID].regionInfos, ri)
+			}
+		}
+	}
+	return newTasks
+}
+
+// StoreRolePreference decides which TiFlash stores are preferred by the role of their peers when the batch
+// cop tasks are built, it's set by kv.Request.BatchCopStoreRolePreference. The other stores are only used when
+// none of the stores of a region has the preferred role.
+type StoreRolePreference string
+
+const (
+	// StoreRolePreferNone doesn't prefer any role.
+	StoreRolePreferNone StoreRolePreference = "none"
+	// StoreRolePreferVoter prefers the stores whose peers aren't learners, they are less likely to lag.
+	StoreRolePreferVoter StoreRolePreference = "voter"
+	// StoreRolePreferLearner prefers the stores whose peers are learners.
+	StoreRolePreferLearner StoreRolePreference = "learner"
+)
+
+// isNone checks whether no role is preferred, the empty and unknown preferences are the same as
+// StoreRolePreferNone.
+func (p StoreRolePreference) isNone() bool {
+	return p != StoreRolePreferVoter && p != StoreRolePreferLearner
+}
+
+func (p StoreRolePreference) prefers(role metapb.PeerRole) bool {
+	switch p {
+	case StoreRolePreferVoter:
+		return role != metapb.PeerRole_Learner
+	case StoreRolePreferLearner:
+		return role == metapb.PeerRole_Learner
+	default:
+		return true
+	}
+}
+
+// prefersStore checks whether the peer of the region on the store has the preferred role, the store
+// without a peer of the region isn't preferred.
+func (p StoreRolePreference) prefersStore(meta *metapb.Region, storeID uint64) bool {
+	for _, peer := range meta.GetPeers() {
+		if peer.GetStoreId() == storeID {
+			return p.prefers(peer.GetRole())
+		}
+	}
+	return false
+}
+
+// preferRPCContextByRole switches the rpc context of the region to a store with the preferred role, it
+// keeps rpcCtx if there is no such store.
+func preferRPCContextByRole(bo *Backoffer, cache batchCopRegionCache, region tikv.RegionVerID, rpcCtx *tikv.RPCContext, preference StoreRolePreference) (*tikv.RPCContext, error) {
+	if preference.isNone() || preference.prefers(rpcCtx.Peer.GetRole()) {
+		return rpcCtx, nil
+	}
+	// Each load balanced rpc context is on the next TiFlash store of the region.
+	for i := 0; i < len(rpcCtx.Meta.GetPeers()); i++ {
+		next, err := cache.GetTiFlashRPCContext(bo.TiKVBackoffer(), region, true)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if next != nil && preference.prefers(next.Peer.GetRole()) {
+			return next, nil
+		}
+	}
+	return rpcCtx, nil
+}
+
+// preferStoresByRole keeps the stores with the preferred role, the first one is the current store of the
+// region. The stores are kept as they are if the current store isn't preferred.
+func preferStoresByRole(stores []uint64, meta *metapb.Region, preference StoreRolePreference) []uint64 {
+	if preference.isNone() || len(stores) == 0 || !preference.prefersStore(meta, stores[0]) {
+		return stores
+	}
+	preferred := make([]uint64, 0, len(stores))
+	for _, storeID := range stores {
+		if preference.prefersStore(meta, storeID) {
+			preferred = append(preferred, storeID)
+		}
+	}
+	return preferred
+}
@@ -0,0 +1,88 @@
+// Copyright 2021 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package copr
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tikv/client-go/v2/tikv"
+)
+
+func TestReplicaSelectPolicy(t *testing.T) {
+	t.Parallel()
+	candidates := []uint64{1, 2, 3}
+
+	random := NewRandomReplicaSelectPolicy()
+	for i := 0; i < 10; i++ {
+		require.Contains(t, candidates, random.Select(candidates))
+	}
+
+	roundRobin := NewRoundRobinReplicaSelectPolicy()
+	var selected []uint64
+	for i := 0; i < 4; i++ {
+		selected = append(selected, roundRobin.Select(candidates))
+	}
+	require.Equal(t, []uint64{1, 2, 3, 1}, selected)
+
+	lrf := NewLeastRecentlyFailedReplicaSelectPolicy()
+	require.Equal(t, uint64(1), lrf.Select(candidates))
+	lrf.OnFail(1)
+	lrf.OnFail(3)
+	require.Equal(t, uint64(2), lrf.Select(candidates))
+	lrf.OnFail(2)
+	require.Equal(t, uint64(1), lrf.Select(candidates))
+	lrf.OnFail(1)
+	require.Equal(t, uint64(3), lrf.Select(candidates))
+
+	require.IsType(t, randomReplicaSelectPolicy{}, NewReplicaSelectPolicy("random"))
+	require.IsType(t, &roundRobinReplicaSelectPolicy{}, NewReplicaSelectPolicy("round-robin"))
+	require.IsType(t, &leastRecentlyFailedReplicaSelectPolicy{}, NewReplicaSelectPolicy("least-recently-failed"))
+	require.Nil(t, NewReplicaSelectPolicy("none"))
+	require.Nil(t, NewReplicaSelectPolicy(""))
+	// Each policy has its own failure history.
+	require.Equal(t, uint64(1), NewReplicaSelectPolicy("least-recently-failed").Select(candidates))
+}
+
+func TestSelectReplicas(t *testing.T) {
+	t.Parallel()
+	regionInfo := func(id uint64, stores ...uint64) RegionInfo {
+		return RegionInfo{Region: tikv.NewRegionVerID(id, 1, 1), AllStores: stores}
+	}
+	tasks := []*batchCopTask{
+		{storeAddr: "store1", regionInfos: []RegionInfo{regionInfo(1, 1, 2), regionInfo(3, 1, 2), regionInfo(4, 1)}},
+		{storeAddr: "store2", regionInfos: []RegionInfo{regionInfo(2, 2, 1), regionInfo(5, 2, 1)}},
+	}
+	tasks = selectReplicas(tasks, NewRoundRobinReplicaSelectPolicy())
+	require.Len(t, tasks, 2)
+	// Region 3 selects store 1, then region 5 selects store 1 in turn.
+	require.Equal(t, []uint64{1, 3, 4, 5}, regionIDsOfTasks(tasks[:1]))
+	require.Equal(t, []uint64{2}, regionIDsOfTasks(tasks[1:]))
+
+	lrf := NewLeastRecentlyFailedReplicaSelectPolicy()
+	lrf.OnFail(1)
+	tasks = selectReplicas(tasks, lrf)
+	require.Equal(t, []uint64{1, 4}, regionIDsOfTasks(tasks[:1]))
+	require.Equal(t, []uint64{2, 3, 5}, regionIDsOfTasks(tasks[1:]))
+
+	// The tasks are kept if the first region of some task has no store.
+	tasks = []*batchCopTask{
+		{storeAddr: "store1", regionInfos: []RegionInfo{regionInfo(1, 1, 2), regionInfo(3, 1, 2)}},
+		{storeAddr: "store2", regionInfos: []RegionInfo{regionInfo(2)}},
+	}
+	require.Equal(t, tasks, selectReplicas(tasks, NewRoundRobinReplicaSelectPolicy()))
+	tasks = []*batchCopTask{{storeAddr: "store1"}}
+	require.Equal(t, tasks, selectReplicas(tasks, NewRoundRobinReplicaSelectPolicy()))
+}
@@ -16,6 +16,7 @@ package copr
 
 import (
 	"context"
+	"fmt"
 	"time"
 
 	"github.com/pingcap/errors"
@@ -33,23 +34,72 @@ type RegionInfo struct {
 	Meta      *metapb.Region
 	Ranges    *KeyRanges
 	AllStores []uint64
+	// EstRows is the estimated number of rows of the region, it's 0 if it's unknown.
+	EstRows int64
+}
+
+// NewAddrAllowlistValidator returns a validator that only accepts the given addresses.
+func NewAddrAllowlistValidator(addrs []string) func(addr string) error {
+	allowlist := make(map[string]struct{}, len(addrs))
+	for _, addr := range addrs {
+		allowlist[addr] = struct{}{}
+	}
+	return func(addr string) error {
+		if _, ok := allowlist[addr]; !ok {
+			return errors.Errorf("store address %s is not in the allowlist", addr)
+		}
+		return nil
+	}
+}
+
+// ErrBatchCopSendAttemptsExceeded is returned when a request fails to be sent and
+// kv.Request.BatchCopMaxSendAttempts is reached.
+type ErrBatchCopSendAttemptsExceeded struct {
+	Attempts int
+	// Addr is the address of the store the request is sent to last.
+	Addr string
+	Err  error
+}
+
+func (e *ErrBatchCopSendAttemptsExceeded) Error() string {
+	return fmt.Sprintf("batch cop request is sent %d times, last store: %s, last error: %v", e.Attempts, e.Addr, e.Err)
 }
 
 // RegionBatchRequestSender sends BatchCop requests to TiFlash server by stream way.
 type RegionBatchRequestSender struct {
 	*tikv.RegionRequestSender
+	// onSendFail is called with the store address when a request fails to be sent, it's nil by default.
+	onSendFail func(addr string)
+	// addrValidator validates the store address before a request is sent to it, the request is rejected when it
+	// returns an error. It's nil by default, which means no validation.
+	addrValidator func(addr string) error
+	// metricSink receives the send duration of each request.
+	metricSink MetricSink
+	// maxSendAttempts is the max number of the requests sent by the sender, a failed send isn't retried once
+	// it's reached. `0` means no limit.
+	maxSendAttempts int
+	// sendAttempts is the number of the requests sent by the sender.
+	sendAttempts int
+	// storeID is the id of the store the last request is sent to successfully.
+	storeID uint64
 }
 
 // NewRegionBatchRequestSender creates a RegionBatchRequestSender object.
 func NewRegionBatchRequestSender(cache *RegionCache, client tikv.Client) *RegionBatchRequestSender {
 	return &RegionBatchRequestSender{
 		RegionRequestSender: tikv.NewRegionRequestSender(cache.RegionCache, client),
+		metricSink:          NewPrometheusMetricSink(),
 	}
 }
 
 // SendReqToAddr send batch cop request
 func (ss *RegionBatchRequestSender) SendReqToAddr(bo *Backoffer, rpcCtx *tikv.RPCContext, regionInfos []RegionInfo, req *tikvrpc.Request, timout time.Duration) (resp *tikvrpc.Response, retry bool, cancel func(), err error) {
 	cancel = func() {}
+	if ss.addrValidator != nil {
+		if e := ss.addrValidator(rpcCtx.Addr); e != nil {
+			return nil, false, cancel, errors.Trace(e)
+		}
+	}
 	if e := tikvrpc.SetContext(req, rpcCtx.Meta, rpcCtx.Peer); e != nil {
 		return nil, false, cancel, errors.Trace(e)
 	}
@@ -58,10 +108,13 @@ func (ss *RegionBatchRequestSender) SendReqToAddr(bo *Backoffer, rpcCtx *tikv.RP
 		ctx, cancel = rawHook.(*tikv.RPCCanceller).WithCancel(ctx)
 	}
 	start := time.Now()
+	ss.sendAttempts++
 	resp, err = ss.GetClient().SendRequest(ctx, rpcCtx.Addr, req, timout)
+	elapsed := time.Since(start)
 	if ss.Stats != nil {
-		tikv.RecordRegionRequestRuntimeStats(ss.Stats, req.Type, time.Since(start))
+		tikv.RecordRegionRequestRuntimeStats(ss.Stats, req.Type, elapsed)
 	}
+	ss.metricSink.ObserveStoreSend(rpcCtx.Addr, elapsed)
 	if err != nil {
 		cancel()
 		ss.SetRPCError(err)
@@ -71,10 +124,20 @@ func (ss *RegionBatchRequestSender) SendReqToAddr(bo *Backoffer, rpcCtx *tikv.RP
 		}
 		return nil, true, func() {}, nil
 	}
+	ss.storeID = 0
+	if rpcCtx.Store != nil {
+		ss.storeID = rpcCtx.Store.StoreID()
+	}
 	// We don't need to process region error or lock error. Because TiFlash will retry by itself.
 	return
 }
 
+// StoreID returns the id of the store which serves the last request sent successfully, the requests may be
+// retried on other stores before that. It's 0 if the store is unknown.
+func (ss *RegionBatchRequestSender) StoreID() uint64 {
+	return ss.storeID
+}
+
 func (ss *RegionBatchRequestSender) onSendFailForBatchRegions(bo *Backoffer, ctx *tikv.RPCContext, regionInfos []RegionInfo, err error) error {
 	// If it failed because the context is cancelled by ourself, don't retry.
 	if errors.Cause(err) == context.Canceled || status.Code(errors.Cause(err)) == codes.Canceled {
@@ -82,19 +145,23 @@ func (ss *RegionBatchRequestSender) onSendFailForBatchRegions(bo *Backoffer, ctx
 	} else if tikv.LoadShuttingDown() > 0 {
 		return tikverr.ErrTiDBShuttingDown
 	}
+	if ss.onSendFail != nil {
+		ss.onSendFail(ctx.Addr)
+	}
 
 	// The reload region param is always true. Because that every time we try, we must
 	// re-build the range then re-create the batch sender. As a result, the len of "failStores"
 	// will change. If tiflash's replica is more than two, the "reload region" will always be false.
 	// Now that the batch cop and mpp has a relative low qps, it's reasonable to reload every time
 	// when meeting io error.
-	rc := RegionCache{ss.GetRegionCache()}
+	rc := RegionCache{RegionCache: ss.GetRegionCache()}
 	rc.OnSendFailForBatchRegions(bo, ctx.Store, regionInfos, true, err)
 
+	if ss.maxSendAttempts > 0 && ss.sendAttempts >= ss.maxSendAttempts {
+		return &ErrBatchCopSendAttemptsExceeded{Attempts: ss.sendAttempts, Addr: ctx.Addr, Err: err}
+	}
 	// Retry on send request failure when it's not canceled.
 	// When a store is not available, the leader of related region should be elected quickly.
-	// TODO: the number of retry time should be limited:since region may be unavailable
-	// when some unrecoverable disaster happened.
 	err = bo.Backoff(tikv.BoTiFlashRPC(), errors.Errorf("send request error: %v, ctx: %v, regionInfos: %v", err, ctx, regionInfos))
 	return errors.Trace(err)
 }
@@ -0,0 +1,71 @@
+// Copyright 2021 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package copr
+
+import (
+	"time"
+)
+
+// clock is the source of time of the batch cop, tests can replace it to control the time deterministically.
+type clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	NewTicker(d time.Duration) clockTimer
+	NewTimer(d time.Duration) clockTimer
+}
+
+// clockTimer is a ticker or a timer created by a clock.
+type clockTimer interface {
+	Chan() <-chan time.Time
+	Stop()
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Since(t time.Time) time.Duration {
+	return time.Since(t)
+}
+
+func (realClock) NewTicker(d time.Duration) clockTimer {
+	return realTicker{time.NewTicker(d)}
+}
+
+func (realClock) NewTimer(d time.Duration) clockTimer {
+	return realTimer{time.NewTimer(d)}
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) Chan() <-chan time.Time {
+	return t.C
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) Chan() <-chan time.Time {
+	return t.C
+}
+
+func (t realTimer) Stop() {
+	t.Timer.Stop()
+}
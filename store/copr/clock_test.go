@@ -0,0 +1,121 @@
+// Copyright 2021 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package copr
+
+import (
+	"sync"
+	"time"
+)
+
+// fakeClock is a clock whose time only moves forward when Advance is called.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock *fakeClock
+	at    time.Time
+	// period is 0 for a timer.
+	period  time.Duration
+	ch      chan time.Time
+	stopped bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(0, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Since(t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) clockTimer {
+	return c.newTimer(d, d)
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) clockTimer {
+	return c.newTimer(d, 0)
+}
+
+func (c *fakeClock) newTimer(d, period time.Duration) *fakeTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, at: c.now.Add(d), period: period, ch: make(chan time.Time, 1)}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the time forward and fires the timers and tickers that are due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	timers := c.timers[:0]
+	for _, t := range c.timers {
+		for !t.stopped && !t.at.After(c.now) {
+			select {
+			case t.ch <- c.now:
+			default:
+			}
+			if t.period == 0 {
+				t.stopped = true
+			} else {
+				t.at = t.at.Add(t.period)
+			}
+		}
+		if !t.stopped {
+			timers = append(timers, t)
+		}
+	}
+	c.timers = timers
+}
+
+// WaitForTimers blocks until there are n active timers and tickers.
+func (c *fakeClock) WaitForTimers(n int) {
+	for {
+		c.mu.Lock()
+		active := len(c.timers)
+		c.mu.Unlock()
+		if active == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (t *fakeTimer) Chan() <-chan time.Time {
+	return t.ch
+}
+
+func (t *fakeTimer) Stop() {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t.stopped = true
+	for i, timer := range c.timers {
+		if timer == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			break
+		}
+	}
+}
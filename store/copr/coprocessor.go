@@ -65,6 +65,15 @@ type CopClient struct {
 	kv.RequestTypeSupportedChecker
 	store           *Store
 	replicaReadSeed uint32
+	// BalanceHook receives the balanced batch cop tasks, including the ones rebuilt on retry, and returns the
+	// tasks to be sent, it may reorder or rearrange them. It's nil by default, which means the tasks are kept.
+	BalanceHook func(tasks []*batchCopTask) []*batchCopTask
+	// AddrValidator validates the store address before a batch cop request is sent to it, the request is rejected
+	// when it returns an error. It's nil by default, which means no validation.
+	AddrValidator func(addr string) error
+	// AuditHook receives the redacted view of each batch cop request before it's sent, the retried requests are
+	// included. It's nil by default, which means no audit.
+	AuditHook func(record *BatchCopAuditRecord)
 }
 
 // Send builds the request and gets the coprocessor iterator response.
@@ -987,6 +996,11 @@ type CopRuntimeStats struct {
 	tikv.RegionRequestRuntimeStats
 
 	CoprCacheHit bool
+	// TiFlashCPUTime is the CPU time TiFlash spends on the batch cop response.
+	TiFlashCPUTime time.Duration
+	// CalleeStoreID is the id of the TiFlash store which serves the batch cop response, the address of the store
+	// is CalleeAddress.
+	CalleeStoreID uint64
 }
 
 func (worker *copIteratorWorker) handleTiDBSendReqErr(err error, task *copTask, ch chan<- *copResponse) error {
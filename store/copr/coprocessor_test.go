@@ -153,6 +153,56 @@ func TestBuildTasks(t *testing.T) {
 	taskEqual(t, tasks[1], regionIDs[2], "n", "p")
 }
 
+func TestSplitFirstRegions(t *testing.T) {
+	t.Parallel()
+	// nil --- 'g' --- 'n' --- 't' --- nil
+	// <-  0  -> <- 1 -> <- 2 -> <- 3 ->
+	mockClient, cluster, pdClient, err := testutils.NewMockTiKV("", nil)
+	require.NoError(t, err)
+	defer func() {
+		pdClient.Close()
+		err = mockClient.Close()
+		require.NoError(t, err)
+	}()
+
+	testutils.BootstrapWithMultiRegions(cluster, []byte("g"), []byte("n"), []byte("t"))
+	pdCli := &tikv.CodecPDClient{Client: pdClient}
+	defer pdCli.Close()
+
+	cache := NewRegionCache(tikv.NewRegionCache(pdCli))
+	defer cache.Close()
+
+	bo := backoff.NewBackofferWithVars(context.Background(), 3000, nil)
+	toSlice := func(ranges *KeyRanges) []kv.KeyRange {
+		var ret []kv.KeyRange
+		ranges.Do(func(ran *kv.KeyRange) {
+			ret = append(ret, *ran)
+		})
+		return ret
+	}
+
+	first, rest, err := cache.SplitFirstRegions(bo, buildCopRanges("a", "z"), 2)
+	require.NoError(t, err)
+	require.Equal(t, buildKeyRanges("a", "n"), toSlice(first))
+	require.Equal(t, buildKeyRanges("n", "z"), toSlice(rest))
+
+	// Only the regions touched by the ranges are counted.
+	first, rest, err = cache.SplitFirstRegions(bo, buildCopRanges("a", "b", "c", "d", "o", "p", "u", "v"), 2)
+	require.NoError(t, err)
+	require.Equal(t, buildKeyRanges("a", "b", "c", "d", "o", "p"), toSlice(first))
+	require.Equal(t, buildKeyRanges("u", "v"), toSlice(rest))
+
+	// The ranges of the last region are never split.
+	first, rest, err = cache.SplitFirstRegions(bo, buildCopRanges("h", "z"), 5)
+	require.NoError(t, err)
+	require.Equal(t, buildKeyRanges("h", "z"), toSlice(first))
+	require.Zero(t, rest.Len())
+	first, rest, err = cache.SplitFirstRegions(bo, buildCopRanges("h", "s"), 2)
+	require.NoError(t, err)
+	require.Equal(t, buildKeyRanges("h", "s"), toSlice(first))
+	require.Zero(t, rest.Len())
+}
+
 func TestSplitRegionRanges(t *testing.T) {
 	t.Parallel()
 	// nil --- 'g' --- 'n' --- 't' --- nil
@@ -65,7 +65,7 @@ func (c *MPPClient) ConstructMPPTasks(ctx context.Context, req *kv.MPPBuildTasks
 		return c.selectAllTiFlashStore(), nil
 	}
 	ranges := NewKeyRanges(req.KeyRanges)
-	tasks, err := buildBatchCopTasks(bo, c.store, ranges, kv.TiFlash, mppStoreLastFailTime, ttl)
+	tasks, err := buildBatchCopTasks(bo, c.store, c.store.GetRegionCache(), ranges, kv.TiFlash, mppStoreLastFailTime, ttl, nil, batchCopBuildOptions{})
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
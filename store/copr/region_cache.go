@@ -16,7 +16,10 @@ package copr
 
 import (
 	"bytes"
+	"sync"
+	"time"
 
+	"github.com/pingcap/kvproto/pkg/metapb"
 	"github.com/pingcap/tidb/kv"
 	derr "github.com/pingcap/tidb/store/driver/error"
 	"github.com/pingcap/tidb/util/logutil"
@@ -27,11 +30,54 @@ import (
 // RegionCache wraps tikv.RegionCache.
 type RegionCache struct {
 	*tikv.RegionCache
+	storeAddrs *storeAddrCache
 }
 
 // NewRegionCache returns a new RegionCache.
 func NewRegionCache(rc *tikv.RegionCache) *RegionCache {
-	return &RegionCache{rc}
+	return &RegionCache{RegionCache: rc, storeAddrs: newStoreAddrCache(storeAddrCacheTTL)}
+}
+
+// storeAddrCacheTTL is how long an address loaded from PD is reused before loading it again.
+const storeAddrCacheTTL = 30 * time.Second
+
+// storeAddrCache caches the addresses of the TiFlash stores loaded from PD, so that building the batch cop tasks
+// doesn't send a GetStore request for every store missing in the region cache. An empty address is cached too.
+type storeAddrCache struct {
+	ttl   time.Duration
+	clock clock
+	mu    sync.Mutex
+	// addrs maps the store id to its address and the time the address expires.
+	addrs map[uint64]storeAddrEntry
+}
+
+type storeAddrEntry struct {
+	addr     string
+	expireAt time.Time
+}
+
+func newStoreAddrCache(ttl time.Duration) *storeAddrCache {
+	return &storeAddrCache{ttl: ttl, clock: realClock{}, addrs: make(map[uint64]storeAddrEntry)}
+}
+
+// get returns the address of the store, load is called only when the store is not cached or the cached address
+// has expired. The errors of load are not cached.
+func (c *storeAddrCache) get(storeID uint64, load func() (string, error)) (string, error) {
+	now := c.clock.Now()
+	c.mu.Lock()
+	entry, ok := c.addrs[storeID]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expireAt) {
+		return entry.addr, nil
+	}
+	addr, err := load()
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	c.addrs[storeID] = storeAddrEntry{addr: addr, expireAt: now.Add(c.ttl)}
+	c.mu.Unlock()
+	return addr, nil
 }
 
 // SplitRegionRanges gets the split ranges from pd region.
@@ -108,6 +154,55 @@ func (c *RegionCache) SplitKeyRangesByLocations(bo *Backoffer, ranges *KeyRanges
 	return res, nil
 }
 
+// SplitFirstRegions splits the ranges into the ranges of the first n regions they touch and the rest ones.
+func (c *RegionCache) SplitFirstRegions(bo *Backoffer, ranges *KeyRanges, n int) (*KeyRanges, *KeyRanges, error) {
+	rest := ranges
+	for i := 0; i < n && rest.Len() > 0; i++ {
+		loc, err := c.LocateKey(bo.TiKVBackoffer(), rest.At(0).StartKey)
+		if err != nil {
+			return nil, nil, derr.ToTiDBErr(err)
+		}
+		if len(loc.EndKey) == 0 {
+			// The region is the last one, it holds all the rest ranges.
+			return ranges, NewKeyRanges(nil), nil
+		}
+		_, rest = rest.Split(loc.EndKey)
+	}
+	if rest.Len() == 0 {
+		return ranges, rest, nil
+	}
+	first, rest := ranges.Split(rest.At(0).StartKey)
+	return first, rest, nil
+}
+
+// ResolveTiFlashStoreAddr returns the address of the TiFlash store. The stores which are not resolved in the cache
+// yet are loaded from PD and kept for storeAddrCacheTTL, an empty address is returned if the store is tombstone or
+// not found.
+func (c *RegionCache) ResolveTiFlashStoreAddr(bo *Backoffer, storeID uint64) (string, error) {
+	for _, store := range c.GetTiFlashStores() {
+		if store.StoreID() == storeID && store.GetAddr() != "" {
+			return store.GetAddr(), nil
+		}
+	}
+	if c.storeAddrs == nil {
+		return c.loadTiFlashStoreAddr(bo, storeID)
+	}
+	return c.storeAddrs.get(storeID, func() (string, error) {
+		return c.loadTiFlashStoreAddr(bo, storeID)
+	})
+}
+
+func (c *RegionCache) loadTiFlashStoreAddr(bo *Backoffer, storeID uint64) (string, error) {
+	store, err := c.PDClient().GetStore(bo.GetCtx(), storeID)
+	if err != nil {
+		return "", derr.ToTiDBErr(err)
+	}
+	if store == nil || store.GetState() == metapb.StoreState_Tombstone {
+		return "", nil
+	}
+	return store.GetAddress(), nil
+}
+
 // OnSendFailForBatchRegions handles send request fail logic.
 func (c *RegionCache) OnSendFailForBatchRegions(bo *Backoffer, store *tikv.Store, regionInfos []RegionInfo, scheduleReload bool, err error) {
 	metrics.RegionCacheCounterWithSendFail.Add(float64(len(regionInfos)))
@@ -0,0 +1,72 @@
+// Copyright 2021 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package copr
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStoreAddrCache(t *testing.T) {
+	t.Parallel()
+	clock := newFakeClock()
+	cache := newStoreAddrCache(time.Minute)
+	cache.clock = clock
+	loads := map[uint64]int{}
+	addrs := map[uint64]string{1: "store1", 2: ""}
+	var loadErr error
+	get := func(storeID uint64) (string, error) {
+		return cache.get(storeID, func() (string, error) {
+			loads[storeID]++
+			if loadErr != nil {
+				return "", loadErr
+			}
+			return addrs[storeID], nil
+		})
+	}
+
+	for i := 0; i < 3; i++ {
+		addr, err := get(1)
+		require.NoError(t, err)
+		require.Equal(t, "store1", addr)
+		// The store not found is cached too.
+		addr, err = get(2)
+		require.NoError(t, err)
+		require.Equal(t, "", addr)
+	}
+	require.Equal(t, map[uint64]int{1: 1, 2: 1}, loads)
+
+	// The address is loaded again after it expires.
+	clock.Advance(time.Minute)
+	addrs[1] = "store1-new"
+	addr, err := get(1)
+	require.NoError(t, err)
+	require.Equal(t, "store1-new", addr)
+	require.Equal(t, 2, loads[1])
+
+	// The errors are not cached.
+	loadErr = errors.New("pd unavailable")
+	_, err = get(3)
+	require.Error(t, err)
+	loadErr = nil
+	addrs[3] = "store3"
+	addr, err = get(3)
+	require.NoError(t, err)
+	require.Equal(t, "store3", addr)
+	require.Equal(t, 2, loads[3])
+}
@@ -30,12 +30,63 @@ import (
 )
 
 type kvStore struct {
-	store *tikv.KVStore
+	store      *tikv.KVStore
+	storeAddrs *storeAddrCache
+	// balanceStrategy balances the batch cop tasks between the TiFlash stores, the greedy one is used if it's nil.
+	balanceStrategy BalanceStrategy
+	// storeWeights provides the store weights used to balance the batch cop tasks, all the stores have the same
+	// weight if it's nil.
+	storeWeights StoreWeightProvider
+	// metricSink receives the batch cop metrics, they are written to the Prometheus metrics if it's nil.
+	metricSink MetricSink
+	// regionRowsEstimator fills the EstRows of the regions, which are used by the size weighted balance strategy.
+	// The rows are unknown if it's nil.
+	regionRowsEstimator RegionRowsEstimator
+	// clock is the source of time of the batch cop, the real time is used if it's nil.
+	clock clock
+}
+
+// StoreOption configures the batch cop dependencies of the store.
+type StoreOption func(s *kvStore)
+
+// WithBatchCopBalanceStrategy sets the strategy used to balance the batch cop tasks between the TiFlash stores.
+func WithBatchCopBalanceStrategy(strategy BalanceStrategy) StoreOption {
+	return func(s *kvStore) {
+		s.balanceStrategy = strategy
+	}
+}
+
+// WithBatchCopStoreWeightProvider sets the provider of the store weights used to balance the batch cop tasks.
+func WithBatchCopStoreWeightProvider(weights StoreWeightProvider) StoreOption {
+	return func(s *kvStore) {
+		s.storeWeights = weights
+	}
+}
+
+// WithBatchCopMetricSink sets the sink the batch cop metrics are written to.
+func WithBatchCopMetricSink(sink MetricSink) StoreOption {
+	return func(s *kvStore) {
+		s.metricSink = sink
+	}
+}
+
+// WithBatchCopRegionRowsEstimator sets the estimator of the region rows used to balance the batch cop tasks.
+func WithBatchCopRegionRowsEstimator(estimator RegionRowsEstimator) StoreOption {
+	return func(s *kvStore) {
+		s.regionRowsEstimator = estimator
+	}
+}
+
+func (s *kvStore) batchCopBalanceStrategy() BalanceStrategy {
+	if s == nil || s.balanceStrategy == nil {
+		return NewGreedyBalanceStrategy()
+	}
+	return s.balanceStrategy
 }
 
 // GetRegionCache returns the region cache instance.
 func (s *kvStore) GetRegionCache() *RegionCache {
-	return &RegionCache{s.store.GetRegionCache()}
+	return &RegionCache{RegionCache: s.store.GetRegionCache(), storeAddrs: s.storeAddrs}
 }
 
 // CheckVisibility checks if it is safe to read using given ts.
@@ -73,14 +124,18 @@ type Store struct {
 }
 
 // NewStore creates a new store instance.
-func NewStore(s *tikv.KVStore, coprCacheConfig *config.CoprocessorCache) (*Store, error) {
+func NewStore(s *tikv.KVStore, coprCacheConfig *config.CoprocessorCache, opts ...StoreOption) (*Store, error) {
 	coprCache, err := newCoprCache(coprCacheConfig)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
+	store := &kvStore{store: s, storeAddrs: newStoreAddrCache(storeAddrCacheTTL)}
+	for _, opt := range opts {
+		opt(store)
+	}
 	/* #nosec G404 */
 	return &Store{
-		kvStore:         &kvStore{store: s},
+		kvStore:         store,
 		coprCache:       coprCache,
 		replicaReadSeed: rand.Uint32(),
 	}, nil
@@ -127,3 +182,24 @@ func getEndPointType(t kv.StoreType) tikvrpc.EndpointType {
 
 // Backoffer wraps tikv.Backoffer and converts the error which returns by the functions of tikv.Backoffer to tidb error.
 type Backoffer = backoff.Backoffer
+
+func (s *kvStore) batchCopStoreWeights() StoreWeightProvider {
+	if s == nil || s.storeWeights == nil {
+		return NewUniformStoreWeightProvider()
+	}
+	return s.storeWeights
+}
+
+func (s *kvStore) batchCopMetricSink() MetricSink {
+	if s == nil || s.metricSink == nil {
+		return NewPrometheusMetricSink()
+	}
+	return s.metricSink
+}
+
+func (s *kvStore) batchCopClock() clock {
+	if s == nil || s.clock == nil {
+		return realClock{}
+	}
+	return s.clock
+}